@@ -12,6 +12,11 @@ import (
 // Gateway4to6 is a primitive that allow client to have a ipv6 gateway
 type Gateway4to6 struct {
 	PublicKey string `json:"public_key"`
+	// Hostname is the name the reverse lookups of the peer address answer.
+	// It must be a subdomain reserved by the user or in a domain delegated by the user.
+	// All the peers of a user share its address, so they must use the same hostname.
+	// If not set, the gateway default name of the address is used, if configured
+	Hostname string `json:"hostname,omitempty"`
 }
 
 // Gateway4to6Result contains the configuration required by the user to
@@ -19,6 +24,8 @@ type Gateway4to6 struct {
 type Gateway4to6Result struct {
 	IPs   []string  `json:"ips"`
 	Peers []wg.Peer `json:"peers"`
+	// Hostname is the name the reverse lookups of the peer address answer
+	Hostname string `json:"hostname,omitempty"`
 }
 
 func (p *Provisioner) gateway4To6Provision(ctx context.Context, r *provision.Reservation) (interface{}, error) {
@@ -37,9 +44,23 @@ func (p *Provisioner) gateway4To6ProvisionImpl(ctx context.Context, r *provision
 		return Gateway4to6Result{}, err
 	}
 
+	ip, err := p.wg.PeerIP(r.User)
+	if err != nil {
+		return Gateway4to6Result{}, err
+	}
+
+	hostname, err := p.dns.AddPTR(r.User, data.PublicKey, ip, data.Hostname, 0)
+	if err != nil {
+		if err := p.wg.RemovePeer(data.PublicKey); err != nil {
+			log.Error().Err(err).Str("id", r.ID).Msg("failed to remove peer")
+		}
+		return Gateway4to6Result{}, err
+	}
+
 	return Gateway4to6Result{
-		IPs:   cfg.IPs,
-		Peers: cfg.Peers,
+		IPs:      cfg.IPs,
+		Peers:    cfg.Peers,
+		Hostname: hostname,
 	}, nil
 }
 
@@ -50,5 +71,14 @@ func (p *Provisioner) gateway4To6Decomission(ctx context.Context, r *provision.R
 	}
 	log.Info().Str("id", r.ID).Msgf("decomission gateway4to6 %+v", data)
 
-	return p.wg.RemovePeer(data.PublicKey)
+	if err := p.wg.RemovePeer(data.PublicKey); err != nil {
+		return err
+	}
+
+	ip, err := p.wg.PeerIP(r.User)
+	if err != nil {
+		return err
+	}
+
+	return p.dns.RemovePTR(data.PublicKey, ip, data.Hostname)
 }
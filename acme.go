@@ -0,0 +1,83 @@
+package tfgateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/tfgateway/audit"
+	"github.com/threefoldtech/tfgateway/dns"
+)
+
+// ACMEChallengeRequest is the body of the requests sent to the ACME challenge API.
+// PUT publishes Token as the DNS-01 challenge of Domain, DELETE clears it.
+// The request must be signed by User with the key registered in the explorer phonebook,
+// see SigningMessage. Nonce is a random string, a nonce is only accepted once by the gateway
+type ACMEChallengeRequest struct {
+	User      string `json:"user"`
+	Domain    string `json:"domain"`
+	Token     string `json:"token"`
+	Nonce     string `json:"nonce"`
+	Timestamp int64  `json:"timestamp"`
+	// Signature is the hex encoded signature of SigningMessage
+	Signature string `json:"signature"`
+}
+
+// SigningMessage returns the message the user signs for a request sent
+// with method to path of the gateway with identity gateway
+func (r ACMEChallengeRequest) SigningMessage(method, path, gateway string) []byte {
+	return []byte(fmt.Sprintf("%s:%s:%s:%s:%s:%s:%s:%d", method, path, gateway, r.User, r.Domain, r.Token, r.Nonce, r.Timestamp))
+}
+
+// acmeHandler lets the owners of subdomains and delegated domains publish
+// the TXT records needed to get certificates for them
+type acmeHandler struct {
+	dns     *dns.Mgr
+	keys    userKeyFetcher
+	gateway string
+	nonces  *nonceStore
+	timeout time.Duration
+}
+
+func (h *acmeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ACMEChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	msg := req.SigningMessage(r.Method, r.URL.Path, h.gateway)
+	if err := verifySignature(h.keys, req.User, msg, req.Signature, req.Timestamp); err != nil {
+		log.Warn().Err(err).Str("user", req.User).Str("domain", req.Domain).Msg("refused ACME challenge request")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.nonces.use(req.User, req.Nonce, req.Timestamp); err != nil {
+		log.Warn().Err(err).Str("user", req.User).Str("domain", req.Domain).Msg("refused ACME challenge request")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var err error
+	dns := h.dns.As(audit.Actor{User: req.User, Operation: "acme challenge"})
+	if r.Method == http.MethodPut {
+		err = dns.SetACMEChallenge(req.User, req.Domain, req.Token, h.timeout)
+	} else {
+		err = dns.ClearACMEChallenge(req.User, req.Domain, req.Token)
+	}
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
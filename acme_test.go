@@ -0,0 +1,99 @@
+package tfgateway
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/tfgateway/dns"
+	"github.com/threefoldtech/tfgateway/redis"
+)
+
+func TestACMEHandler(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	gwid := "gwid"
+	dnsMgr := dns.New(pool, gwid)
+	require.NoError(t, dnsMgr.AddDomainDelagate(gwid, gwid, "gateway.tf"))
+	require.NoError(t, dnsMgr.AddSubdomain("1", "app.gateway.tf", []net.IP{net.ParseIP("10.1.1.10")}, 0))
+
+	pk, sk, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	handler := &acmeHandler{
+		dns: dnsMgr,
+		keys: func(user string) (ed25519.PublicKey, error) {
+			return pk, nil
+		},
+		gateway: gwid,
+		nonces:  newNonceStore(),
+		timeout: time.Hour,
+	}
+
+	signed := func(method, gateway string, req ACMEChallengeRequest, key ed25519.PrivateKey) []byte {
+		req.Signature = hex.EncodeToString(ed25519.Sign(key, req.SigningMessage(method, "/acme/challenge", gateway)))
+		b, err := json.Marshal(req)
+		require.NoError(t, err)
+		return b
+	}
+
+	post := func(method string, b []byte) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, "/acme/challenge", bytes.NewReader(b)))
+		return w.Code
+	}
+
+	send := func(method string, req ACMEChallengeRequest, key ed25519.PrivateKey) int {
+		return post(method, signed(method, gwid, req, key))
+	}
+
+	req := ACMEChallengeRequest{User: "1", Domain: "app.gateway.tf", Token: "token", Nonce: "1", Timestamp: time.Now().Unix()}
+
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodPut, req, otherKey))
+
+	old := req
+	old.Timestamp = time.Now().Add(-time.Hour).Unix()
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodPut, old, sk))
+
+	other := req
+	other.User = "2"
+	assert.Equal(t, http.StatusForbidden, send(http.MethodPut, other, sk))
+
+	assert.Equal(t, http.StatusMethodNotAllowed, send(http.MethodGet, req, sk))
+
+	assert.Equal(t, http.StatusUnauthorized, post(http.MethodPut, signed(http.MethodPut, "other-gateway", req, sk)), "signed for another gateway")
+	assert.Equal(t, http.StatusUnauthorized, post(http.MethodPut, signed(http.MethodDelete, gwid, req, sk)), "signed for another method")
+
+	withoutNonce := req
+	withoutNonce.Nonce = ""
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodPut, withoutNonce, sk))
+
+	assert.Equal(t, http.StatusNoContent, send(http.MethodPut, req, sk))
+	assert.Contains(t, s.HGet("gateway.tf.", "_acme-challenge.app"), `"text":"token"`)
+
+	clear := req
+	clear.Nonce = "2"
+	assert.Equal(t, http.StatusNoContent, send(http.MethodDelete, clear, sk))
+	assert.Equal(t, "", s.HGet("gateway.tf.", "_acme-challenge.app"))
+
+	// the captured request can not be replayed
+	assert.Equal(t, http.StatusUnauthorized, send(http.MethodPut, req, sk))
+	assert.Equal(t, "", s.HGet("gateway.tf.", "_acme-challenge.app"))
+}
@@ -0,0 +1,120 @@
+package tfgateway
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/threefoldtech/tfgateway/dns"
+	"github.com/threefoldtech/zos/pkg/crypto"
+)
+
+// requestMaxAge is how old a signed API request can be before
+// it is refused, the nonces of the requests are remembered for
+// that long to prevent their replay
+const requestMaxAge = 5 * time.Minute
+
+// userKeyFetcher returns the public key of a user
+type userKeyFetcher func(user string) (ed25519.PublicKey, error)
+
+// APIHandler returns the handler of the API users call to manage their
+// names outside of reservations. The requests are signed by the users
+// with the key registered in the explorer phonebook.
+// /acme/challenge publishes and clears ACME challenges, see ACMEChallengeRequest.
+// The challenges not cleared are removed after acmeTimeout.
+// /transfer transfers a domain to another user, see TransferRequest
+// The signed messages include the method and path of the request, the identity
+// of the gateway and a nonce that can only be used once
+func (p *Provisioner) APIHandler(acmeTimeout time.Duration) http.Handler {
+	nonces := newNonceStore()
+	mux := http.NewServeMux()
+	mux.Handle("/acme/challenge", &acmeHandler{
+		dns:     p.dns,
+		keys:    p.fetchUserPublicKey,
+		gateway: p.kp.Identity(),
+		nonces:  nonces,
+		timeout: acmeTimeout,
+	})
+	mux.Handle("/transfer", &transferHandler{
+		provisioner: p,
+		keys:        p.fetchUserPublicKey,
+		gateway:     p.kp.Identity(),
+		nonces:      nonces,
+	})
+	return mux
+}
+
+// nonceStore remembers the nonces of the accepted requests until their
+// timestamp is too old for the request to be accepted again
+type nonceStore struct {
+	m    sync.Mutex
+	seen map[string]time.Time
+}
+
+func newNonceStore() *nonceStore {
+	return &nonceStore{seen: make(map[string]time.Time)}
+}
+
+// use records the nonce of a request of user signed at timestamp, it fails
+// if the nonce is empty or if it has already been used by user
+func (s *nonceStore) use(user, nonce string, timestamp int64) error {
+	if nonce == "" {
+		return fmt.Errorf("request nonce is missing")
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	for key, expiry := range s.seen {
+		if now.After(expiry) {
+			delete(s.seen, key)
+		}
+	}
+
+	key := fmt.Sprintf("%s:%s", user, nonce)
+	if _, ok := s.seen[key]; ok {
+		return fmt.Errorf("request nonce has already been used")
+	}
+	s.seen[key] = time.Unix(timestamp, 0).Add(requestMaxAge)
+
+	return nil
+}
+
+// verifySignature checks that signature is the hex encoded signature of msg
+// by user and that the request was signed around timestamp
+func verifySignature(keys userKeyFetcher, user string, msg []byte, signature string, timestamp int64) error {
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > requestMaxAge || age < -requestMaxAge {
+		return fmt.Errorf("request timestamp is too far from the gateway time")
+	}
+
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	key, err := keys(user)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve user %s public key: %w", user, err)
+	}
+
+	if err := crypto.Verify(key, msg, sig); err != nil {
+		return fmt.Errorf("invalid signature of user %s: %w", user, err)
+	}
+
+	return nil
+}
+
+// writeError sends err to the client of the API
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, dns.ErrAuth) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
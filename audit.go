@@ -0,0 +1,46 @@
+package tfgateway
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/threefoldtech/tfgateway/audit"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+// provisionerMethod and decommissionerMethod are the methods
+// of the Provisioner that handle a type of workload
+type (
+	provisionerMethod    func(p *Provisioner, ctx context.Context, r *provision.Reservation) (interface{}, error)
+	decommissionerMethod func(p *Provisioner, ctx context.Context, r *provision.Reservation) error
+)
+
+// as returns a copy of p that records the changes it makes
+// to the DNS and proxies configuration as made by actor
+func (p *Provisioner) as(actor audit.Actor) *Provisioner {
+	cp := *p
+	cp.dns = p.dns.As(actor)
+	cp.proxy = p.proxy.As(actor)
+	return &cp
+}
+
+// reservationActor is the actor of the changes made for reservation r
+func reservationActor(r *provision.Reservation, operation string) audit.Actor {
+	return audit.Actor{
+		User:        r.User,
+		Reservation: r.ID,
+		Operation:   fmt.Sprintf("%s %s", operation, r.Type),
+	}
+}
+
+func (p *Provisioner) auditProvision(fn provisionerMethod) provision.ProvisionerFunc {
+	return func(ctx context.Context, r *provision.Reservation) (interface{}, error) {
+		return fn(p.as(reservationActor(r, "provision")), ctx, r)
+	}
+}
+
+func (p *Provisioner) auditDecommission(fn decommissionerMethod) provision.DecomissionerFunc {
+	return func(ctx context.Context, r *provision.Reservation) error {
+		return fn(p.as(reservationActor(r, "decommission")), ctx, r)
+	}
+}
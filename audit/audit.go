@@ -0,0 +1,306 @@
+// Package audit keeps the history of the changes made to the DNS and
+// TCP router configuration stored in redis, so they can be investigated later
+package audit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Actor is who changes the configuration, and why
+type Actor struct {
+	// User is the ID of the user the change is made for, if any
+	User string
+	// Reservation is the ID of the reservation that caused the change, if any
+	Reservation string
+	// Operation is what the gateway was doing, like provision subdomain or health check
+	Operation string
+}
+
+// Entry is a change of a single configuration value
+type Entry struct {
+	// ID is set by the Log the entry is read from
+	ID          string    `json:"id,omitempty"`
+	Time        time.Time `json:"time"`
+	User        string    `json:"user,omitempty"`
+	Reservation string    `json:"reservation,omitempty"`
+	Operation   string    `json:"operation,omitempty"`
+	// Object is the kind of value changed, like records or proxy
+	Object string `json:"object"`
+	Domain string `json:"domain"`
+	// Before and After are empty if the value is created or deleted
+	Before string `json:"before,omitempty"`
+	After  string `json:"after,omitempty"`
+}
+
+// Filter selects entries of a Log. The empty fields are not used
+type Filter struct {
+	// Domain selects the entries of the domain and of its subdomains
+	Domain string
+	User   string
+	From   time.Time
+	To     time.Time
+	// Limit is the maximum number of entries returned, the oldest first
+	Limit int
+}
+
+// Match checks e is selected by the filter
+func (f Filter) Match(e Entry) bool {
+	if f.Domain != "" {
+		domain := strings.ToLower(strings.TrimPrefix(e.Domain, "*."))
+		want := strings.ToLower(f.Domain)
+		if domain != want && !strings.HasSuffix(domain, "."+want) {
+			return false
+		}
+	}
+
+	if f.User != "" && e.User != f.User {
+		return false
+	}
+
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+
+	if !f.To.IsZero() && e.Time.After(f.To) {
+		return false
+	}
+
+	return true
+}
+
+// Log is an append-only store of entries
+type Log interface {
+	Append(entries ...Entry) error
+	// Query returns the entries selected by filter, oldest first
+	Query(filter Filter) ([]Entry, error)
+}
+
+// Key tells what a redis key, or a field of a redis hash, configures
+type Key struct {
+	Object string
+	Domain string
+	// Decode makes the values of the key readable, the values are kept as is if it is nil
+	Decode func(value string) string
+}
+
+// Describer describes the redis keys of a component. field is empty for the keys
+// that are not hashes. ok is false if the key does not hold configuration
+type Describer func(key, field string) (k Key, ok bool)
+
+// Command is a redis command that changes the configuration
+type Command struct {
+	Name string
+	Args []interface{}
+}
+
+// Recorder turns the redis commands that change the configuration into
+// entries of a Log. A nil Recorder records nothing
+type Recorder struct {
+	log      Log
+	describe []Describer
+}
+
+// NewRecorder creates a Recorder that appends to log the changes made
+// to the keys described by one of describe
+func NewRecorder(log Log, describe ...Describer) *Recorder {
+	return &Recorder{log: log, describe: describe}
+}
+
+// Prepare reads with con the values that cmds are about to change and returns
+// the entries of the changes made by actor. It must be called before cmds are
+// sent, on the connection that watches the keys if cmds are sent in a transaction.
+// The entries are appended to the log with Commit once cmds succeeded.
+// HSET, HDEL, SET and DEL are supported, other commands are ignored
+func (r *Recorder) Prepare(con redis.Conn, actor Actor, cmds ...Command) ([]Entry, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	p := preparer{
+		recorder: r,
+		con:      con,
+		actor:    actor,
+		pending:  make(map[field]string),
+	}
+
+	for _, cmd := range cmds {
+		if err := p.prepare(cmd); err != nil {
+			return nil, errors.Wrapf(err, "failed to prepare audit of %s", cmd.Name)
+		}
+	}
+
+	return p.entries, nil
+}
+
+// Commit appends the entries returned by Prepare to the log. The changes are
+// already applied, so a failure is only logged
+func (r *Recorder) Commit(entries []Entry) {
+	if r == nil || len(entries) == 0 {
+		return
+	}
+
+	now := time.Now().UTC()
+	for i := range entries {
+		entries[i].Time = now
+	}
+
+	if err := r.log.Append(entries...); err != nil {
+		log.Error().Err(err).Interface("entries", entries).Msg("failed to append to the audit log")
+	}
+}
+
+func (r *Recorder) key(key, field string) (Key, bool) {
+	for _, describe := range r.describe {
+		if k, ok := describe(key, field); ok {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+// preparer holds the state of Recorder.Prepare
+type preparer struct {
+	recorder *Recorder
+	con      redis.Conn
+	actor    Actor
+	// pending are the values set by the commands already prepared,
+	// indexed by key and field
+	pending map[field]string
+	entries []Entry
+}
+
+func (p *preparer) prepare(cmd Command) error {
+	args := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		args[i] = argString(arg)
+	}
+
+	if len(args) == 0 {
+		return nil
+	}
+
+	key, args := args[0], args[1:]
+	switch strings.ToUpper(cmd.Name) {
+	case "HSET":
+		for i := 0; i+1 < len(args); i += 2 {
+			if err := p.change(field{key, args[i], true}, args[i+1]); err != nil {
+				return err
+			}
+		}
+	case "HDEL":
+		for _, name := range args {
+			if err := p.change(field{key, name, true}, ""); err != nil {
+				return err
+			}
+		}
+	case "SET":
+		if len(args) > 0 {
+			return p.change(field{key: key}, args[0])
+		}
+	case "DEL":
+		for _, key := range append([]string{key}, args...) {
+			if err := p.delete(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// delete prepares the deletion of a whole key
+func (p *preparer) delete(key string) error {
+	typ, err := redis.String(p.con.Do("TYPE", key))
+	if err != nil {
+		return err
+	}
+
+	switch typ {
+	case "string":
+		return p.change(field{key: key}, "")
+	case "hash":
+		names, err := redis.Strings(p.con.Do("HKEYS", key))
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			if err := p.change(field{key, name, true}, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// field is a redis key, or a field of a redis hash
+type field struct {
+	key  string
+	name string
+	hash bool
+}
+
+// change prepares the change of f to value
+func (p *preparer) change(f field, value string) error {
+	k, ok := p.recorder.key(f.key, f.name)
+	if !ok {
+		return nil
+	}
+
+	before, ok := p.pending[f]
+	if !ok {
+		var err error
+		if f.hash {
+			before, err = redis.String(p.con.Do("HGET", f.key, f.name))
+		} else {
+			before, err = redis.String(p.con.Do("GET", f.key))
+		}
+		if err != nil && !errors.Is(err, redis.ErrNil) {
+			return err
+		}
+	}
+	p.pending[f] = value
+
+	if before == value {
+		return nil
+	}
+
+	if k.Decode != nil {
+		if before != "" {
+			before = k.Decode(before)
+		}
+		if value != "" {
+			value = k.Decode(value)
+		}
+	}
+
+	p.entries = append(p.entries, Entry{
+		User:        p.actor.User,
+		Reservation: p.actor.Reservation,
+		Operation:   p.actor.Operation,
+		Object:      k.Object,
+		Domain:      k.Domain,
+		Before:      before,
+		After:       value,
+	})
+
+	return nil
+}
+
+func argString(arg interface{}) string {
+	switch arg := arg.(type) {
+	case string:
+		return arg
+	case []byte:
+		return string(arg)
+	default:
+		return fmt.Sprint(arg)
+	}
+}
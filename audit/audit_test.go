@@ -0,0 +1,207 @@
+package audit
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/tfgateway/redis"
+)
+
+func describe(key, field string) (Key, bool) {
+	switch key {
+	case "owners":
+		return Key{Object: "owner", Domain: field}, true
+	case "proxy":
+		return Key{Object: "proxy", Domain: "example.com", Decode: func(v string) string { return "<" + v + ">" }}, true
+	}
+	return Key{}, false
+}
+
+func TestRecorder(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logs := map[string]Log{
+		"stream": NewStream(pool),
+		"file":   NewFile(filepath.Join(dir, "audit.log")),
+	}
+
+	for name, log := range logs {
+		t.Run(name, func(t *testing.T) {
+			s.FlushAll()
+			s.HSet("owners", "app.example.com", "user1")
+
+			con := pool.Get()
+			defer con.Close()
+
+			recorder := NewRecorder(log, describe)
+			actor := Actor{User: "user2", Reservation: "12", Operation: "provision"}
+			cmds := []Command{
+				{Name: "HSET", Args: []interface{}{"owners", "app.example.com", "user2", "www.example.com", []byte("user2")}},
+				// an undescribed key is not recorded
+				{Name: "HSET", Args: []interface{}{"index", "app.example.com", 1}},
+				{Name: "SET", Args: []interface{}{"proxy", "10.1.1.10"}},
+				// the value set by the previous command is the value before this one
+				{Name: "HDEL", Args: []interface{}{"owners", "www.example.com"}},
+			}
+
+			entries, err := recorder.Prepare(con, actor, cmds...)
+			require.NoError(t, err)
+			require.Len(t, entries, 4)
+			recorder.Commit(entries)
+
+			all, err := log.Query(Filter{})
+			require.NoError(t, err)
+			require.Len(t, all, 4)
+
+			assert.Equal(t, "user2", all[0].User)
+			assert.Equal(t, "12", all[0].Reservation)
+			assert.Equal(t, "provision", all[0].Operation)
+			assert.Equal(t, "owner", all[0].Object)
+			assert.Equal(t, "app.example.com", all[0].Domain)
+			assert.Equal(t, "user1", all[0].Before)
+			assert.Equal(t, "user2", all[0].After)
+			assert.NotEmpty(t, all[0].ID)
+			assert.WithinDuration(t, time.Now(), all[0].Time, time.Minute)
+
+			assert.Equal(t, "", all[1].Before)
+			assert.Equal(t, "user2", all[1].After)
+
+			assert.Equal(t, "proxy", all[2].Object)
+			assert.Equal(t, "<10.1.1.10>", all[2].After)
+
+			assert.Equal(t, "www.example.com", all[3].Domain)
+			assert.Equal(t, "user2", all[3].Before)
+			assert.Equal(t, "", all[3].After)
+
+			entries, err = log.Query(Filter{Domain: "www.example.com"})
+			require.NoError(t, err)
+			assert.Len(t, entries, 2)
+
+			entries, err = log.Query(Filter{Domain: "example.com", User: "user1"})
+			require.NoError(t, err)
+			assert.Len(t, entries, 0)
+
+			entries, err = log.Query(Filter{From: time.Now().Add(time.Hour)})
+			require.NoError(t, err)
+			assert.Len(t, entries, 0)
+
+			entries, err = log.Query(Filter{From: time.Now().Add(-time.Hour), To: time.Now().Add(time.Hour)})
+			require.NoError(t, err)
+			assert.Len(t, entries, 4)
+		})
+	}
+}
+
+func TestRecorderDelete(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	s.HSet("owners", "app.example.com", "user1")
+	s.HSet("owners", "www.example.com", "user2")
+
+	con := pool.Get()
+	defer con.Close()
+
+	recorder := NewRecorder(NewStream(pool), describe)
+	entries, err := recorder.Prepare(con, Actor{}, Command{Name: "DEL", Args: []interface{}{"owners", "missing"}})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.NotEmpty(t, entry.Before)
+		assert.Empty(t, entry.After)
+	}
+
+	var nothing *Recorder
+	entries, err = nothing.Prepare(con, Actor{}, Command{Name: "DEL", Args: []interface{}{"owners"}})
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	nothing.Commit(entries)
+}
+
+func TestStreamMaxEntries(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	stream := NewStream(pool)
+	assert.Error(t, stream.SetMaxEntries(-1))
+	require.NoError(t, stream.SetMaxEntries(3))
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, stream.Append(Entry{Domain: fmt.Sprintf("app%d.example.com", i)}))
+	}
+
+	entries, err := stream.Query(Filter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "app2.example.com", entries[0].Domain, "the oldest entries are trimmed")
+}
+
+func TestStreamQueryPages(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	pageSize := queryPageSize
+	queryPageSize = 2
+	defer func() { queryPageSize = pageSize }()
+
+	stream := NewStream(pool)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, stream.Append(Entry{Domain: fmt.Sprintf("app%d.example.com", i), User: fmt.Sprint(i % 2)}))
+	}
+
+	entries, err := stream.Query(Filter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 5, "all the pages are read")
+	for i, entry := range entries {
+		assert.Equal(t, fmt.Sprintf("app%d.example.com", i), entry.Domain)
+	}
+
+	entries, err = stream.Query(Filter{Limit: 3})
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.Equal(t, "app2.example.com", entries[2].Domain)
+
+	entries, err = stream.Query(Filter{User: "0", Limit: 2})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "app0.example.com", entries[0].Domain)
+	assert.Equal(t, "app2.example.com", entries[1].Domain)
+
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := NewFile(filepath.Join(dir, "audit.log"))
+	require.NoError(t, file.Append(entries...))
+	entries, err = file.Query(Filter{Limit: 1})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// File is a Log kept in a local file, with one JSON encoded entry per line.
+// The ID of the entries is their line number
+type File struct {
+	path string
+	m    sync.Mutex
+}
+
+// NewFile creates a Log kept in the file at path, the file
+// is created when the first entries are appended
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+// Append implements Log
+func (f *File) Append(entries ...Entry) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	// the file is opened for every append, so it can be rotated
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open audit log %s", f.path)
+	}
+
+	enc := json.NewEncoder(file)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			file.Close()
+			return errors.Wrapf(err, "failed to write audit log %s", f.path)
+		}
+	}
+
+	return file.Close()
+}
+
+// Query implements Log
+func (f *File) Query(filter Filter) ([]Entry, error) {
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to open audit log %s", f.path)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, errors.Wrapf(err, "invalid audit entry at %s:%d", f.path, n)
+		}
+		entry.ID = strconv.Itoa(n)
+
+		if filter.Match(entry) {
+			entries = append(entries, entry)
+		}
+
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			return entries, nil
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read audit log %s", f.path)
+	}
+
+	return entries, nil
+}
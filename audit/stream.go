@@ -0,0 +1,154 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// StreamKey is the redis stream used by Stream
+const StreamKey = "tfgateway_audit"
+
+// queryPageSize is how many messages of the stream are read at once by Query
+var queryPageSize = 1000
+
+// Stream is a Log kept in a redis stream. The ID of the entries is
+// the ID given by redis, which starts with the time in milliseconds
+type Stream struct {
+	redis      *redis.Pool
+	maxEntries int
+}
+
+// NewStream creates a Log kept in the stream StreamKey
+func NewStream(pool *redis.Pool) *Stream {
+	return &Stream{redis: pool}
+}
+
+// SetMaxEntries caps the number of entries kept in the stream, the oldest
+// entries are trimmed when new ones are appended. redis trims the stream
+// efficiently, so it can hold a few more entries than max.
+// 0, the default, keeps all the entries
+func (s *Stream) SetMaxEntries(max int) error {
+	if max < 0 {
+		return fmt.Errorf("invalid maximum number of audit entries %d", max)
+	}
+
+	s.maxEntries = max
+	return nil
+}
+
+// Append implements Log
+func (s *Stream) Append(entries ...Entry) error {
+	con := s.redis.Get()
+	defer con.Close()
+
+	for _, entry := range entries {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+
+		args := redis.Args{StreamKey}
+		if s.maxEntries > 0 {
+			args = args.Add("MAXLEN", "~", s.maxEntries)
+		}
+
+		if err := con.Send("XADD", args.Add("*", "entry", b)...); err != nil {
+			return err
+		}
+	}
+
+	if err := con.Flush(); err != nil {
+		return errors.Wrap(err, "failed to append to the audit stream")
+	}
+
+	for range entries {
+		if _, err := con.Receive(); err != nil {
+			return errors.Wrap(err, "failed to append to the audit stream")
+		}
+	}
+
+	return nil
+}
+
+// Query implements Log
+func (s *Stream) Query(filter Filter) ([]Entry, error) {
+	start, end := "-", "+"
+	if !filter.From.IsZero() {
+		start = fmt.Sprint(filter.From.UnixNano() / 1e6)
+	}
+	if !filter.To.IsZero() {
+		end = fmt.Sprint(filter.To.UnixNano() / 1e6)
+	}
+
+	con := s.redis.Get()
+	defer con.Close()
+
+	// the stream is read by pages so a large stream is never loaded at once
+	var entries []Entry
+	for {
+		values, err := redis.Values(con.Do("XRANGE", StreamKey, start, end, "COUNT", queryPageSize))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read the audit stream")
+		}
+
+		var id string
+		for _, value := range values {
+			var fields []string
+			message, err := redis.Values(value, nil)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := redis.Scan(message, &id, &fields); err != nil {
+				return nil, errors.Wrap(err, "invalid audit stream message")
+			}
+
+			for i := 0; i+1 < len(fields); i += 2 {
+				if fields[i] != "entry" {
+					continue
+				}
+
+				var entry Entry
+				if err := json.Unmarshal([]byte(fields[i+1]), &entry); err != nil {
+					return nil, errors.Wrapf(err, "invalid audit entry %s", id)
+				}
+				entry.ID = id
+
+				if filter.Match(entry) {
+					entries = append(entries, entry)
+				}
+			}
+
+			if filter.Limit > 0 && len(entries) >= filter.Limit {
+				return entries[:filter.Limit], nil
+			}
+		}
+
+		if len(values) < queryPageSize {
+			return entries, nil
+		}
+
+		if start, err = nextStreamID(id); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// nextStreamID returns the smallest stream ID greater than id
+func nextStreamID(id string) (string, error) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid audit stream ID %s", id)
+	}
+
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid audit stream ID %s", id)
+	}
+
+	return fmt.Sprintf("%s-%d", parts[0], seq+1), nil
+}
@@ -0,0 +1,62 @@
+package tfgateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/tfgateway/audit"
+	"github.com/threefoldtech/tfgateway/dns"
+	"github.com/threefoldtech/tfgateway/proxy"
+	"github.com/threefoldtech/tfgateway/redis"
+	"github.com/threefoldtech/zos/pkg/identity"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+func TestProvisionAudit(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	log := audit.NewStream(pool)
+	recorder := audit.NewRecorder(log, dns.Describe, proxy.Describe)
+
+	gwid := "gwid"
+	dnsMgr := dns.New(pool, gwid)
+	dnsMgr.SetAuditRecorder(recorder)
+	proxyMgr := proxy.New(pool)
+	proxyMgr.SetAuditRecorder(recorder)
+	require.NoError(t, dnsMgr.AddDomainDelagate(gwid, gwid, "gateway.tf"))
+
+	p := NewProvisioner(proxyMgr, dnsMgr, nil, nil, nil, identity.KeyPair{}, nil)
+
+	b, err := json.Marshal(Subdomain{Domain: "app.gateway.tf", IPs: []net.IP{net.ParseIP("10.1.1.10")}})
+	require.NoError(t, err)
+	r := &provision.Reservation{ID: "42", NodeID: gwid, User: "user", Type: SubDomainReservation, Data: b}
+
+	_, err = p.Provisioners[SubDomainReservation](context.Background(), r)
+	require.NoError(t, err)
+	require.NoError(t, p.Decommissioners[SubDomainReservation](context.Background(), r))
+
+	entries, err := log.Query(audit.Filter{Domain: "app.gateway.tf"})
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	for i, entry := range entries {
+		assert.Equal(t, "user", entry.User)
+		assert.Equal(t, "42", entry.Reservation)
+		if i < 2 {
+			assert.Equal(t, "provision subdomain", entry.Operation)
+		} else {
+			assert.Equal(t, "decommission subdomain", entry.Operation)
+		}
+	}
+}
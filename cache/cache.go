@@ -120,6 +120,31 @@ func (s *Redis) Remove(id string) error {
 	return err
 }
 
+// List returns all the reservations present in the cache
+func (s *Redis) List() ([]*provision.Reservation, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	con := s.pool.Get()
+	defer con.Close()
+
+	ids, err := redis.ByteSlices(con.Do("HKEYS", reservationsKey))
+	if err != nil {
+		return nil, err
+	}
+
+	rs := make([]*provision.Reservation, 0, len(ids))
+	for _, id := range ids {
+		r, err := s.get(string(id))
+		if err != nil {
+			return nil, err
+		}
+		rs = append(rs, r)
+	}
+
+	return rs, nil
+}
+
 // GetExpired returns all id the the reservations that are expired
 // at the time of the function call
 func (s *Redis) GetExpired() ([]*provision.Reservation, error) {
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/threefoldtech/tfgateway"
+	"github.com/threefoldtech/tfgateway/audit"
+	"github.com/threefoldtech/tfgateway/dns"
+	"github.com/threefoldtech/tfgateway/proxy"
+	"github.com/threefoldtech/tfgateway/redis"
+	"github.com/urfave/cli/v2"
+)
+
+var auditCommand = &cli.Command{
+	Name:  "audit",
+	Usage: "query the audit log of the changes made to the DNS zones and the proxies",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "domain",
+			Usage: "only show the changes of this domain and of its subdomains",
+		},
+		&cli.StringFlag{
+			Name:  "user",
+			Usage: "only show the changes made for this user",
+		},
+		&cli.StringFlag{
+			Name:  "from",
+			Usage: "only show the changes made after this time, either RFC 3339 or a duration like 24h before now",
+		},
+		&cli.StringFlag{
+			Name:  "to",
+			Usage: "only show the changes made before this time, either RFC 3339 or a duration like 1h before now",
+		},
+		&cli.IntFlag{
+			Name:  "limit",
+			Usage: "show at most this number of changes, the oldest first, 0 shows all the changes",
+			Value: 1000,
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "print the entries as JSON, one per line",
+		},
+	},
+	Action: auditQuery,
+}
+
+// auditLog returns the audit log configured with --audit-log
+func auditLog(c *cli.Context, pool *redigo.Pool) (audit.Log, error) {
+	if path := c.String("audit-log"); path != "" {
+		return audit.NewFile(path), nil
+	}
+
+	stream := audit.NewStream(pool)
+	if err := stream.SetMaxEntries(c.Int("audit-max-entries")); err != nil {
+		return nil, err
+	}
+	return stream, nil
+}
+
+// auditRecorder returns the recorder of the changes made by the DNS and proxy managers
+func auditRecorder(c *cli.Context, pool *redigo.Pool) (*audit.Recorder, error) {
+	log, err := auditLog(c, pool)
+	if err != nil {
+		return nil, err
+	}
+	return audit.NewRecorder(log, dns.Describe, proxy.Describe), nil
+}
+
+func auditQuery(c *cli.Context) error {
+	pool, err := redis.NewPool(c.String("redis"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	domain, err := tfgateway.ParseDomainName(c.String("domain"))
+	if err != nil {
+		return fmt.Errorf("invalid --domain: %w", err)
+	}
+
+	filter := audit.Filter{
+		Domain: domain.ASCII,
+		User:   c.String("user"),
+		Limit:  c.Int("limit"),
+	}
+
+	if filter.Limit < 0 {
+		return fmt.Errorf("invalid --limit %d", filter.Limit)
+	}
+
+	now := time.Now()
+	if filter.From, err = parseTime(c.String("from"), now); err != nil {
+		return fmt.Errorf("invalid --from: %w", err)
+	}
+	if filter.To, err = parseTime(c.String("to"), now); err != nil {
+		return fmt.Errorf("invalid --to: %w", err)
+	}
+
+	log, err := auditLog(c, pool)
+	if err != nil {
+		return err
+	}
+
+	entries, err := log.Query(filter)
+	if err != nil {
+		return err
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		for _, entry := range entries {
+			if err := enc.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tUSER\tRESERVATION\tOPERATION\tOBJECT\tDOMAIN\tBEFORE\tAFTER")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Format(time.RFC3339),
+			orDash(e.User), orDash(e.Reservation), orDash(e.Operation),
+			e.Object, e.Domain, orDash(e.Before), orDash(e.After),
+		)
+	}
+	return w.Flush()
+}
+
+// parseTime parses a time given as RFC 3339 or as a duration before now
+func parseTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
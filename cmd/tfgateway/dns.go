@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/threefoldtech/tfgateway/audit"
+	"github.com/threefoldtech/tfgateway/dns"
+	"github.com/threefoldtech/tfgateway/redis"
+	"github.com/threefoldtech/zos/pkg/identity"
+	"github.com/urfave/cli/v2"
+)
+
+var dnsCommand = &cli.Command{
+	Name:  "dns",
+	Usage: "inspect and manage the DNS zones served by the gateway",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "export",
+			Usage:     "print a zone in the RFC 1035 master file format",
+			ArgsUsage: "<zone>",
+			Action:    dnsExport,
+		},
+		{
+			Name:      "import",
+			Usage:     "import a zone file in the RFC 1035 master file format into a delegated zone",
+			ArgsUsage: "<zone> <file|->",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "user",
+					Usage:    "ID of the user that delegated the zone",
+					Required: true,
+				},
+			},
+			Action: dnsImport,
+		},
+	},
+}
+
+func dnsMgr(c *cli.Context) (*dns.Mgr, error) {
+	pool, err := redis.NewPool(c.String("redis"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	kp, err := identity.LoadKeyPair(c.String("seed"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read identity seed: %w", err)
+	}
+
+	recorder, err := auditRecorder(c, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	// the imported records are clamped to the same TTL range as the daemon
+	mgr := dns.New(pool, kp.Identity())
+	if err := mgr.SetTTLRange(c.Int("min-ttl"), c.Int("max-ttl")); err != nil {
+		return nil, err
+	}
+	mgr.SetAuditRecorder(recorder)
+	return mgr, nil
+}
+
+func dnsExport(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf("usage: %s", c.Command.ArgsUsage)
+	}
+
+	mgr, err := dnsMgr(c)
+	if err != nil {
+		return err
+	}
+
+	return mgr.ExportZone(c.Args().Get(0), os.Stdout)
+}
+
+func dnsImport(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("usage: %s", c.Command.ArgsUsage)
+	}
+
+	mgr, err := dnsMgr(c)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if path := c.Args().Get(1); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	user := c.String("user")
+	return mgr.As(audit.Actor{User: user, Operation: "dns import"}).ImportZone(user, c.Args().Get(0), r)
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/ed25519"
 	"encoding/hex"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
 	"time"
 
@@ -13,10 +15,12 @@ import (
 
 	"github.com/shirou/gopsutil/host"
 	"github.com/threefoldtech/tfgateway"
+	"github.com/threefoldtech/tfgateway/audit"
 	"github.com/threefoldtech/tfgateway/cache"
 	"github.com/threefoldtech/tfgateway/dns"
 	"github.com/threefoldtech/tfgateway/proxy"
 	"github.com/threefoldtech/tfgateway/redis"
+	"github.com/threefoldtech/tfgateway/reserved"
 	"github.com/threefoldtech/tfgateway/wg"
 	"github.com/threefoldtech/zos/pkg/app"
 	"github.com/threefoldtech/zos/pkg/crypto"
@@ -85,6 +89,76 @@ var appCLI = cli.App{
 			Usage: "name of the wireguard interface created for the 4to6 tunnel primitive",
 			Value: "wg-tfgateway",
 		},
+		&cli.StringFlag{
+			Name:  "ptr-domain",
+			Usage: "domain of the names the reverse lookups of the 4to6 tunnel addresses answer when the user does not set a hostname, the name of an address is its hexadecimal form under this domain. If not set, such addresses have no PTR record",
+		},
+		&cli.StringFlag{
+			Name:  "dns-listen",
+			Usage: "if specified, the gateway serves the DNS zones it manages itself on this address (udp and tcp), format: host:port. This replaces coredns-redis",
+		},
+		&cli.StringFlag{
+			Name:  "geoip-db",
+			Usage: "path to the file mapping networks to regions, used by the built-in DNS server to answer clients with the records of their region. Each line is a network in CIDR notation followed by its region",
+		},
+		&cli.BoolFlag{
+			Name:  "dnssec",
+			Usage: "sign the zones served by the built-in DNS server with DNSSEC, requires --dns-listen",
+		},
+		&cli.IntFlag{
+			Name:  "min-ttl",
+			Usage: "minimum TTL in seconds users can set on their records",
+			Value: 60,
+		},
+		&cli.IntFlag{
+			Name:  "max-ttl",
+			Usage: "maximum TTL in seconds users can set on their records",
+			Value: 86400,
+		},
+		&cli.IntFlag{
+			Name:  "max-health-checks",
+			Usage: "maximum number of health checks a user can set on the backends of its subdomains",
+			Value: 20,
+		},
+		&cli.BoolFlag{
+			Name:  "verify-delegation",
+			Usage: "only accept domain delegations once the domain holds the TXT challenge of the user",
+		},
+		&cli.DurationFlag{
+			Name:  "reconcile-interval",
+			Usage: "how often the DNS and TCP router configuration is compared with the reservations, 0 disables the reconciliation",
+			Value: time.Hour,
+		},
+		&cli.BoolFlag{
+			Name:  "reconcile-repair",
+			Usage: "repair the differences found between the configuration and the reservations instead of only reporting them",
+		},
+		&cli.StringFlag{
+			Name:  "reserved-labels",
+			Usage: "path to the file listing the labels users cannot reserve under --domains, the file is reloaded when it changes",
+		},
+		&cli.StringSliceFlag{
+			Name:  "quota",
+			Usage: "limit the number of reservations of a type users can have, format: [<user>:]<type>=<limit>. Without user, the limit applies to all users. A negative limit means unlimited",
+		},
+		&cli.StringFlag{
+			Name:  "api-listen",
+			Usage: "if specified, serves the API users call to publish their ACME DNS-01 challenges and transfer their domains on this address, format: host:port",
+		},
+		&cli.DurationFlag{
+			Name:  "acme-challenge-timeout",
+			Usage: "how long an ACME challenge is published if the user does not clear it",
+			Value: dns.DefaultACMEChallengeTimeout,
+		},
+		&cli.StringFlag{
+			Name:  "audit-log",
+			Usage: "path to the file the changes made to the DNS zones and the proxies are appended to. If not set, the changes are appended to the redis stream " + audit.StreamKey,
+		},
+		&cli.IntFlag{
+			Name:  "audit-max-entries",
+			Usage: "maximum number of entries kept in the redis stream " + audit.StreamKey + ", the oldest entries are trimmed. 0 keeps all the entries",
+			Value: 1000000,
+		},
 		&cli.BoolFlag{
 			Name:  "free",
 			Usage: "if specified, the gateway will be marked as free to use and capacity can be reserved using FreeTFT",
@@ -102,6 +176,10 @@ var appCLI = cli.App{
 		return nil
 	},
 	Action: run,
+	Commands: []*cli.Command{
+		dnsCommand,
+		auditCommand,
+	},
 }
 
 func validDomain(d string) bool {
@@ -160,14 +238,49 @@ func run(c *cli.Context) error {
 		return fmt.Errorf("invalid nameservers: %v", nameservers)
 	}
 
+	var signer *dns.Signer
+	if c.Bool("dnssec") {
+		if c.String("dns-listen") == "" {
+			return fmt.Errorf("--dnssec requires the built-in DNS server, use --dns-listen")
+		}
+		signer = dns.NewSigner(kp.PrivateKey.Seed())
+	}
+
 	dnsMgr := dns.New(pool, kp.Identity())
-	if err := dnsMgr.Cleanup(); err != nil {
+	if err := dnsMgr.SetTTLRange(c.Int("min-ttl"), c.Int("max-ttl")); err != nil {
+		return err
+	}
+	if err := dnsMgr.SetMaxHealthChecks(c.Int("max-health-checks")); err != nil {
+		return err
+	}
+
+	proxyMgr := proxy.New(pool)
+
+	recorder, err := auditRecorder(c, pool)
+	if err != nil {
+		return err
+	}
+	dnsMgr.SetAuditRecorder(recorder)
+	proxyMgr.SetAuditRecorder(recorder)
+
+	var reservedLabels *reserved.Labels
+	if path := c.String("reserved-labels"); path != "" {
+		reservedLabels, err = reserved.Load(path, domains)
+		if err != nil {
+			return fmt.Errorf("failed to load reserved labels: %w", err)
+		}
+		dnsMgr.SetReservedLabels(reservedLabels)
+		proxyMgr.SetReservedLabels(reservedLabels)
+	}
+
+	if err := dnsMgr.As(audit.Actor{Operation: "cleanup"}).Cleanup(); err != nil {
 		log.Fatal().Err(err).Msg("failed to clean up coredns config")
 	}
 
 	for _, domain := range domains {
 		log.Info().Msgf("gateway will manage domain %s", domain)
-		if err := dnsMgr.AddDomainDelagate(kp.Identity(), kp.Identity(), domain); err != nil {
+		gwDNS := dnsMgr.As(audit.Actor{User: kp.Identity(), Operation: "manage domain"})
+		if err := gwDNS.AddDomainDelagate(kp.Identity(), kp.Identity(), domain); err != nil {
 			return errors.Wrapf(err, "fail to manage domain %s", domain)
 		}
 	}
@@ -216,11 +329,21 @@ func run(c *cli.Context) error {
 			Str("wg-iface", wgIface).
 			Msg("gateway 4 to 6 enabled")
 
-		wgMgr, err = wg.New(kp, wg.NewIPPool(kp), endpoint, wgIface)
+		ipPool := wg.NewIPPool(kp)
+		wgMgr, err = wg.New(kp, ipPool, endpoint, wgIface)
 		if err != nil {
 			return err
 		}
 
+		gwDNS := dnsMgr.As(audit.Actor{User: kp.Identity(), Operation: "manage reverse zone"})
+		if err := gwDNS.AddReverseZone(ipPool.Subnet()); err != nil {
+			return errors.Wrap(err, "fail to manage the reverse zone of the 4to6 tunnel addresses")
+		}
+
+		if err := dnsMgr.SetReverseDomain(c.String("ptr-domain")); err != nil {
+			return errors.Wrap(err, "invalid --ptr-domain")
+		}
+
 		defer func() {
 			if err := wgMgr.Close(); err != nil {
 				log.Error().Err(err).Msgf("failed to cleanup network namespace")
@@ -228,7 +351,22 @@ func run(c *cli.Context) error {
 		}()
 	}
 
-	provisioner := tfgateway.NewProvisioner(proxy.New(pool), dnsMgr, wgMgr, kp, e)
+	var verifier *dns.DelegationVerifier
+	if c.Bool("verify-delegation") {
+		verifier = dns.NewDelegationVerifier(net.DefaultResolver)
+	}
+
+	provisioner := tfgateway.NewProvisioner(proxyMgr, dnsMgr, wgMgr, signer, verifier, kp, e)
+
+	if defs := c.StringSlice("quota"); len(defs) > 0 {
+		var quotas tfgateway.Quotas
+		for _, def := range defs {
+			if err := quotas.Set(def); err != nil {
+				return err
+			}
+		}
+		provisioner.SetQuotas(&quotas, localStore)
+	}
 
 	engine, err := provision.New(provision.EngineOps{
 		NodeID: kp.Identity(),
@@ -261,6 +399,42 @@ func run(c *cli.Context) error {
 		log.Info().Msg("shutting down")
 	})
 
+	if addr := c.String("dns-listen"); addr != "" {
+		dnsServer := dns.NewServer(dnsMgr, nameservers, signer)
+		if path := c.String("geoip-db"); path != "" {
+			db, err := dns.LoadGeoIPDatabase(path)
+			if err != nil {
+				return err
+			}
+			dnsServer.SetGeoIP(db)
+		}
+		go func() {
+			if err := dnsServer.ListenAndServe(ctx, addr); err != nil {
+				log.Fatal().Err(err).Msg("dns server stopped")
+			}
+		}()
+	}
+
+	if addr := c.String("api-listen"); addr != "" {
+		server := &http.Server{Addr: addr, Handler: provisioner.APIHandler(c.Duration("acme-challenge-timeout"))}
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				log.Fatal().Err(err).Msg("api server stopped")
+			}
+		}()
+	}
+	go sweepACMEChallenges(ctx, dnsMgr.As(audit.Actor{Operation: "expire acme challenge"}), time.Minute)
+	go dns.NewHealthChecker(dnsMgr.As(audit.Actor{Operation: "health check"})).Run(ctx)
+
+	if reservedLabels != nil {
+		go reservedLabels.Watch(ctx, 10*time.Second)
+	}
+
+	if interval := c.Duration("reconcile-interval"); interval > 0 {
+		reconciler := tfgateway.NewReconciler(localStore, provisioner, c.Bool("reconcile-repair"))
+		go reconciler.Run(ctx, interval)
+	}
+
 	if err := engine.Run(ctx); err != nil {
 		log.Error().Err(err).Msg("unexpected error")
 	}
@@ -268,6 +442,26 @@ func run(c *cli.Context) error {
 	return nil
 }
 
+// sweepACMEChallenges removes the expired ACME challenges every interval until ctx is done
+func sweepACMEChallenges(ctx context.Context, dnsMgr *dns.Mgr, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := dnsMgr.SweepACMEChallenges(now)
+			if err != nil {
+				log.Error().Err(err).Msg("failed to remove expired ACME challenges")
+			} else if n > 0 {
+				log.Info().Int("count", n).Msg("removed expired ACME challenges")
+			}
+		}
+	}
+}
+
 func registerID(gw directory.Gateway, expl *client.Client) func() error {
 	return func() error {
 		log.Info().Str("ID", gw.NodeId).Msg("trying to register to the explorer")
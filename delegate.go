@@ -3,7 +3,9 @@ package tfgateway
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 
+	"github.com/threefoldtech/tfgateway/dns"
 	"github.com/threefoldtech/zos/pkg/provision"
 
 	"github.com/rs/zerolog/log"
@@ -11,7 +13,18 @@ import (
 
 // Delegate is the primitives that allow a user to delegate a or part of a domain to us
 type Delegate struct {
-	Domain string `json:"domain"`
+	Domain string          `json:"domain"`
+	MX     []dns.RecordMX  `json:"mx,omitempty"`
+	CAA    []dns.RecordCAA `json:"caa,omitempty"`
+}
+
+// DelegateResult contains the information the user needs to complete the
+// delegation of its domain at its registrar
+type DelegateResult struct {
+	// DomainResult is only set for an internationalized domain name
+	DomainResult
+	// DS is the DS record of the domain, only set if the gateway signs the zones with DNSSEC
+	DS string `json:"ds,omitempty"`
 }
 
 func (p *Provisioner) domainDeleateProvision(ctx context.Context, r *provision.Reservation) (interface{}, error) {
@@ -21,7 +34,40 @@ func (p *Provisioner) domainDeleateProvision(ctx context.Context, r *provision.R
 	}
 	log.Info().Str("id", r.ID).Msgf("provision Delegate %+v", data)
 
-	return nil, p.dns.AddDomainDelagate(r.NodeID, r.User, data.Domain)
+	domain, err := ParseDomainName(data.Domain)
+	if err != nil {
+		return nil, err
+	}
+	data.Domain = domain.ASCII
+
+	if p.verifier != nil {
+		if err := p.verifier.Verify(ctx, r.User, data.Domain); err != nil {
+			return nil, domain.Wrap(err)
+		}
+	}
+
+	// the MX and CAA records are added with the delegation, so the
+	// domain is not left delegated if any of them is invalid
+	records := make([]dns.Record, 0, len(data.MX)+len(data.CAA))
+	for _, mx := range data.MX {
+		records = append(records, mx)
+	}
+	for _, caa := range data.CAA {
+		records = append(records, caa)
+	}
+
+	if err := p.dns.AddDomainDelagate(r.NodeID, r.User, data.Domain, records...); err != nil {
+		return nil, domain.Wrap(err)
+	}
+
+	if p.signer == nil {
+		return domain.result(), nil
+	}
+
+	return DelegateResult{
+		DomainResult: domain.domainResult(),
+		DS:           p.signer.DS(data.Domain).String(),
+	}, nil
 }
 
 func (p *Provisioner) domainDeleateDecomission(ctx context.Context, r *provision.Reservation) error {
@@ -31,5 +77,43 @@ func (p *Provisioner) domainDeleateDecomission(ctx context.Context, r *provision
 	}
 	log.Info().Str("id", r.ID).Msgf("decomission Delegate %+v", data)
 
-	return p.dns.RemoveDomainDelagate(r.User, data.Domain)
+	domain, err := ParseDomainName(data.Domain)
+	if err != nil {
+		return err
+	}
+	data.Domain = domain.ASCII
+
+	released, err := p.dns.ReleaseTransfer(r.User, data.Domain)
+	if err != nil {
+		return domain.Wrap(err)
+	}
+	if released {
+		// the domain now belongs to the user it was transferred to
+		log.Info().Str("id", r.ID).Msgf("delegated domain %s was transferred, released the reservation", domain)
+		return nil
+	}
+
+	subdomains, err := p.dns.RemoveDomainDelagate(r.User, data.Domain)
+	if err != nil {
+		return domain.Wrap(err)
+	}
+
+	// the proxies of the zones delegated inside the domain are kept
+	nested, err := p.dns.NestedZones(data.Domain)
+	if err != nil {
+		return fmt.Errorf("failed to list the zones inside delegated domain %s: %w", domain, err)
+	}
+
+	proxies, err := p.proxy.RemoveDomain(data.Domain, nested...)
+	if err != nil {
+		return fmt.Errorf("failed to remove proxies of delegated domain %s: %w", domain, err)
+	}
+
+	log.Info().
+		Str("id", r.ID).
+		Strs("subdomains", subdomains).
+		Strs("proxies", proxies).
+		Msgf("removed delegated domain %s", data.Domain)
+
+	return nil
 }
@@ -0,0 +1,193 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// acmeChallengeLabel is the label under which the ACME DNS-01
+	// challenges of a name are published
+	acmeChallengeLabel = "_acme-challenge"
+	// acmeChallengeTTL is kept short so the resolvers of the
+	// certificate authority do not cache an outdated challenge
+	acmeChallengeTTL = 60
+	// acmeChallengesKey is the redis sorted set of the challenges
+	// published with SetACMEChallenge, scored by their expiration time
+	acmeChallengesKey = "tfgateway_acme_challenges"
+	// DefaultACMEChallengeTimeout is how long a challenge is kept
+	// if it is not cleared by the user
+	DefaultACMEChallengeTimeout = time.Hour
+)
+
+// acmeChallenge identifies a challenge in the acmeChallengesKey set
+type acmeChallenge struct {
+	Zone  string `json:"zone"`
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
+func (a acmeChallenge) member() (string, error) {
+	b, err := json.Marshal(a)
+	return string(b), err
+}
+
+func (t *tx) addACMEChallenge(challenge acmeChallenge, expiration time.Time) error {
+	member, err := challenge.member()
+	if err != nil {
+		return err
+	}
+
+	t.send("ZADD", acmeChallengesKey, expiration.Unix(), member)
+	return nil
+}
+
+func (t *tx) deleteACMEChallenge(challenge acmeChallenge) error {
+	member, err := challenge.member()
+	if err != nil {
+		return err
+	}
+
+	t.send("ZREM", acmeChallengesKey, member)
+	return nil
+}
+
+// SetACMEChallenge publishes token as the ACME DNS-01 challenge of domain, so user
+// can get a certificate for it. domain can be a wildcard, in which case the
+// challenge is published for the name of the wildcard, as required by ACME.
+// The same ownership rules as AddMX apply.
+// The challenge is removed automatically by SweepACMEChallenges once timeout
+// is elapsed, if it is not cleared before with ClearACMEChallenge
+func (c *Mgr) SetACMEChallenge(user, domain, token string, timeout time.Duration) error {
+	log.Info().Msgf("set ACME challenge of %s", domain)
+
+	if err := validateACMEToken(token); err != nil {
+		return err
+	}
+
+	name, zone, err := c.authorizeACMEChallenge(user, domain)
+	if err != nil {
+		return err
+	}
+
+	challenge := acmeChallenge{Zone: zone, Name: name, Token: token}
+	return c.atomic(func(r *Mgr, t *tx) error {
+		zr, err := r.getZoneRecords(zone, name)
+		if err != nil {
+			return err
+		}
+
+		zr.Add(RecordTXT{Text: token, TTL: acmeChallengeTTL})
+		if err := t.setZoneRecords(zone, name, zr); err != nil {
+			return err
+		}
+
+		return t.addACMEChallenge(challenge, time.Now().Add(timeout))
+	}, zoneKey(zone), acmeChallengesKey)
+}
+
+// ClearACMEChallenge removes a challenge published with SetACMEChallenge
+func (c *Mgr) ClearACMEChallenge(user, domain, token string) error {
+	log.Info().Msgf("clear ACME challenge of %s", domain)
+
+	name, zone, err := c.authorizeACMEChallenge(user, domain)
+	if err != nil {
+		return err
+	}
+
+	return c.clearACMEChallenge(acmeChallenge{Zone: zone, Name: name, Token: token})
+}
+
+// SweepACMEChallenges removes the challenges that expired before now
+// and returns how many were removed
+func (c *Mgr) SweepACMEChallenges(now time.Time) (int, error) {
+	con := c.redis.Get()
+	members, err := redis.Strings(con.Do("ZRANGEBYSCORE", acmeChallengesKey, "-inf", now.Unix()))
+	con.Close()
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list expired ACME challenges")
+	}
+
+	swept := 0
+	for _, member := range members {
+		var challenge acmeChallenge
+		if err := json.Unmarshal([]byte(member), &challenge); err != nil {
+			log.Error().Err(err).Str("challenge", member).Msg("invalid ACME challenge, dropping it")
+			if err := c.dropACMEChallenge(member); err != nil {
+				return swept, err
+			}
+			continue
+		}
+
+		if err := c.clearACMEChallenge(challenge); err != nil {
+			return swept, errors.Wrapf(err, "failed to remove expired ACME challenge of %s in zone %s", challenge.Name, challenge.Zone)
+		}
+		swept++
+	}
+
+	return swept, nil
+}
+
+func (c *Mgr) clearACMEChallenge(challenge acmeChallenge) error {
+	return c.atomic(func(r *Mgr, t *tx) error {
+		zr, err := r.getZoneRecords(challenge.Zone, challenge.Name)
+		if err != nil {
+			return err
+		}
+
+		zr.Remove(RecordTXT{Text: challenge.Token})
+		if zr.Records.IsEmpty() {
+			t.deleteZoneRecords(challenge.Zone, challenge.Name)
+		} else if err := t.setZoneRecords(challenge.Zone, challenge.Name, zr); err != nil {
+			return err
+		}
+
+		return t.deleteACMEChallenge(challenge)
+	}, zoneKey(challenge.Zone), acmeChallengesKey)
+}
+
+func (c *Mgr) dropACMEChallenge(member string) error {
+	con := c.redis.Get()
+	defer con.Close()
+
+	_, err := con.Do("ZREM", acmeChallengesKey, member)
+	return err
+}
+
+// authorizeACMEChallenge checks that user is allowed to publish challenges for
+// domain and returns the name and zone under which they are stored
+func (c *Mgr) authorizeACMEChallenge(user, domain string) (name, zone string, err error) {
+	// the challenges of a wildcard are published for its name, and
+	// a wildcard can only be reserved by the owner of its name
+	name, zone, err = c.authorizeRecords(user, strings.TrimPrefix(domain, WildcardPrefix))
+	if err != nil {
+		return "", "", err
+	}
+
+	if name == apex {
+		return acmeChallengeLabel, zone, nil
+	}
+	return acmeChallengeLabel + "." + name, zone, nil
+}
+
+// validateACMEToken checks token looks like the digest published for a
+// DNS-01 challenge, a base64url encoded SHA-256
+func validateACMEToken(token string) error {
+	if len(token) == 0 || len(token) > 255 {
+		return fmt.Errorf("invalid ACME challenge '%s'", token)
+	}
+
+	for _, r := range token {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return fmt.Errorf("invalid ACME challenge '%s'", token)
+		}
+	}
+
+	return nil
+}
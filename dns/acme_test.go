@@ -0,0 +1,91 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestACMEChallenge(t *testing.T) {
+	gwid := "gwid"
+	s, mgr := newTestMgr(t)
+
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+	require.NoError(t, mgr.AddDomainDelagate("id", gwid, "gateway.tf"))
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", "example.com"))
+	require.NoError(t, mgr.AddSubdomain("user", "app.gateway.tf", ips, 0))
+	require.NoError(t, mgr.AddSubdomain("user2", "web.gateway.tf", ips, 0))
+	require.NoError(t, mgr.AddSubdomain("user2", "*.web.gateway.tf", ips, 0))
+
+	tt := []struct {
+		user   string
+		domain string
+		zone   string
+		name   string
+	}{
+		{"user", "app.gateway.tf", "gateway.tf", "_acme-challenge.app"},
+		{"user", "*.app.gateway.tf", "gateway.tf", "_acme-challenge.app"},
+		{"user2", "*.web.gateway.tf", "gateway.tf", "_acme-challenge.web"},
+		{"user", "example.com", "example.com", "_acme-challenge"},
+		{"user", "*.dev.example.com", "example.com", "_acme-challenge.dev"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.domain, func(t *testing.T) {
+			err := mgr.SetACMEChallenge(tc.user, tc.domain, "token-1", time.Hour)
+			require.NoError(t, err)
+
+			zr, err := mgr.getZoneRecords(tc.zone, tc.name)
+			require.NoError(t, err)
+			assert.Equal(t, []Record{RecordTXT{Text: "token-1", TTL: acmeChallengeTTL}}, zr.Records[RecordTypeTXT])
+
+			err = mgr.ClearACMEChallenge(tc.user, tc.domain, "token-1")
+			require.NoError(t, err)
+
+			zr, err = mgr.getZoneRecords(tc.zone, tc.name)
+			require.NoError(t, err)
+			assert.True(t, zr.Records.IsEmpty())
+		})
+	}
+
+	err := mgr.SetACMEChallenge("user2", "app.gateway.tf", "token", time.Hour)
+	assert.True(t, errors.Is(err, ErrAuth))
+
+	err = mgr.SetACMEChallenge("user2", "*.app.gateway.tf", "token", time.Hour)
+	assert.True(t, errors.Is(err, ErrAuth))
+
+	err = mgr.SetACMEChallenge("user2", "example.com", "token", time.Hour)
+	assert.True(t, errors.Is(err, ErrAuth))
+
+	err = mgr.SetACMEChallenge(gwid, "gateway.tf", "token", time.Hour)
+	assert.True(t, errors.Is(err, ErrAuth))
+
+	err = mgr.SetACMEChallenge("user", "app.gateway.tf", "not a token", time.Hour)
+	assert.Error(t, err)
+
+	t.Run("sweep", func(t *testing.T) {
+		require.NoError(t, mgr.SetACMEChallenge("user", "app.gateway.tf", "expired", -time.Minute))
+		require.NoError(t, mgr.SetACMEChallenge("user", "app.gateway.tf", "valid", time.Hour))
+
+		n, err := mgr.SweepACMEChallenges(time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		zr, err := mgr.getZoneRecords("gateway.tf", "_acme-challenge.app")
+		require.NoError(t, err)
+		assert.Equal(t, []Record{RecordTXT{Text: "valid", TTL: acmeChallengeTTL}}, zr.Records[RecordTypeTXT])
+
+		n, err = mgr.SweepACMEChallenges(time.Now().Add(2 * time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		zr, err = mgr.getZoneRecords("gateway.tf", "_acme-challenge.app")
+		require.NoError(t, err)
+		assert.True(t, zr.Records.IsEmpty())
+		assert.False(t, s.Exists(acmeChallengesKey))
+	})
+}
@@ -3,7 +3,9 @@ package dns
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net"
+	"regexp"
 	"strings"
 
 	"github.com/asaskevich/govalidator"
@@ -11,12 +13,58 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/threefoldtech/tfgateway/audit"
+	"github.com/threefoldtech/tfgateway/reserved"
 )
 
+// WildcardPrefix is the label prefix of a wildcard domain
+const WildcardPrefix = "*."
+
+// srvLabelRegex matches the service and protocol labels of a SRV record
+var srvLabelRegex = regexp.MustCompile(`^_[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// apex is the name used by the coredns redis plugin to store the
+// records of the zone itself
+const apex = "@"
+
+// defaultTTL is the TTL of the records when none is specified
+const defaultTTL = 3600
+
+const (
+	// zoneIndexKey is the redis set holding the names of all the zones
+	// configured by the gateway
+	zoneIndexKey = "tfgateway_zones"
+	// zoneIndexMigratedKey is set once the zones created before
+	// zoneIndexKey existed have been added to the index
+	zoneIndexMigratedKey = "tfgateway_zones_migrated"
+	// zoneSerialKey is the redis hash holding the serial of the zones,
+	// it is incremented by every transaction that changes their records
+	zoneSerialKey = "tfgateway_zone_serials"
+)
+
+// ownerName is the name of the TXT record that holds the owner of a delegated zone
+const ownerName = "__owner__"
+
 // Mgr is responsible to configure CoreDNS trough its redis pluging
 type Mgr struct {
-	redis    *redis.Pool
+	redis    pool
 	identity string
+
+	minTTL int
+	maxTTL int
+
+	maxHealthChecks int
+	// probePrivate lets the health checks probe the private backends,
+	// it is only set by the tests which run their backends locally
+	probePrivate bool
+
+	reserved *reserved.Labels
+
+	// reverseDomain is the domain of the default names of the PTR records
+	reverseDomain string
+
+	audit *audit.Recorder
+	actor audit.Actor
 }
 
 // New creates a DNS manager
@@ -27,6 +75,79 @@ func New(pool *redis.Pool, identity string) *Mgr {
 	}
 }
 
+// SetTTLRange sets the bounds of the TTL users can choose for their records.
+// A bound set to 0 is not enforced
+func (c *Mgr) SetTTLRange(min, max int) error {
+	if min < 0 || max < 0 || (max > 0 && min > max) {
+		return fmt.Errorf("invalid TTL range [%d, %d]", min, max)
+	}
+
+	c.minTTL = min
+	c.maxTTL = max
+	return nil
+}
+
+// SetReservedLabels sets the labels users cannot reserve under the managed domains
+func (c *Mgr) SetReservedLabels(labels *reserved.Labels) {
+	c.reserved = labels
+}
+
+// SetAuditRecorder sets the recorder of the changes made to the zones
+func (c *Mgr) SetAuditRecorder(recorder *audit.Recorder) {
+	c.audit = recorder
+}
+
+// As returns a copy of the Mgr that records its changes as made by actor
+func (c *Mgr) As(actor audit.Actor) *Mgr {
+	mgr := *c
+	mgr.actor = actor
+	return &mgr
+}
+
+// Describe is the audit.Describer of the redis keys written by the Mgr
+func Describe(key, field string) (audit.Key, bool) {
+	switch key {
+	case "zone":
+		return audit.Key{Object: "zone owner", Domain: field}, true
+	case "managed_domains":
+		return audit.Key{Object: "subdomain owner", Domain: field}, true
+	case healthChecksKey:
+		return audit.Key{Object: "health check", Domain: field}, true
+	case ptrPeersKey:
+		return audit.Key{Object: "PTR peers", Domain: field}, true
+	}
+
+	if !strings.HasSuffix(key, ".") || key == "." {
+		return audit.Key{}, false
+	}
+
+	// the records of the zone itself can be stored under an empty name
+	zone, name := strings.TrimSuffix(key, "."), field
+	if name == "" {
+		name = apex
+	}
+
+	return audit.Key{Object: "records", Domain: absoluteName(name, zone)}, true
+}
+
+// ttl returns the TTL to use for a record requested with ttl,
+// 0 means the default TTL. The TTL is clamped to the range set with SetTTLRange
+func (c *Mgr) ttl(ttl int) int {
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+
+	if c.minTTL > 0 && ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	return ttl
+}
+
 // Cleanup makes sure that currect coredns configuration
 // is optimal by cleaning up not used records
 func (c *Mgr) Cleanup() error {
@@ -36,6 +157,10 @@ func (c *Mgr) Cleanup() error {
 	}
 
 	for _, zone := range zones {
+		if err := c.migrateApex(zone); err != nil {
+			log.Error().Err(err).Str("zone", zone).Msg("failed to migrate the records of the zone apex")
+		}
+
 		if err := c.cleanUp(zone); err != nil {
 			log.Error().Err(err).Str("zone", zone).Msg("failed to cleanup zone")
 		}
@@ -44,6 +169,35 @@ func (c *Mgr) Cleanup() error {
 	return nil
 }
 
+// migrateApex moves the records of the zone itself, that AddSubdomain used to
+// store under an empty name, to the apex where the coredns redis plugin reads them
+func (c *Mgr) migrateApex(zone string) error {
+	return c.atomic(func(r *Mgr, t *tx) error {
+		legacy, err := r.getZoneRecords(zone, "")
+		if err != nil {
+			return err
+		}
+
+		if legacy.Records.IsEmpty() {
+			return nil
+		}
+
+		zr, err := r.getZoneRecords(zone, apex)
+		if err != nil {
+			return err
+		}
+
+		for _, records := range legacy.Records {
+			for _, record := range records {
+				zr.Add(record)
+			}
+		}
+
+		t.deleteZoneRecords(zone, "")
+		return t.setZoneRecords(zone, apex, zr)
+	}, zone)
+}
+
 func (c *Mgr) cleanUp(zone string) error {
 	con := c.redis.Get()
 	defer con.Close()
@@ -61,7 +215,11 @@ func (c *Mgr) cleanUp(zone string) error {
 		}
 
 		if len(value) == 0 || value == "{}" {
-			if _, err := con.Do("HDEL", zone, key); err != nil {
+			err := c.apply(func(t *tx) error {
+				t.send("HDEL", zone, key)
+				return nil
+			})
+			if err != nil {
 				log.Error().Err(err).Str("zone", zone).Str("key", key).Msg("failed to delete empty key")
 			}
 		}
@@ -70,28 +228,75 @@ func (c *Mgr) cleanUp(zone string) error {
 	return nil
 }
 
+// listCorednsZones returns the keys of the coredns zones from the zone index.
+// The first time it is called, the zones created before the index existed
+// are added to the index
 func (c *Mgr) listCorednsZones() ([]string, error) {
 	con := c.redis.Get()
 	defer con.Close()
 
-	zones, err := redis.Strings(con.Do("KEYS", "*."))
+	migrated, err := redis.Bool(con.Do("EXISTS", zoneIndexMigratedKey))
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to list potential coredns zones")
+		return nil, errors.Wrap(err, "failed to check zone index")
 	}
 
-	result := zones[:0]
-	for _, zone := range zones {
-		typ, err := redis.String(con.Do("TYPE", zone))
+	if !migrated {
+		if err := migrateZoneIndex(con); err != nil {
+			return nil, errors.Wrap(err, "failed to migrate zones to the zone index")
+		}
+	}
+
+	zones, err := redis.Strings(con.Do("SMEMBERS", zoneIndexKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list coredns zones")
+	}
+
+	for i, zone := range zones {
+		zones[i] = zoneKey(zone)
+	}
+
+	return zones, nil
+}
+
+// migrateZoneIndex adds all the coredns zones found in redis to the zone index.
+// The keys are walked with SCAN so redis is not blocked when it holds many keys
+func migrateZoneIndex(con redis.Conn) error {
+	log.Info().Msg("adding existing zones to the zone index")
+
+	cursor := 0
+	for {
+		values, err := redis.Values(con.Do("SCAN", cursor, "MATCH", "*.", "COUNT", 1000))
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to get type of redis key '%s'", zone)
+			return err
+		}
+
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			typ, err := redis.String(con.Do("TYPE", key))
+			if err != nil {
+				return errors.Wrapf(err, "failed to get type of redis key '%s'", key)
+			}
+
+			if typ != "hash" {
+				continue
+			}
+
+			if _, err := con.Do("SADD", zoneIndexKey, strings.TrimSuffix(key, ".")); err != nil {
+				return err
+			}
 		}
 
-		if typ == "hash" {
-			result = append(result, zone)
+		if cursor == 0 {
+			break
 		}
 	}
 
-	return result, nil
+	_, err := con.Do("SET", zoneIndexMigratedKey, 1)
+	return err
 }
 
 func (c *Mgr) getZoneOwner(zone string) (owner ZoneOwner, err error) {
@@ -115,16 +320,9 @@ func (c *Mgr) getZoneOwner(zone string) (owner ZoneOwner, err error) {
 }
 
 func (c *Mgr) setZoneOwner(zone string, owner ZoneOwner) (err error) {
-	con := c.redis.Get()
-	defer con.Close()
-
-	b, err := json.Marshal(owner)
-	if err != nil {
-		return err
-	}
-
-	_, err = con.Do("HSET", "zone", zone, b)
-	return err
+	return c.apply(func(t *tx) error {
+		return t.setZoneOwner(zone, owner)
+	})
 }
 
 func (c *Mgr) getZoneRecords(zone, name string) (Zone, error) {
@@ -153,51 +351,17 @@ func (c *Mgr) getZoneRecords(zone, name string) (Zone, error) {
 
 func (c *Mgr) setZoneRecords(zone, name string, zr Zone) (err error) {
 	log.Debug().Msgf("zet zone records %+v", zr)
-	con := c.redis.Get()
-	defer con.Close()
-
-	if zone[len(zone)-1] != '.' {
-		zone += "."
-	}
-
-	b, err := json.Marshal(zr.Records)
-	if err != nil {
-		return err
-	}
-
-	if _, err := con.Do("HSET", zone, name, b); err != nil {
-		return err
-	}
-
-	return nil
+	return c.apply(func(t *tx) error {
+		return t.setZoneRecords(zone, name, zr)
+	})
 }
 
 func (c *Mgr) deleteZoneRecords(zone, name string) (err error) {
 	log.Debug().Str("name", name).Str("zone", zone).Msg("delete zone record")
-	con := c.redis.Get()
-	defer con.Close()
-
-	if zone[len(zone)-1] != '.' {
-		zone += "."
-	}
-
-	if _, err := con.Do("HDEL", zone, name); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (c *Mgr) setSubdomainOwner(domain, user string) error {
-	log.Debug().Msgf("set managed domain owner %s %s", domain, user)
-	con := c.redis.Get()
-	defer con.Close()
-
-	if _, err := con.Do("HSET", "managed_domains", domain, user); err != nil {
-		return err
-	}
-
-	return nil
+	return c.apply(func(t *tx) error {
+		t.deleteZoneRecords(zone, name)
+		return nil
+	})
 }
 
 func (c *Mgr) getSubdomainOwner(domain string) (user string, err error) {
@@ -215,227 +379,1050 @@ func (c *Mgr) getSubdomainOwner(domain string) (user string, err error) {
 	return user, nil
 }
 
-func (c *Mgr) deleteSubdomainOwner(domain string) error {
-	log.Debug().Msgf("delete managed domain owner %s", domain)
-	con := c.redis.Get()
-	defer con.Close()
-
-	_, err := con.Do("HDEL", "managed_domains", domain)
-	return err
-}
-
 // AddSubdomain configures a domain A or AAA records depending on the version of
 // the IP address in IPs
-func (c *Mgr) AddSubdomain(user string, domain string, IPs []net.IP) error {
+func (c *Mgr) AddSubdomain(user string, domain string, IPs []net.IP, ttl int) error {
 
-	log.Info().Msgf("add subdomain %s %+v", domain, IPs)
+	log.Info().Msgf("add subdomain %s %+v ttl %d", domain, IPs, ttl)
 
-	if err := validateDomain(domain); err != nil {
+	if err := validateTTL(ttl); err != nil {
 		return err
 	}
 
-	name, zone := splitDomain(domain)
-
-	con := c.redis.Get()
-	defer con.Close()
-
-	owner, err := c.getZoneOwner(zone)
-	if err != nil {
-		return fmt.Errorf("failed to read the DNS zone %s: %w", zone, err)
-	}
-
-	if owner.Owner == "" {
-		return fmt.Errorf("%s is not managed by the gateway. delegate the domain first", zone)
+	records := make([]Record, 0, len(IPs))
+	for _, ip := range IPs {
+		records = append(records, recordFromIP(ip, c.ttl(ttl)))
 	}
 
-	if owner.Owner == c.identity { // this is a manged domain
-		owner, err := c.getSubdomainOwner(domain)
-		if err != nil {
-			return err
-		}
-
-		if owner != "" {
-			// the sub-domain is already provisioned, so regardless it's by the own user
-			// or not, the user need to first deprovision it, before he can use it again.
-			//return errors.
+	return c.addSubdomain(user, domain, records)
+}
 
-			return errors.Wrapf(ErrSubdomainUsed, "cannot add subdomain %s to zone %s", name, zone)
-		}
-	} else if owner.Owner != user { //this is a deletegatedDomain
-		return errors.Wrapf(ErrAuth, "cannot add subdomain %s to zone %s", name, zone)
-	}
+// AddSubdomainCNAME makes domain an alias of target. The same ownership rules
+// as AddSubdomain apply, and domain cannot hold any other record
+func (c *Mgr) AddSubdomainCNAME(user, domain, target string, ttl int) error {
+	log.Info().Msgf("add subdomain %s CNAME %s ttl %d", domain, target, ttl)
 
-	// we mark this subdomain as reserved for that user
-	if err := c.setSubdomainOwner(domain, user); err != nil {
-		return errors.Wrap(err, "failed to reserve subdomain")
+	if err := validateTTL(ttl); err != nil {
+		return err
 	}
 
-	defer func() {
-		if err != nil {
-			if err := c.deleteSubdomainOwner(domain); err != nil {
-				log.Error().Err(err).Msg("failed to clean up sub-domain reservation owner")
-			}
-		}
-	}()
-
-	zr, err := c.getZoneRecords(zone, name)
+	record, err := cnameRecord(domain, target, c.ttl(ttl))
 	if err != nil {
 		return err
 	}
 
-	for _, ip := range IPs {
-		r := recordFromIP(ip)
-		zr.Add(r)
-	}
+	return c.addSubdomain(user, domain, []Record{record})
+}
 
-	if err = c.setZoneRecords(zone, name, zr); err != nil {
+// RemoveSubdomainCNAME removes a subdomain added with AddSubdomainCNAME
+func (c *Mgr) RemoveSubdomainCNAME(user, domain, target string) error {
+	record, err := cnameRecord(domain, target, defaultTTL)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return c.removeSubdomain(user, domain, []Record{record})
 }
 
-// RemoveSubdomain remove a domain added with AddSubdomain
-func (c *Mgr) RemoveSubdomain(user string, domain string, IPs []net.IP) error {
+// addSubdomain reserves domain for user and adds records to it
+func (c *Mgr) addSubdomain(user string, domain string, records []Record) error {
 	if err := validateDomain(domain); err != nil {
 		return err
 	}
 
-	name, zone := splitDomain(domain)
+	if c.reserved != nil {
+		if err := c.reserved.Check(domain); err != nil {
+			return err
+		}
+	}
 
-	con := c.redis.Get()
-	defer con.Close()
+	if IsWildcard(domain) {
+		return c.addWildcardSubdomain(user, domain, records)
+	}
 
-	owner, err := c.getZoneOwner(zone)
+	_, zone, _, err := c.findZone(domain)
 	if err != nil {
-		return fmt.Errorf("failed to read the DNS zone %s: %w", zone, err)
+		return fmt.Errorf("failed to read the DNS zone of %s: %w", domain, err)
 	}
 
-	if owner.Owner == "" {
-		// domain not managed by this gateway at all, so all subdomain are already gone too.
-		// this can happen when a delegated domain expires before a subdomain
+	// the reservation of the subdomain and its records are written in the same
+	// transaction, so concurrent reservations cannot both succeed and a failed
+	// reservation does not leave anything behind
+	return c.atomic(func(r *Mgr, t *tx) error {
+		name, zone, owner, err := r.findZone(domain)
+		if err != nil {
+			return fmt.Errorf("failed to read the DNS zone of %s: %w", domain, err)
+		}
 
-		// we can safely then delete the subdomain owner
-		// as a way of clean up. (records already gone with the domain)
-		return c.deleteSubdomainOwner(domain)
-	}
+		if owner.Owner == "" {
+			return fmt.Errorf("%s is not managed by the gateway. delegate the domain first", zone)
+		}
 
-	// this is now set for both managed domains and delegated domains
-	// if the owner name is not set we still continue (backward compatibility)
-	// otherwise we check if it matches the user
-	ownerName, err := c.getSubdomainOwner(domain)
-	if err != nil {
-		return err
-	}
-	if ownerName != "" && ownerName != user {
-		return errors.Wrapf(ErrAuth, "cannot remove subdomain %s from zone %s", name, zone)
-	}
+		if err := owner.refuseReverse(zone); err != nil {
+			return err
+		}
 
-	zr, err := c.getZoneRecords(zone, name)
-	if err != nil {
-		return err
-	}
+		if name == apex && hasCNAME(records) {
+			return errors.Wrapf(ErrCNAMEConflict, "cannot add a CNAME to the zone %s itself", zone)
+		}
 
-	if zr.Records.IsEmpty() {
-		return nil
-	}
+		if owner.Owner == c.identity { // this is a manged domain
+			if strings.Contains(name, ".") {
+				// the parent subdomain could be reserved by someone else
+				return errors.Wrapf(ErrAuth, "cannot add subdomain %s to the managed zone %s, only one label is allowed", name, zone)
+			}
 
-	for _, ip := range IPs {
-		r := recordFromIP(ip)
-		zr.Remove(r)
-	}
+			owner, err := r.getSubdomainOwner(domain)
+			if err != nil {
+				return err
+			}
+
+			adoptable, err := r.adoptable(user, domain)
+			if err != nil {
+				return err
+			}
+
+			if owner != "" && !adoptable {
+				// the sub-domain is already provisioned, so regardless it's by the own user
+				// or not, the user need to first deprovision it, before he can use it again.
+				// Only the new owner of a transferred subdomain can reserve it again
+				return errors.Wrapf(ErrSubdomainUsed, "cannot add subdomain %s to zone %s", name, zone)
+			}
+
+			// a wildcard left behind by a previous owner of this subdomain
+			// would still catch the traffic of the new owner
+			wildcardOwner, err := r.getSubdomainOwner(WildcardPrefix + domain)
+			if err != nil {
+				return err
+			}
+
+			if wildcardOwner != "" && wildcardOwner != user {
+				return errors.Wrapf(ErrSubdomainUsed, "cannot add subdomain %s to zone %s, a wildcard beneath it is used", name, zone)
+			}
+		} else if owner.Owner != user { //this is a deletegatedDomain
+			return errors.Wrapf(ErrAuth, "cannot add subdomain %s to zone %s", name, zone)
+		}
+
+		// we mark this subdomain as reserved for that user
+		t.setSubdomainOwner(domain, user)
 
-	if zr.Records.IsEmpty() {
-		if err := c.deleteZoneRecords(zone, name); err != nil {
+		zr, err := r.getZoneRecords(zone, name)
+		if err != nil {
 			return err
 		}
-		// if the subdomain has been cleared out, we remove the owner so anyone can claim it again
-		return c.deleteSubdomainOwner(domain)
 
-	}
+		for _, record := range records {
+			zr.Add(record)
+		}
+
+		if err := zr.checkCNAME(); err != nil {
+			return errors.Wrapf(err, "cannot add subdomain %s to zone %s", name, zone)
+		}
 
-	return c.setZoneRecords(zone, name, zr)
+		return t.setZoneRecords(zone, name, zr)
+	}, "zone", "managed_domains", zoneKey(zone))
 }
 
-// AddDomainDelagate configures coreDNS to manage domain
-func (c *Mgr) AddDomainDelagate(identity, user, domain string) error {
-	if err := validateDomain(domain); err != nil {
-		return err
+// RemoveSubdomain remove a domain added with AddSubdomain
+func (c *Mgr) RemoveSubdomain(user string, domain string, IPs []net.IP) error {
+	records := make([]Record, 0, len(IPs))
+	for _, ip := range IPs {
+		records = append(records, recordFromIP(ip, defaultTTL))
 	}
 
-	owner, err := c.getZoneOwner(domain)
-	if err != nil {
+	return c.removeSubdomain(user, domain, records)
+}
+
+// removeSubdomain removes records from domain and releases
+// domain once it does not have any record left
+func (c *Mgr) removeSubdomain(user string, domain string, records []Record) error {
+	if err := validateDomain(domain); err != nil {
 		return err
 	}
 
-	if owner.Owner != "" && owner.Owner != user {
-		return fmt.Errorf("%w cannot delegate domain %s", ErrAuth, domain)
+	if IsWildcard(domain) {
+		return c.removeWildcardSubdomain(user, domain, records)
 	}
 
-	owner.Owner = user
-	if err := c.setZoneOwner(domain, owner); err != nil {
-		return errors.Wrap(err, "failed to set zone owner")
+	_, zone, _, err := c.findZone(domain)
+	if err != nil {
+		return fmt.Errorf("failed to read the DNS zone of %s: %w", domain, err)
 	}
 
-	return c.setZoneOwnerTXTRecord(domain, identity, owner.Owner)
-}
+	return c.atomic(func(r *Mgr, t *tx) error {
+		name, zone, owner, err := r.findZone(domain)
+		if err != nil {
+			return fmt.Errorf("failed to read the DNS zone of %s: %w", domain, err)
+		}
 
-func (c *Mgr) setZoneOwnerTXTRecord(domain, identity, owner string) error {
-	const name = "__owner__"
-	var zone Zone
-	// we are not using the ZoneOwner struct because of
-	// 1- backward compatibility issue since it does not define json tags
-	// 2- extendability of this struct with more data in the future
-	data := struct {
-		Identity string `json:"identity"`
-		Owner    string `json:"owner"`
-	}{
-		Identity: identity,
-		Owner:    owner,
-	}
+		if owner.Owner == "" {
+			// domain not managed by this gateway at all, so all subdomain are already gone too.
+			// this can happen when a delegated domain expires before a subdomain
 
-	bytes, err := json.Marshal(data)
-	if err != nil {
-		return errors.Wrap(err, "failed to create owner TXT record")
-	}
+			// we can safely then delete the subdomain owner
+			// as a way of clean up. (records already gone with the domain)
+			t.deleteSubdomainOwner(domain)
+			return nil
+		}
 
-	zone.Add(RecordTXT{Text: string(bytes), TTL: 600})
+		// this is now set for both managed domains and delegated domains
+		// if the owner name is not set we still continue (backward compatibility)
+		// otherwise we check if it matches the user
+		ownerName, err := r.getSubdomainOwner(domain)
+		if err != nil {
+			return err
+		}
+		if ownerName != "" && ownerName != user {
+			return errors.Wrapf(ErrAuth, "cannot remove subdomain %s from zone %s", name, zone)
+		}
 
-	return c.setZoneRecords(domain, name, zone)
-}
+		zr, err := r.getZoneRecords(zone, name)
+		if err != nil {
+			return err
+		}
 
-// RemoveDomainDelagate remove a delagated domain added with AddDomainDelagate
-func (c *Mgr) RemoveDomainDelagate(user string, domain string) error {
-	if err := validateDomain(domain); err != nil {
-		return err
-	}
+		if zr.Records.IsEmpty() {
+			return nil
+		}
 
-	owner, err := c.getZoneOwner(domain)
-	if err != nil {
-		return err
-	}
+		for _, record := range records {
+			zr.Remove(record)
+		}
 
-	if owner.Owner != "" && owner.Owner != user {
-		return fmt.Errorf("%w cannot remove delegated domain %s", ErrAuth, domain)
-	}
+		if err := r.removeUnhealthyRecords(t, domain, &zr, records); err != nil {
+			return err
+		}
 
-	con := c.redis.Get()
-	defer con.Close()
+		if zr.Records.IsEmpty() {
+			t.deleteZoneRecords(zone, name)
+			// if the subdomain has been cleared out, we remove the owner so anyone can claim it again
+			t.deleteSubdomainOwner(domain)
+			return nil
+		}
 
-	// TODO IMPORTANT: delete all sub-domain owners
-	// we need to go over all managed_domains
-	// do hkeys managed_domains, find all keys that has domain as suffix
-	// delete
+		return t.setZoneRecords(zone, name, zr)
+	}, "zone", "managed_domains", zoneKey(zone), unhealthyRecordsKey)
+}
 
-	// remove all eventual subdomain configuration for this delegated domain
-	if _, err = con.Do("DEL", domain); err != nil {
+// addWildcardSubdomain configures the records of a wildcard subdomain *.name.zone
+// In a managed domain, only the owner of name.zone can create the wildcard beneath it
+func (c *Mgr) addWildcardSubdomain(user string, domain string, records []Record) error {
+	base := strings.TrimPrefix(domain, WildcardPrefix)
+	_, zone, _, err := c.locateDomain(base)
+	if err != nil {
 		return err
 	}
 
-	_, err = con.Do("HDEL", "zone", domain)
-	return err
-}
-
+	return c.atomic(func(r *Mgr, t *tx) error {
+		name, zone, owner, err := r.locateDomain(base)
+		if err != nil {
+			return err
+		}
+
+		if err := owner.refuseReverse(zone); err != nil {
+			return err
+		}
+
+		if owner.Owner == c.identity { // this is a manged domain
+			if name == apex {
+				return errors.Wrapf(ErrAuth, "cannot add wildcard to the managed zone %s", zone)
+			}
+
+			baseOwner, err := r.getSubdomainOwner(base)
+			if err != nil {
+				return err
+			}
+
+			if baseOwner != user {
+				return errors.Wrapf(ErrAuth, "cannot add wildcard %s, subdomain %s must be reserved first", domain, base)
+			}
+
+			wildcardOwner, err := r.getSubdomainOwner(domain)
+			if err != nil {
+				return err
+			}
+
+			adoptable, err := r.adoptable(user, domain)
+			if err != nil {
+				return err
+			}
+
+			if wildcardOwner != "" && !adoptable {
+				return errors.Wrapf(ErrSubdomainUsed, "cannot add wildcard %s to zone %s", domain, zone)
+			}
+		} else if owner.Owner != user { //this is a deletegatedDomain
+			return errors.Wrapf(ErrAuth, "cannot add wildcard %s to zone %s", domain, zone)
+		}
+
+		t.setSubdomainOwner(domain, user)
+
+		name = wildcardName(name)
+		zr, err := r.getZoneRecords(zone, name)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			zr.Add(record)
+		}
+
+		if err := zr.checkCNAME(); err != nil {
+			return errors.Wrapf(err, "cannot add wildcard %s to zone %s", domain, zone)
+		}
+
+		return t.setZoneRecords(zone, name, zr)
+	}, "zone", "managed_domains", zoneKey(zone))
+}
+
+// removeWildcardSubdomain removes a wildcard added with addWildcardSubdomain
+func (c *Mgr) removeWildcardSubdomain(user string, domain string, records []Record) error {
+	base := strings.TrimPrefix(domain, WildcardPrefix)
+	_, zone, _, err := c.findZone(base)
+	if err != nil {
+		return err
+	}
+
+	return c.atomic(func(r *Mgr, t *tx) error {
+		ownerName, err := r.getSubdomainOwner(domain)
+		if err != nil {
+			return err
+		}
+
+		if ownerName != "" && ownerName != user {
+			return errors.Wrapf(ErrAuth, "cannot remove wildcard %s", domain)
+		}
+
+		name, zone, owner, err := r.findZone(base)
+		if err != nil {
+			return err
+		}
+
+		if owner.Owner == "" {
+			// the zone is gone and its records with it
+			t.deleteSubdomainOwner(domain)
+			return nil
+		}
+
+		name = wildcardName(name)
+		zr, err := r.getZoneRecords(zone, name)
+		if err != nil {
+			return err
+		}
+
+		for _, record := range records {
+			zr.Remove(record)
+		}
+
+		if err := r.removeUnhealthyRecords(t, domain, &zr, records); err != nil {
+			return err
+		}
+
+		if zr.Records.IsEmpty() {
+			t.deleteZoneRecords(zone, name)
+			t.deleteSubdomainOwner(domain)
+			return nil
+		}
+
+		return t.setZoneRecords(zone, name, zr)
+	}, "zone", "managed_domains", zoneKey(zone), unhealthyRecordsKey)
+}
+
+// AddMX adds MX records to domain. domain can either be a subdomain owned by user
+// or the apex of a zone delegated by user
+func (c *Mgr) AddMX(user string, domain string, mx []RecordMX) error {
+	log.Info().Msgf("add MX records to %s %+v", domain, mx)
+
+	name, zone, err := c.authorizeRecords(user, domain)
+	if err != nil {
+		return err
+	}
+
+	if err := ValidateMX(mx); err != nil {
+		return err
+	}
+
+	return c.updateZoneRecords(zone, name, func(zr *Zone) error {
+		for _, r := range mx {
+			r.TTL = c.ttl(r.TTL)
+			zr.Add(r)
+		}
+		return nil
+	})
+}
+
+// RemoveMX removes MX records added with AddMX
+func (c *Mgr) RemoveMX(user string, domain string, mx []RecordMX) error {
+	name, zone, err := c.authorizeRecords(user, domain)
+	if err != nil {
+		return err
+	}
+
+	return c.updateZoneRecords(zone, name, func(zr *Zone) error {
+		for _, r := range mx {
+			zr.Remove(r)
+		}
+		return nil
+	})
+}
+
+// AddSRV adds SRV records for the service reachable over proto at domain.
+// The records are stored under _service._proto.domain. Only the owner of
+// the zone containing domain can add SRV records
+func (c *Mgr) AddSRV(user, service, proto, domain string, srv []RecordSRV) error {
+	log.Info().Msgf("add SRV records to %s %s %s %+v", service, proto, domain, srv)
+
+	name, zone, err := c.authorizeSRV(user, service, proto, domain)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range srv {
+		if err := validateSRV(r); err != nil {
+			return err
+		}
+	}
+
+	return c.updateZoneRecords(zone, name, func(zr *Zone) error {
+		for _, r := range srv {
+			r.TTL = c.ttl(r.TTL)
+			zr.Add(r)
+		}
+		return nil
+	})
+}
+
+// RemoveSRV removes SRV records added with AddSRV
+func (c *Mgr) RemoveSRV(user, service, proto, domain string, srv []RecordSRV) error {
+	name, zone, err := c.authorizeSRV(user, service, proto, domain)
+	if err != nil {
+		return err
+	}
+
+	return c.updateZoneRecords(zone, name, func(zr *Zone) error {
+		for _, r := range srv {
+			zr.Remove(r)
+		}
+		return nil
+	})
+}
+
+// authorizeSRV checks that user owns the zone containing domain
+// and returns the name and zone under which the SRV records are stored
+func (c *Mgr) authorizeSRV(user, service, proto, domain string) (name, zone string, err error) {
+	if err := validateDomain(domain); err != nil {
+		return "", "", err
+	}
+
+	for _, label := range []string{service, proto} {
+		if !srvLabelRegex.MatchString(label) {
+			return "", "", fmt.Errorf("SRV label '%s' is invalid, expected format is _label", label)
+		}
+	}
+
+	name, zone, owner, err := c.locateDomain(domain)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := owner.refuseReverse(zone); err != nil {
+		return "", "", err
+	}
+
+	if owner.Owner != user {
+		return "", "", errors.Wrapf(ErrAuth, "cannot modify SRV records of %s", domain)
+	}
+
+	if name == apex {
+		return fmt.Sprintf("%s.%s", service, proto), zone, nil
+	}
+
+	return fmt.Sprintf("%s.%s.%s", service, proto, name), zone, nil
+}
+
+// AddCAA adds CAA records to the apex of the delegated zone domain
+func (c *Mgr) AddCAA(user, domain string, caa []RecordCAA) error {
+	log.Info().Msgf("add CAA records to %s %+v", domain, caa)
+
+	zone, err := c.authorizeApex(user, domain)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range caa {
+		if err := validateCAA(r); err != nil {
+			return err
+		}
+	}
+
+	return c.updateZoneRecords(zone, apex, func(zr *Zone) error {
+		for _, r := range caa {
+			r.TTL = c.ttl(r.TTL)
+			zr.Add(r)
+		}
+		return nil
+	})
+}
+
+// RemoveCAA removes CAA records added with AddCAA
+func (c *Mgr) RemoveCAA(user, domain string, caa []RecordCAA) error {
+	zone, err := c.authorizeApex(user, domain)
+	if err != nil {
+		return err
+	}
+
+	return c.updateZoneRecords(zone, apex, func(zr *Zone) error {
+		for _, r := range caa {
+			zr.Remove(r)
+		}
+		return nil
+	})
+}
+
+// NameServer is an external nameserver a subdomain is delegated to.
+// IPs are published as glue records, they are required when Host is
+// inside the delegated subdomain and refused otherwise
+type NameServer struct {
+	Host string   `json:"host"`
+	IPs  []net.IP `json:"ips,omitempty"`
+}
+
+// AddSubdomainDelegation hands domain off to external nameservers by publishing
+// NS records, and glue records if needed, in the parent zone. Only the owner of
+// a delegated zone can delegate part of it, this is never allowed on domains
+// managed by the gateway
+func (c *Mgr) AddSubdomainDelegation(user, domain string, nameservers []NameServer) error {
+	log.Info().Msgf("delegate subdomain %s to %+v", domain, nameservers)
+
+	if len(nameservers) == 0 {
+		return fmt.Errorf("at least one nameserver is required to delegate %s", domain)
+	}
+
+	// the nameservers are checked before the transaction, they do not depend on the zone
+	hosts := make([]string, len(nameservers))
+	for i, ns := range nameservers {
+		host := strings.TrimSuffix(ns.Host, ".")
+		if !govalidator.IsDNSName(host) || host == domain {
+			return fmt.Errorf("nameserver host '%s' is invalid", ns.Host)
+		}
+
+		inside := strings.HasSuffix(host, "."+domain)
+		if inside && len(ns.IPs) == 0 {
+			return fmt.Errorf("nameserver %s is inside %s, glue IPs are required", host, domain)
+		} else if !inside && len(ns.IPs) > 0 {
+			return fmt.Errorf("nameserver %s is outside %s, glue IPs are not allowed", host, domain)
+		}
+		hosts[i] = host
+	}
+
+	_, zone, err := c.authorizeSubdomainDelegation(user, domain)
+	if err != nil {
+		return err
+	}
+
+	// the NS and glue records are written in a single transaction, so they cannot
+	// interleave with a concurrent reservation of the same names or be half written
+	return c.atomic(func(r *Mgr, t *tx) error {
+		name, zone, err := r.authorizeSubdomainDelegation(user, domain)
+		if err != nil {
+			return err
+		}
+
+		zr, err := r.getZoneRecords(zone, name)
+		if err != nil {
+			return err
+		}
+
+		if !zr.Records.IsEmpty() {
+			// like for AddSubdomain, the existing records needs to be removed
+			// before the name can be delegated
+			return errors.Wrapf(ErrSubdomainUsed, "cannot delegate subdomain %s of zone %s", name, zone)
+		}
+
+		ttl := c.ttl(defaultTTL)
+		glues := make(map[string]Zone)
+		for i, ns := range nameservers {
+			host := hosts[i]
+			zr.Add(RecordNS{Host: host, TTL: ttl})
+			if len(ns.IPs) == 0 {
+				continue
+			}
+
+			glueName := strings.TrimSuffix(host, "."+zone)
+			glue, ok := glues[glueName]
+			if !ok {
+				glue, err = r.getZoneRecords(zone, glueName)
+				if err != nil {
+					return err
+				}
+				if !glue.Records.IsEmpty() {
+					return errors.Wrapf(ErrSubdomainUsed, "cannot add glue records for %s", host)
+				}
+			}
+
+			for _, ip := range ns.IPs {
+				glue.Add(recordFromIP(ip, ttl))
+			}
+			glues[glueName] = glue
+		}
+
+		if err := t.setZoneRecords(zone, name, zr); err != nil {
+			return err
+		}
+
+		for glueName, glue := range glues {
+			if err := t.setZoneRecords(zone, glueName, glue); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, "zone", zoneKey(zone))
+}
+
+// RemoveSubdomainDelegation removes a delegation added with AddSubdomainDelegation
+// together with its glue records
+func (c *Mgr) RemoveSubdomainDelegation(user, domain string) error {
+	_, zone, err := c.authorizeSubdomainDelegation(user, domain)
+	if err != nil {
+		return err
+	}
+
+	return c.atomic(func(r *Mgr, t *tx) error {
+		name, zone, err := r.authorizeSubdomainDelegation(user, domain)
+		if err != nil {
+			return err
+		}
+
+		zr, err := r.getZoneRecords(zone, name)
+		if err != nil {
+			return err
+		}
+
+		if zr.Records.IsEmpty() {
+			return nil
+		}
+
+		if _, ok := zr.Records[RecordTypeNS]; !ok || len(zr.Records) != 1 {
+			return fmt.Errorf("subdomain %s is not delegated", domain)
+		}
+
+		for _, r := range zr.Records[RecordTypeNS] {
+			host := r.(RecordNS).Host
+			if !strings.HasSuffix(host, "."+domain) {
+				continue
+			}
+
+			t.deleteZoneRecords(zone, strings.TrimSuffix(host, "."+zone))
+		}
+
+		t.deleteZoneRecords(zone, name)
+		return nil
+	}, "zone", zoneKey(zone))
+}
+
+// authorizeSubdomainDelegation checks that domain is a subdomain of a zone
+// delegated by user
+func (c *Mgr) authorizeSubdomainDelegation(user, domain string) (name, zone string, err error) {
+	if err := validateDomain(domain); err != nil {
+		return "", "", err
+	}
+
+	name, zone, owner, err := c.locateDomain(domain)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := owner.refuseReverse(zone); err != nil {
+		return "", "", err
+	}
+
+	if name == apex {
+		return "", "", fmt.Errorf("cannot delegate %s, it is the apex of a zone", domain)
+	}
+
+	if owner.Owner == c.identity {
+		return "", "", errors.Wrapf(ErrAuth, "cannot delegate subdomain %s of a zone managed by the gateway", domain)
+	} else if owner.Owner != user {
+		return "", "", errors.Wrapf(ErrAuth, "cannot delegate subdomain %s of zone %s", name, zone)
+	}
+
+	return name, zone, nil
+}
+
+// authorizeApex checks that domain is a zone delegated by user
+func (c *Mgr) authorizeApex(user, domain string) (zone string, err error) {
+	name, zone, err := c.authorizeRecords(user, domain)
+	if err != nil {
+		return "", err
+	}
+
+	if name != apex {
+		return "", fmt.Errorf("%s is not a delegated domain", domain)
+	}
+
+	return zone, nil
+}
+
+// authorizeRecords checks that user is allowed to manage the records of domain
+// it returns the name and zone under which the records of domain are stored.
+// If domain is a zone itself, the apex of the zone is used and only the
+// owner of a delegated zone can modify it. Otherwise the same ownership rules
+// as AddSubdomain applies, except the subdomain must already be reserved by user
+func (c *Mgr) authorizeRecords(user, domain string) (name, zone string, err error) {
+	if err := validateDomain(domain); err != nil {
+		return "", "", err
+	}
+
+	name, zone, owner, err := c.locateDomain(domain)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := owner.refuseReverse(zone); err != nil {
+		return "", "", err
+	}
+
+	if name == apex {
+		if owner.Owner == c.identity || owner.Owner != user {
+			return "", "", errors.Wrapf(ErrAuth, "cannot modify records of zone %s", domain)
+		}
+		return name, zone, nil
+	}
+
+	if owner.Owner == c.identity { // this is a manged domain
+		subOwner, err := c.getSubdomainOwner(domain)
+		if err != nil {
+			return "", "", err
+		}
+
+		if subOwner != user {
+			return "", "", errors.Wrapf(ErrAuth, "cannot modify records of subdomain %s in zone %s", name, zone)
+		}
+	} else if owner.Owner != user { //this is a deletegatedDomain
+		return "", "", errors.Wrapf(ErrAuth, "cannot modify records of subdomain %s in zone %s", name, zone)
+	}
+
+	return name, zone, nil
+}
+
+// locateDomain finds the zone managed by the gateway that contains domain
+// and returns the name of domain inside this zone together with the zone owner.
+// If domain is a zone itself, name is the apex of the zone
+func (c *Mgr) locateDomain(domain string) (name, zone string, owner ZoneOwner, err error) {
+	name, zone, owner, err = c.findZone(domain)
+	if err != nil {
+		return "", "", owner, err
+	}
+
+	if owner.Owner == "" {
+		return "", "", owner, fmt.Errorf("%s is not managed by the gateway. delegate the domain first", zone)
+	}
+
+	return name, zone, owner, nil
+}
+
+// findZone is like locateDomain but does not fail if the zone is not
+// managed by the gateway, in which case the returned owner is empty.
+// The zone is the longest suffix of domain managed by the gateway and
+// name holds all the labels of domain in front of it
+func (c *Mgr) findZone(domain string) (name, zone string, owner ZoneOwner, err error) {
+	labels := strings.Split(domain, ".")
+	for i := 0; i < len(labels)-1; i++ {
+		zone = strings.Join(labels[i:], ".")
+		owner, err = c.getZoneOwner(zone)
+		if err != nil {
+			return "", "", owner, err
+		}
+
+		if owner.Owner == "" {
+			continue
+		}
+
+		if i == 0 {
+			return apex, zone, owner, nil
+		}
+		return strings.Join(labels[:i], "."), zone, owner, nil
+	}
+
+	name, zone = splitDomain(domain)
+	return name, zone, ZoneOwner{}, nil
+}
+
+// AddDomainDelagate configures coreDNS to manage domain. The records given
+// are added to the apex of the zone in the same transaction, so the domain is
+// not delegated if any of them is invalid. Only MX and CAA records can be given
+func (c *Mgr) AddDomainDelagate(identity, user, domain string, records ...Record) error {
+	return c.addZone(identity, user, domain, false, records)
+}
+
+// addZone configures coreDNS to manage domain, as a reverse zone if reverse is set
+func (c *Mgr) addZone(identity, user, domain string, reverse bool, records []Record) error {
+	if err := validateDomain(domain); err != nil {
+		return err
+	}
+
+	if IsWildcard(domain) {
+		return fmt.Errorf("cannot delegate wildcard domain %s", domain)
+	}
+
+	records, err := c.apexRecords(records)
+	if err != nil {
+		return errors.Wrapf(err, "cannot delegate domain %s", domain)
+	}
+
+	// the owner, the zone index and the owner TXT record are written in the same
+	// transaction, so a zone is never left out of the index
+	return c.atomic(func(r *Mgr, t *tx) error {
+		owner, err := r.getZoneOwner(domain)
+		if err != nil {
+			return err
+		}
+
+		if owner.Owner != "" && owner.Owner != user {
+			return fmt.Errorf("%w cannot delegate domain %s", ErrAuth, domain)
+		}
+
+		if owner.Reverse && !reverse {
+			return owner.refuseReverse(domain)
+		}
+
+		owner.Owner = user
+		owner.Reverse = reverse
+		if err := t.setZoneOwner(domain, owner); err != nil {
+			return errors.Wrap(err, "failed to set zone owner")
+		}
+
+		t.send("SADD", zoneIndexKey, domain)
+
+		txt, err := ownerTXTRecord(identity, owner.Owner)
+		if err != nil {
+			return err
+		}
+		if err := t.setZoneRecords(domain, ownerName, txt); err != nil {
+			return err
+		}
+
+		if len(records) == 0 {
+			return nil
+		}
+
+		zr, err := r.getZoneRecords(domain, apex)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			zr.Add(record)
+		}
+		return t.setZoneRecords(domain, apex, zr)
+	}, "zone", zoneKey(domain))
+}
+
+// apexRecords validates the records given to AddDomainDelagate
+// and returns them with their TTL clamped
+func (c *Mgr) apexRecords(records []Record) ([]Record, error) {
+	clamped := make([]Record, 0, len(records))
+	for _, record := range records {
+		switch r := record.(type) {
+		case RecordMX:
+			if err := validateMX(r); err != nil {
+				return nil, err
+			}
+			r.TTL = c.ttl(r.TTL)
+			clamped = append(clamped, r)
+		case RecordCAA:
+			if err := validateCAA(r); err != nil {
+				return nil, err
+			}
+			r.TTL = c.ttl(r.TTL)
+			clamped = append(clamped, r)
+		default:
+			return nil, fmt.Errorf("%s records cannot be added to the apex of a delegated domain", record.Type())
+		}
+	}
+	return clamped, nil
+}
+
+// ownerTXTRecord returns the records of the __owner__ name of a delegated zone
+func ownerTXTRecord(identity, owner string) (Zone, error) {
+	var zone Zone
+	// we are not using the ZoneOwner struct because of
+	// 1- backward compatibility issue since it does not define json tags
+	// 2- extendability of this struct with more data in the future
+	data := struct {
+		Identity string `json:"identity"`
+		Owner    string `json:"owner"`
+	}{
+		Identity: identity,
+		Owner:    owner,
+	}
+
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return zone, errors.Wrap(err, "failed to create owner TXT record")
+	}
+
+	zone.Add(RecordTXT{Text: string(bytes), TTL: 600})
+	return zone, nil
+}
+
+// RemoveDomainDelagate remove a delagated domain added with AddDomainDelagate
+// All the subdomains reserved in the domain are released as well, their
+// names are returned to the caller
+func (c *Mgr) RemoveDomainDelagate(user string, domain string) ([]string, error) {
+	if err := validateDomain(domain); err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	err := c.atomic(func(r *Mgr, t *tx) error {
+		owner, err := r.getZoneOwner(domain)
+		if err != nil {
+			return err
+		}
+
+		if owner.Owner != "" && owner.Owner != user {
+			return fmt.Errorf("%w cannot remove delegated domain %s", ErrAuth, domain)
+		}
+
+		removed, err = r.deleteSubdomainOwners(t, domain)
+		if err != nil {
+			return errors.Wrapf(err, "failed to release subdomains of %s", domain)
+		}
+
+		// remove all eventual subdomain configuration for this delegated domain
+		t.send("DEL", zoneKey(domain))
+		t.send("HDEL", zoneSerialKey, domain)
+		t.send("HDEL", transfersKey, domain)
+		t.send("SREM", zoneIndexKey, domain)
+		t.send("HDEL", "zone", domain)
+		return nil
+	}, "zone", "managed_domains", zoneKey(domain))
+
+	return removed, err
+}
+
+// NestedZones returns the zones managed by the gateway inside domain,
+// such as the zones delegated by other users under a delegated domain
+func (c *Mgr) NestedZones(domain string) ([]string, error) {
+	keys, err := c.listCorednsZones()
+	if err != nil {
+		return nil, err
+	}
+
+	var nested []string
+	for _, key := range keys {
+		zone := strings.TrimSuffix(key, ".")
+		if strings.HasSuffix(zone, "."+domain) {
+			nested = append(nested, zone)
+		}
+	}
+
+	return nested, nil
+}
+
+// DelegatedZones returns the zones delegated to the gateway by the users
+// together with their owner. The zones managed by the gateway are not included
+func (c *Mgr) DelegatedZones() (map[string]string, error) {
+	keys, err := c.listCorednsZones()
+	if err != nil {
+		return nil, err
+	}
+
+	zones := make(map[string]string, len(keys))
+	for _, key := range keys {
+		zone := strings.TrimSuffix(key, ".")
+		owner, err := c.getZoneOwner(zone)
+		if err != nil {
+			return nil, err
+		}
+
+		if owner.Owner == "" || owner.Owner == c.identity {
+			continue
+		}
+		zones[zone] = owner.Owner
+	}
+
+	return zones, nil
+}
+
+// Subdomains returns all the subdomains reserved with AddSubdomain
+// together with the user that reserved them
+func (c *Mgr) Subdomains() (map[string]string, error) {
+	con := c.redis.Get()
+	defer con.Close()
+
+	subdomains, err := redis.StringMap(con.Do("HGETALL", "managed_domains"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list subdomains")
+	}
+
+	return subdomains, nil
+}
+
+// ReleaseSubdomain removes the records of a subdomain added with AddSubdomain
+// and releases it, whoever reserved it
+func (c *Mgr) ReleaseSubdomain(domain string) error {
+	base := strings.TrimPrefix(domain, WildcardPrefix)
+	_, zone, _, err := c.findZone(base)
+	if err != nil {
+		return err
+	}
+
+	return c.atomic(func(r *Mgr, t *tx) error {
+		name, zone, owner, err := r.findZone(base)
+		if err != nil {
+			return err
+		}
+
+		t.deleteSubdomainOwner(domain)
+		t.deleteHealthCheck(domain)
+		if owner.Owner == "" {
+			return nil
+		}
+
+		if IsWildcard(domain) {
+			name = wildcardName(name)
+		}
+		t.deleteZoneRecords(zone, name)
+		return nil
+	}, "zone", "managed_domains", zoneKey(zone))
+}
+
+// deleteSubdomainOwners releases all the subdomains reserved in the zone domain
+func (c *Mgr) deleteSubdomainOwners(t *tx, domain string) ([]string, error) {
+	con := c.redis.Get()
+	defer con.Close()
+
+	subdomains, err := redis.Strings(con.Do("HKEYS", "managed_domains"))
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, subdomain := range subdomains {
+		base := strings.TrimPrefix(subdomain, WildcardPrefix)
+		if base != domain && !strings.HasSuffix(base, "."+domain) {
+			continue
+		}
+
+		// the subdomain can be in a zone delegated inside domain,
+		// it then belongs to that zone and is kept
+		_, zone, _, err := c.findZone(base)
+		if err != nil {
+			return nil, err
+		}
+		if zone != domain {
+			continue
+		}
+
+		t.deleteSubdomainOwner(subdomain)
+		t.deleteHealthCheck(subdomain)
+		removed = append(removed, subdomain)
+	}
+
+	return removed, nil
+}
+
 func splitDomain(d string) (name, domain string) {
 	ss := strings.Split(d, ".")
 	if len(ss) < 3 {
@@ -444,22 +1431,137 @@ func splitDomain(d string) (name, domain string) {
 	return ss[0], strings.Join(ss[1:], ".")
 }
 
-func recordFromIP(ip net.IP) (r Record) {
+// IsWildcard returns true if domain is a wildcard domain
+func IsWildcard(domain string) bool {
+	return strings.HasPrefix(domain, WildcardPrefix)
+}
+
+// wildcardName returns the name under which the coredns redis plugin
+// expects the records of a wildcard beneath name
+func wildcardName(name string) string {
+	if name == apex {
+		return "*"
+	}
+	return WildcardPrefix + name
+}
+
+func recordFromIP(ip net.IP, ttl int) (r Record) {
 	if ip.To4() != nil {
 		r = RecordA{
 			IP4: ip.String(),
-			TTL: 3600,
+			TTL: ttl,
 		}
 	} else {
 		r = RecordAAAA{
 			IP6: ip.String(),
-			TTL: 3600,
+			TTL: ttl,
 		}
 	}
 	return r
 }
 
+// cnameRecord creates the CNAME record that makes domain an alias of target
+func cnameRecord(domain, target string, ttl int) (Record, error) {
+	target = strings.TrimSuffix(target, ".")
+	if !govalidator.IsDNSName(target) {
+		return nil, fmt.Errorf("CNAME target '%s' is invalid", target)
+	}
+
+	if target == domain {
+		return nil, fmt.Errorf("%s cannot be an alias of itself", domain)
+	}
+
+	return RecordCname{Host: target, TTL: ttl}, nil
+}
+
+func hasCNAME(records []Record) bool {
+	for _, r := range records {
+		if r.Type() == RecordTypeCNAME {
+			return true
+		}
+	}
+	return false
+}
+
+// validateTTL checks the TTL requested for a record, 0 means the default TTL
+func validateTTL(ttl int) error {
+	if ttl < 0 {
+		return fmt.Errorf("TTL %d cannot be negative", ttl)
+	}
+	return nil
+}
+
+// ValidateMX checks the MX records given to AddMX, so they
+// can be checked before the domain they belong to is reserved
+func ValidateMX(mx []RecordMX) error {
+	for _, r := range mx {
+		if err := validateMX(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateMX(r RecordMX) error {
+	if err := validateTTL(r.TTL); err != nil {
+		return err
+	}
+
+	if r.Preference < 0 || r.Preference > math.MaxUint16 {
+		return fmt.Errorf("MX preference %d is out of range", r.Preference)
+	}
+
+	if !govalidator.IsDNSName(strings.TrimSuffix(r.Host, ".")) {
+		return fmt.Errorf("MX host '%s' is invalid", r.Host)
+	}
+
+	return nil
+}
+
+func validateSRV(r RecordSRV) error {
+	if err := validateTTL(r.TTL); err != nil {
+		return err
+	}
+
+	for _, v := range []int{r.Priority, r.Weight, r.Port} {
+		if v < 0 || v > math.MaxUint16 {
+			return fmt.Errorf("SRV priority, weight and port must be between 0 and %d", math.MaxUint16)
+		}
+	}
+
+	if !govalidator.IsDNSName(strings.TrimSuffix(r.Target, ".")) {
+		return fmt.Errorf("SRV target '%s' is invalid", r.Target)
+	}
+
+	return nil
+}
+
+func validateCAA(r RecordCAA) error {
+	if err := validateTTL(r.TTL); err != nil {
+		return err
+	}
+
+	if r.Flag < 0 || r.Flag > math.MaxUint8 {
+		return fmt.Errorf("CAA flag %d is out of range", r.Flag)
+	}
+
+	switch r.Tag {
+	case "issue", "issuewild", "iodef":
+	default:
+		return fmt.Errorf("CAA tag '%s' is invalid, supported tags are issue, issuewild and iodef", r.Tag)
+	}
+
+	if r.Tag == "iodef" && !govalidator.IsURL(r.Value) {
+		return fmt.Errorf("CAA iodef value '%s' must be a URL", r.Value)
+	}
+
+	return nil
+}
+
 func validateDomain(domain string) error {
+	// only a single wildcard label in first position is allowed
+	domain = strings.TrimPrefix(domain, WildcardPrefix)
+
 	if !govalidator.IsDNSName(domain) {
 		return fmt.Errorf("domain '%s' name is invalid", domain)
 	}
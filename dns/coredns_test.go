@@ -4,7 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	"github.com/threefoldtech/zos/pkg/identity"
@@ -12,9 +16,23 @@ import (
 	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/tfgateway/audit"
 	"github.com/threefoldtech/tfgateway/redis"
+	"github.com/threefoldtech/tfgateway/reserved"
 )
 
+// newTestMgr returns a Mgr with the identity gwid backed by a new miniredis server
+func newTestMgr(t *testing.T) (*miniredis.Miniredis, *Mgr) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	return s, New(pool, "gwid")
+}
+
 func Test_splitDomain(t *testing.T) {
 	tests := []struct {
 		domain string
@@ -88,6 +106,18 @@ func Test_validateDomain(t *testing.T) {
 			domain: "foo..com",
 			err:    true,
 		},
+		{
+			domain: "*.domain.com",
+			err:    false,
+		},
+		{
+			domain: "a.*.domain.com",
+			err:    true,
+		},
+		{
+			domain: "*.com",
+			err:    true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.domain, func(t *testing.T) {
@@ -122,7 +152,7 @@ func TestRecordFromIP(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		r := recordFromIP(tt.ip)
+		r := recordFromIP(tt.ip, 3600)
 		assert.Equal(t, tt.record, r)
 	}
 }
@@ -145,18 +175,11 @@ func TestLoadRecords(t *testing.T) {
 }
 
 func TestZoneOwner(t *testing.T) {
-	s, err := miniredis.Run()
-	require.NoError(t, err)
-	defer s.Close()
-
-	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
-	require.NoError(t, err)
-
-	mgr := New(pool, "")
+	_, mgr := newTestMgr(t)
 
 	zone := "mydomain.com"
 	zo := ZoneOwner{Owner: "user1"}
-	err = mgr.setZoneOwner(zone, zo)
+	err := mgr.setZoneOwner(zone, zo)
 	require.NoError(t, err, "setZoneOwner should succeed")
 
 	result, err := mgr.getZoneOwner(zone)
@@ -169,14 +192,7 @@ func TestZoneOwner(t *testing.T) {
 }
 
 func TestZoneRecords(t *testing.T) {
-	s, err := miniredis.Run()
-	require.NoError(t, err)
-	defer s.Close()
-
-	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
-	require.NoError(t, err)
-
-	mgr := New(pool, "")
+	s, mgr := newTestMgr(t)
 
 	zone := "mydomain.com"
 	name := "test"
@@ -202,7 +218,7 @@ func TestZoneRecords(t *testing.T) {
 		},
 	}
 
-	err = mgr.setZoneRecords(zone, name, zo)
+	err := mgr.setZoneRecords(zone, name, zo)
 	require.NoError(t, err, "setZoneRecords should succeed")
 
 	result, err := mgr.getZoneRecords(zone, name)
@@ -218,23 +234,20 @@ func TestZoneRecords(t *testing.T) {
 }
 
 func TestDomainDelegate(t *testing.T) {
-	s, err := miniredis.Run()
-	require.NoError(t, err)
-	defer s.Close()
-
-	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
-	require.NoError(t, err)
-
-	mgr := New(pool, "")
+	s, mgr := newTestMgr(t)
 
 	id := "id"
 	user := "user"
 	domain := "my.domain.com"
 
-	err = mgr.AddDomainDelagate(id, user, domain)
+	err := mgr.AddDomainDelagate(id, user, domain)
+	require.NoError(t, err)
+
+	indexed, err := s.IsMember(zoneIndexKey, domain)
 	require.NoError(t, err)
+	assert.True(t, indexed, "the zone is added to the zone index with its owner")
 
-	err = mgr.RemoveDomainDelagate("user2", domain)
+	_, err = mgr.RemoveDomainDelagate("user2", domain)
 	assert.Error(t, err, "a domain can only be remove by its owner")
 	assert.True(t, errors.Is(err, ErrAuth))
 
@@ -242,18 +255,44 @@ func TestDomainDelegate(t *testing.T) {
 	assert.Error(t, err, "a domain cannot be overwritten by another user")
 	assert.True(t, errors.Is(err, ErrAuth))
 
-	err = mgr.RemoveDomainDelagate(user, domain)
+	_, err = mgr.RemoveDomainDelagate(user, domain)
 	require.NoError(t, err)
 }
 
-func TestSubdomain(t *testing.T) {
-	s, err := miniredis.Run()
+func TestDomainDelegateNestedZone(t *testing.T) {
+	s, mgr := newTestMgr(t)
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", "example.com"))
+	require.NoError(t, mgr.AddDomainDelagate("id", "user2", "dev.example.com"))
+	require.NoError(t, mgr.AddSubdomain("user", "www.example.com", ips, 0))
+	require.NoError(t, mgr.AddSubdomain("user2", "app.dev.example.com", ips, 0))
+	require.NoError(t, mgr.AddSubdomain("user2", "*.dev.example.com", ips, 0))
+
+	nested, err := mgr.NestedZones("example.com")
 	require.NoError(t, err)
-	defer s.Close()
+	assert.Equal(t, []string{"dev.example.com"}, nested)
 
-	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	_, err = mgr.RemoveDomainDelagate("user2", "example.com")
+	assert.True(t, errors.Is(err, ErrAuth))
+
+	removed, err := mgr.RemoveDomainDelagate("user", "example.com")
 	require.NoError(t, err)
-	mgr := New(pool, "")
+	assert.Equal(t, []string{"www.example.com"}, removed)
+
+	// the zone delegated by user2 inside example.com is not touched
+	subdomains, err := mgr.Subdomains()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"app.dev.example.com": "user2", "*.dev.example.com": "user2"}, subdomains)
+	assert.NotEmpty(t, s.HGet("dev.example.com.", "app"))
+
+	zones, err := mgr.DelegatedZones()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"dev.example.com": "user2"}, zones)
+}
+
+func TestSubdomain(t *testing.T) {
+	_, mgr := newTestMgr(t)
 
 	id := "id"
 	user := "user"
@@ -263,13 +302,13 @@ func TestSubdomain(t *testing.T) {
 		net.ParseIP("10.1.1.10"),
 	}
 
-	err = mgr.AddDomainDelagate(id, user, zone)
+	err := mgr.AddDomainDelagate(id, user, zone)
 	require.NoError(t, err)
 
-	err = mgr.AddSubdomain(user, domain, ips)
+	err = mgr.AddSubdomain(user, domain, ips, 0)
 	require.NoError(t, err)
 
-	err = mgr.AddSubdomain("user2", domain, ips)
+	err = mgr.AddSubdomain("user2", domain, ips, 0)
 	require.Error(t, err, "only the owner of the zone can add a subdomain")
 	assert.True(t, errors.Is(err, ErrAuth))
 
@@ -280,22 +319,183 @@ func TestSubdomain(t *testing.T) {
 	err = mgr.RemoveSubdomain(user, domain, ips)
 	require.NoError(t, err)
 
-	err = mgr.AddSubdomain(user, "sub.thisisnotdelegated.com", ips)
+	err = mgr.AddSubdomain(user, "sub.thisisnotdelegated.com", ips, 0)
 	assert.Error(t, err)
 	assert.Equal(t, "thisisnotdelegated.com is not managed by the gateway. delegate the domain first", err.Error())
 }
 
-func TestSubdomainChangeOwner(t *testing.T) {
-	// https://github.com/threefoldtech/tfexplorer/issues/166
-	s, err := miniredis.Run()
+func TestDeepSubdomain(t *testing.T) {
+	gwid := "gwid"
+	_, mgr := newTestMgr(t)
+
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+	require.NoError(t, mgr.AddDomainDelagate("id", gwid, "gateway.tf"))
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", "example.com"))
+	require.NoError(t, mgr.AddDomainDelagate("id", "user2", "dev.example.com"))
+
+	tt := []struct {
+		domain string
+		name   string
+		zone   string
+		owner  string
+	}{
+		{"example.com", apex, "example.com", "user"},
+		{"www.example.com", "www", "example.com", "user"},
+		{"a.b.example.com", "a.b", "example.com", "user"},
+		{"dev.example.com", apex, "dev.example.com", "user2"},
+		{"a.b.dev.example.com", "a.b", "dev.example.com", "user2"},
+		{"a.b.notdelegated.com", "a", "b.notdelegated.com", ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.domain, func(t *testing.T) {
+			name, zone, owner, err := mgr.findZone(tc.domain)
+			require.NoError(t, err)
+			assert.Equal(t, tc.name, name)
+			assert.Equal(t, tc.zone, zone)
+			assert.Equal(t, tc.owner, owner.Owner)
+		})
+	}
+
+	err := mgr.AddSubdomain("user", "a.b.example.com", ips, 0)
 	require.NoError(t, err)
-	defer s.Close()
+	zr, err := mgr.getZoneRecords("example.com", "a.b")
+	require.NoError(t, err)
+	assert.Len(t, zr.Records[RecordTypeA], 1)
 
-	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	err = mgr.AddSubdomain("user", "a.b.dev.example.com", ips, 0)
+	assert.True(t, errors.Is(err, ErrAuth), "the most specific zone owns the name")
+
+	err = mgr.AddSubdomain("user2", "a.b.dev.example.com", ips, 0)
+	require.NoError(t, err)
+
+	err = mgr.AddSubdomain("user", "a.b.gateway.tf", ips, 0)
+	assert.True(t, errors.Is(err, ErrAuth), "deep names are not allowed in managed zones")
+
+	err = mgr.RemoveSubdomain("user", "a.b.example.com", ips)
+	require.NoError(t, err)
+	zr, err = mgr.getZoneRecords("example.com", "a.b")
+	require.NoError(t, err)
+	assert.True(t, zr.Records.IsEmpty())
+}
+
+func TestSubdomainTTL(t *testing.T) {
+	_, mgr := newTestMgr(t)
+
+	assert.Error(t, mgr.SetTTLRange(600, 60))
+	require.NoError(t, mgr.SetTTLRange(60, 600))
+
+	zone := "mydomain.com"
+	err := mgr.AddDomainDelagate("id", "user", zone)
 	require.NoError(t, err)
 
+	tt := []struct {
+		domain string
+		ttl    int
+		result int
+	}{
+		{"default", 0, 600},
+		{"short", 30, 60},
+		{"long", 7200, 600},
+		{"valid", 300, 300},
+		{"*.wildcard", 30, 60},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.domain, func(t *testing.T) {
+			domain := fmt.Sprintf("%s.%s", tc.domain, zone)
+			ips := []net.IP{net.ParseIP("10.1.1.10"), net.ParseIP("2a02:2788:864:1314:9eb6:d0ff:fe97:764b")}
+
+			err := mgr.AddSubdomain("user", domain, ips, tc.ttl)
+			require.NoError(t, err)
+
+			zr, err := mgr.getZoneRecords(zone, tc.domain)
+			require.NoError(t, err)
+			assert.Equal(t, []Record{RecordA{IP4: "10.1.1.10", TTL: tc.result}}, zr.Records[RecordTypeA])
+			assert.Equal(t, []Record{RecordAAAA{IP6: "2a02:2788:864:1314:9eb6:d0ff:fe97:764b", TTL: tc.result}}, zr.Records[RecordTypeAAAA])
+
+			err = mgr.RemoveSubdomain("user", domain, ips)
+			require.NoError(t, err)
+
+			zr, err = mgr.getZoneRecords(zone, tc.domain)
+			require.NoError(t, err)
+			assert.True(t, zr.Records.IsEmpty())
+		})
+	}
+}
+
+func TestSubdomainCNAME(t *testing.T) {
 	gwid := "gwid"
-	mgr := New(pool, gwid)
+	_, mgr := newTestMgr(t)
+
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+	require.NoError(t, mgr.AddDomainDelagate("id", gwid, "gateway.tf"))
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", "example.com"))
+
+	err := mgr.AddSubdomainCNAME("user", "app.gateway.tf", "myapp.herokuapp.com.", 0)
+	require.NoError(t, err)
+
+	zr, err := mgr.getZoneRecords("gateway.tf", "app")
+	require.NoError(t, err)
+	assert.Equal(t, []Record{RecordCname{Host: "myapp.herokuapp.com", TTL: defaultTTL}}, zr.Records[RecordTypeCNAME])
+
+	owner, err := mgr.getSubdomainOwner("app.gateway.tf")
+	require.NoError(t, err)
+	assert.Equal(t, "user", owner)
+
+	err = mgr.AddSubdomainCNAME("user2", "app.gateway.tf", "other.com", 0)
+	assert.True(t, errors.Is(err, ErrSubdomainUsed))
+
+	err = mgr.AddSubdomainCNAME("user", "www.example.com", "example.com", 0)
+	require.NoError(t, err)
+
+	err = mgr.AddSubdomain("user", "www.example.com", ips, 0)
+	assert.True(t, errors.Is(err, ErrCNAMEConflict), "a CNAME cannot coexist with other records")
+
+	err = mgr.AddSubdomainCNAME("user", "www.example.com", "other.com", 0)
+	assert.True(t, errors.Is(err, ErrCNAMEConflict), "a name can only have one CNAME")
+
+	err = mgr.AddSubdomain("user", "api.example.com", ips, 0)
+	require.NoError(t, err)
+
+	err = mgr.AddSubdomainCNAME("user", "api.example.com", "other.com", 0)
+	assert.True(t, errors.Is(err, ErrCNAMEConflict))
+
+	err = mgr.AddMX("user", "www.example.com", []RecordMX{{Host: "mail.example.com", Preference: 10}})
+	assert.True(t, errors.Is(err, ErrCNAMEConflict))
+
+	err = mgr.AddSubdomainCNAME("user", "example.com", "other.com", 0)
+	assert.True(t, errors.Is(err, ErrCNAMEConflict), "the zone apex cannot be a CNAME")
+
+	err = mgr.AddSubdomainCNAME("user", "blog.example.com", "not a host", 0)
+	assert.Error(t, err)
+
+	err = mgr.AddSubdomainCNAME("user", "blog.example.com", "blog.example.com", 0)
+	assert.Error(t, err)
+
+	err = mgr.AddSubdomainCNAME("user", "*.apps.example.com", "lb.example.com", 0)
+	require.NoError(t, err)
+
+	err = mgr.RemoveSubdomainCNAME("user", "*.apps.example.com", "lb.example.com")
+	require.NoError(t, err)
+
+	err = mgr.RemoveSubdomainCNAME("user", "app.gateway.tf", "myapp.herokuapp.com")
+	require.NoError(t, err)
+
+	zr, err = mgr.getZoneRecords("gateway.tf", "app")
+	require.NoError(t, err)
+	assert.True(t, zr.Records.IsEmpty())
+
+	owner, err = mgr.getSubdomainOwner("app.gateway.tf")
+	require.NoError(t, err)
+	assert.Equal(t, "", owner)
+}
+
+func TestSubdomainChangeOwner(t *testing.T) {
+	// https://github.com/threefoldtech/tfexplorer/issues/166
+
+	gwid := "gwid"
+	_, mgr := newTestMgr(t)
 
 	domain := "foo.mydomain.com"
 	subdomain := fmt.Sprintf("test.%s", domain)
@@ -304,18 +504,18 @@ func TestSubdomainChangeOwner(t *testing.T) {
 	}
 
 	// the gateway manage a domain
-	err = mgr.AddDomainDelagate("id", gwid, domain)
+	err := mgr.AddDomainDelagate("id", gwid, domain)
 	require.NoError(t, err)
 
 	// a user create a subdomain
-	err = mgr.AddSubdomain("user", subdomain, ips)
+	err = mgr.AddSubdomain("user", subdomain, ips, 0)
 	require.NoError(t, err)
 
 	// free up the domain, anyone else should be able to use now
 	err = mgr.RemoveSubdomain("user", subdomain, ips)
 	require.NoError(t, err)
 
-	err = mgr.AddSubdomain("user2", subdomain, ips)
+	err = mgr.AddSubdomain("user2", subdomain, ips, 0)
 	assert.NoError(t, err, "anyone should be able to use the domain again")
 }
 
@@ -341,23 +541,590 @@ func TestManagedDomain(t *testing.T) {
 	require.NoError(t, err)
 
 	// random user add a subdomain on the managed domain
-	err = mgr.AddSubdomain("user1", fmt.Sprintf("user1.%s", zone), ips)
+	err = mgr.AddSubdomain("user1", fmt.Sprintf("user1.%s", zone), ips, 0)
 	require.NoError(t, err)
 
 	// random user add a subdomain on the managed domain
-	err = mgr.AddSubdomain("user2", fmt.Sprintf("user2.%s", zone), ips)
+	err = mgr.AddSubdomain("user2", fmt.Sprintf("user2.%s", zone), ips, 0)
 	require.NoError(t, err)
 
-	err = mgr.AddSubdomain("user2", fmt.Sprintf("user1.%s", zone), ips)
+	err = mgr.AddSubdomain("user2", fmt.Sprintf("user1.%s", zone), ips, 0)
 	require.Error(t, err, "a user cannot overwrite the domain of someone else")
 
 	err = mgr.RemoveSubdomain("user2", fmt.Sprintf("user2.%s", zone), ips)
 	require.NoError(t, err)
 
 	ips = append(ips, net.ParseIP("2a02:2788:864:1314:9eb6:d0ff:fe97:764b"))
-	err = mgr.AddSubdomain("user1", fmt.Sprintf("user1.%s", zone), ips)
+	err = mgr.AddSubdomain("user1", fmt.Sprintf("user1.%s", zone), ips, 0)
 	assert.Error(t, err, "a user cannot overwrite his domain without deletion first")
 
-	err = mgr.AddSubdomain("user1", fmt.Sprintf("user2.%s", zone), ips)
+	err = mgr.AddSubdomain("user1", fmt.Sprintf("user2.%s", zone), ips, 0)
 	assert.NoError(t, err, "any user can reuse a freed subdomain")
 }
+
+func TestManagedDomainReservedLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reserved")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "reserved")
+	require.NoError(t, ioutil.WriteFile(path, []byte("www\npaypal*\n"), 0644))
+
+	labels, err := reserved.Load(path, []string{"gateway.tf"})
+	require.NoError(t, err)
+
+	gwid := "gwid"
+	_, mgr := newTestMgr(t)
+	mgr.SetReservedLabels(labels)
+
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+	require.NoError(t, mgr.AddDomainDelagate("id", gwid, "gateway.tf"))
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", "mydomain.com"))
+
+	err = mgr.AddSubdomain("user", "www.gateway.tf", ips, 0)
+	assert.True(t, errors.Is(err, reserved.ErrReserved))
+
+	err = mgr.AddSubdomainCNAME("user", "paypal-login.gateway.tf", "example.com", 0)
+	assert.True(t, errors.Is(err, reserved.ErrReserved))
+
+	err = mgr.AddSubdomain("user", "*.www.gateway.tf", ips, 0)
+	assert.True(t, errors.Is(err, reserved.ErrReserved))
+
+	err = mgr.AddSubdomain("user", "www.mydomain.com", ips, 0)
+	assert.NoError(t, err, "the labels are only reserved in the managed domains")
+
+	subdomains, err := mgr.Subdomains()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"www.mydomain.com": "user"}, subdomains)
+}
+
+func TestManagedDomainConcurrentReservation(t *testing.T) {
+	gwid := "gwid"
+	_, mgr := newTestMgr(t)
+
+	zone := "gateway.tf"
+	domain := fmt.Sprintf("app.%s", zone)
+	err := mgr.AddDomainDelagate(gwid, gwid, zone)
+	require.NoError(t, err)
+
+	const users = 20
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, users)
+	)
+
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := net.IPv4(10, 1, 1, byte(i))
+			errs[i] = mgr.AddSubdomain(fmt.Sprintf("user%d", i), domain, []net.IP{ip}, 0)
+		}(i)
+	}
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		if err == nil {
+			assert.Equal(t, -1, winner, "only one user can reserve the subdomain")
+			winner = i
+			continue
+		}
+		assert.True(t, errors.Is(err, ErrSubdomainUsed) || errors.Is(err, ErrConflict), err.Error())
+	}
+	require.NotEqual(t, -1, winner)
+
+	owner, err := mgr.getSubdomainOwner(domain)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("user%d", winner), owner)
+
+	zr, err := mgr.getZoneRecords(zone, "app")
+	require.NoError(t, err)
+	assert.Equal(t, []Record{RecordA{IP4: net.IPv4(10, 1, 1, byte(winner)).String(), TTL: defaultTTL}}, zr.Records[RecordTypeA])
+
+	// a refused reservation must not leave anything behind
+	err = mgr.AddSubdomain("user", "*.other.gateway.tf", []net.IP{net.ParseIP("10.1.1.10")}, 0)
+	require.True(t, errors.Is(err, ErrAuth))
+	owner, err = mgr.getSubdomainOwner("*.other.gateway.tf")
+	require.NoError(t, err)
+	assert.Empty(t, owner)
+}
+
+func TestMX(t *testing.T) {
+	gwid := "gwid"
+	_, mgr := newTestMgr(t)
+
+	managed := "managed-domain.com"
+	delegated := "mydomain.com"
+	ips := []net.IP{
+		net.ParseIP("10.1.1.10"),
+	}
+	mx := []RecordMX{
+		{Host: "mail.mydomain.com", Preference: 10, TTL: 3600},
+	}
+
+	err := mgr.AddDomainDelagate("id", gwid, managed)
+	require.NoError(t, err)
+	err = mgr.AddDomainDelagate("id", "user", delegated)
+	require.NoError(t, err)
+
+	err = mgr.AddMX("user", delegated, mx)
+	require.NoError(t, err, "owner of a delegated domain can set MX on the apex")
+
+	zr, err := mgr.getZoneRecords(delegated, apex)
+	require.NoError(t, err)
+	assert.Equal(t, []Record{mx[0]}, zr.Records[RecordTypeMX])
+
+	err = mgr.AddMX("user2", delegated, mx)
+	assert.True(t, errors.Is(err, ErrAuth), "only the owner of a delegated domain can set MX on the apex")
+
+	err = mgr.AddDomainDelagate("id", "user", "other.com", RecordMX{Host: "mail.other.com", Preference: 10})
+	require.NoError(t, err, "MX records can be added with the delegation")
+	zr, err = mgr.getZoneRecords("other.com", apex)
+	require.NoError(t, err)
+	assert.Equal(t, []Record{RecordMX{Host: "mail.other.com", Preference: 10, TTL: defaultTTL}}, zr.Records[RecordTypeMX])
+
+	err = mgr.AddDomainDelagate("id", "user", "invalid.com", RecordMX{Host: "mail.invalid.com", Preference: -1})
+	assert.Error(t, err, "the domain is not delegated with invalid MX records")
+	owner, err := mgr.getZoneOwner("invalid.com")
+	require.NoError(t, err)
+	assert.Equal(t, "", owner.Owner)
+
+	err = mgr.AddMX("user", managed, mx)
+	assert.True(t, errors.Is(err, ErrAuth), "nobody can set MX on the apex of a managed domain")
+
+	subdomain := fmt.Sprintf("sub.%s", managed)
+	err = mgr.AddMX("user", subdomain, mx)
+	assert.True(t, errors.Is(err, ErrAuth), "subdomain of a managed domain must be reserved first")
+
+	err = mgr.AddSubdomain("user", subdomain, ips, 0)
+	require.NoError(t, err)
+
+	err = mgr.AddMX("user2", subdomain, mx)
+	assert.True(t, errors.Is(err, ErrAuth), "only the owner of a subdomain can set MX on it")
+
+	err = mgr.AddMX("user", subdomain, mx)
+	require.NoError(t, err)
+
+	err = mgr.AddMX("user", subdomain, []RecordMX{{Host: "not valid", Preference: 10}})
+	assert.Error(t, err)
+
+	zr, err = mgr.getZoneRecords(managed, "sub")
+	require.NoError(t, err)
+	assert.Equal(t, []Record{mx[0]}, zr.Records[RecordTypeMX])
+	assert.Len(t, zr.Records[RecordTypeA], 1)
+
+	err = mgr.RemoveMX("user", subdomain, mx)
+	require.NoError(t, err)
+
+	zr, err = mgr.getZoneRecords(managed, "sub")
+	require.NoError(t, err)
+	assert.Len(t, zr.Records[RecordTypeMX], 0)
+	assert.Len(t, zr.Records[RecordTypeA], 1)
+}
+
+func TestRecordTTL(t *testing.T) {
+	_, mgr := newTestMgr(t)
+	require.NoError(t, mgr.SetTTLRange(60, 7200))
+
+	delegated := "mydomain.com"
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", delegated))
+
+	err := mgr.AddMX("user", delegated, []RecordMX{{Host: "mail.mydomain.com", Preference: 10, TTL: -1}})
+	assert.Error(t, err, "negative TTL are refused")
+	err = mgr.AddSRV("user", "_sip", "_tcp", delegated, []RecordSRV{{Target: "sip.mydomain.com", TTL: -1}})
+	assert.Error(t, err)
+	err = mgr.AddCAA("user", delegated, []RecordCAA{{Tag: "issue", Value: "letsencrypt.org", TTL: -1}})
+	assert.Error(t, err)
+	err = mgr.AddSubdomain("user", "www.mydomain.com", []net.IP{net.ParseIP("10.1.1.10")}, -1)
+	assert.Error(t, err)
+
+	require.NoError(t, mgr.AddMX("user", delegated, []RecordMX{{Host: "mail.mydomain.com", Preference: 10}}))
+	require.NoError(t, mgr.AddSRV("user", "_sip", "_tcp", delegated, []RecordSRV{{Target: "sip.mydomain.com", TTL: 10}}))
+	require.NoError(t, mgr.AddCAA("user", delegated, []RecordCAA{{Tag: "issue", Value: "letsencrypt.org", TTL: 86400}}))
+
+	zr, err := mgr.getZoneRecords(delegated, apex)
+	require.NoError(t, err)
+	assert.Equal(t, defaultTTL, zr.Records[RecordTypeMX][0].(RecordMX).TTL, "0 is the default TTL")
+	assert.Equal(t, 7200, zr.Records[RecordTypeCAA][0].(RecordCAA).TTL, "the TTL is clamped to the range")
+
+	zr, err = mgr.getZoneRecords(delegated, "_sip._tcp")
+	require.NoError(t, err)
+	assert.Equal(t, 60, zr.Records[RecordTypeSRV][0].(RecordSRV).TTL)
+}
+
+func TestSRV(t *testing.T) {
+	gwid := "gwid"
+	s, mgr := newTestMgr(t)
+
+	managed := "managed-domain.com"
+	delegated := "mydomain.com"
+	srv := []RecordSRV{
+		{Priority: 10, Weight: 5, Port: 8448, Target: "matrix.mydomain.com", TTL: 3600},
+	}
+
+	err := mgr.AddDomainDelagate("id", gwid, managed)
+	require.NoError(t, err)
+	err = mgr.AddDomainDelagate("id", "user", delegated)
+	require.NoError(t, err)
+
+	err = mgr.AddSRV("user", "_matrix", "_tcp", delegated, srv)
+	require.NoError(t, err)
+
+	err = mgr.AddSRV("user", "_sip", "_udp", fmt.Sprintf("voip.%s", delegated), srv)
+	require.NoError(t, err)
+
+	zr, err := mgr.getZoneRecords(delegated, "_matrix._tcp")
+	require.NoError(t, err)
+	assert.Equal(t, []Record{srv[0]}, zr.Records[RecordTypeSRV])
+
+	zr, err = mgr.getZoneRecords(delegated, "_sip._udp.voip")
+	require.NoError(t, err)
+	assert.Equal(t, []Record{srv[0]}, zr.Records[RecordTypeSRV])
+
+	err = mgr.AddSRV("user2", "_matrix", "_tcp", delegated, srv)
+	assert.True(t, errors.Is(err, ErrAuth), "only the zone owner can add SRV records")
+
+	err = mgr.AddSRV("user", "_matrix", "_tcp", fmt.Sprintf("sub.%s", managed), srv)
+	assert.True(t, errors.Is(err, ErrAuth), "users cannot add SRV records to managed domains")
+
+	err = mgr.AddSRV("user", "matrix", "_tcp", delegated, srv)
+	assert.Error(t, err, "service label must start with an underscore")
+
+	err = mgr.AddSRV("user", "_matrix", "_tcp", delegated, []RecordSRV{{Port: 70000, Target: "matrix.mydomain.com"}})
+	assert.Error(t, err, "port must be valid")
+
+	err = mgr.RemoveSRV("user2", "_matrix", "_tcp", delegated, srv)
+	assert.True(t, errors.Is(err, ErrAuth))
+
+	err = mgr.RemoveSRV("user", "_matrix", "_tcp", delegated, srv)
+	require.NoError(t, err)
+	assert.Equal(t, "", s.HGet(delegated+".", "_matrix._tcp"), "empty SRV names are removed from the zone")
+}
+
+func TestCAA(t *testing.T) {
+	_, mgr := newTestMgr(t)
+
+	zone := "mydomain.com"
+	caa := []RecordCAA{
+		{Flag: 0, Tag: "issue", Value: "letsencrypt.org", TTL: 3600},
+		{Flag: 0, Tag: "iodef", Value: "mailto:security@mydomain.com", TTL: 3600},
+	}
+
+	err := mgr.AddDomainDelagate("id", "user", zone)
+	require.NoError(t, err)
+
+	err = mgr.AddCAA("user2", zone, caa)
+	assert.True(t, errors.Is(err, ErrAuth), "only the zone owner can add CAA records")
+
+	err = mgr.AddCAA("user", fmt.Sprintf("sub.%s", zone), caa)
+	assert.Error(t, err, "CAA records can only be set on the zone apex")
+
+	err = mgr.AddCAA("user", zone, []RecordCAA{{Tag: "unknown", Value: "letsencrypt.org"}})
+	assert.Error(t, err, "CAA tag must be valid")
+
+	err = mgr.AddCAA("user", zone, caa)
+	require.NoError(t, err)
+
+	zr, err := mgr.getZoneRecords(zone, apex)
+	require.NoError(t, err)
+	assert.Equal(t, []Record{caa[0], caa[1]}, zr.Records[RecordTypeCAA])
+
+	err = mgr.RemoveCAA("user", zone, caa[:1])
+	require.NoError(t, err)
+
+	zr, err = mgr.getZoneRecords(zone, apex)
+	require.NoError(t, err)
+	assert.Equal(t, []Record{caa[1]}, zr.Records[RecordTypeCAA])
+
+	err = mgr.AddDomainDelagate("id", "user", "other.com", caa[0])
+	require.NoError(t, err, "CAA records can be added with the delegation")
+	zr, err = mgr.getZoneRecords("other.com", apex)
+	require.NoError(t, err)
+	assert.Equal(t, []Record{caa[0]}, zr.Records[RecordTypeCAA])
+
+	err = mgr.AddDomainDelagate("id", "user", "invalid.com", RecordCAA{Tag: "unknown", Value: "letsencrypt.org"})
+	assert.Error(t, err, "the domain is not delegated with invalid CAA records")
+	owner, err := mgr.getZoneOwner("invalid.com")
+	require.NoError(t, err)
+	assert.Equal(t, "", owner.Owner)
+}
+
+func TestSubdomainDelegation(t *testing.T) {
+	gwid := "gwid"
+	s, mgr := newTestMgr(t)
+
+	managed := "managed-domain.com"
+	zone := "example.com"
+	domain := fmt.Sprintf("dev.%s", zone)
+	nameservers := []NameServer{
+		{Host: "ns1.dev.example.com", IPs: []net.IP{net.ParseIP("10.1.1.10")}},
+		{Host: "ns.otherprovider.net"},
+	}
+
+	err := mgr.AddDomainDelagate("id", gwid, managed)
+	require.NoError(t, err)
+	err = mgr.AddDomainDelagate("id", "user", zone)
+	require.NoError(t, err)
+
+	err = mgr.AddSubdomainDelegation("user", fmt.Sprintf("dev.%s", managed), nameservers[1:])
+	assert.True(t, errors.Is(err, ErrAuth), "subdomains of managed domains cannot be delegated")
+
+	err = mgr.AddSubdomainDelegation("user2", domain, nameservers)
+	assert.True(t, errors.Is(err, ErrAuth), "only the zone owner can delegate a subdomain")
+
+	err = mgr.AddSubdomainDelegation("user", zone, nameservers)
+	assert.Error(t, err, "the apex of a zone cannot be delegated")
+
+	err = mgr.AddSubdomainDelegation("user", domain, []NameServer{{Host: "ns1.dev.example.com"}})
+	assert.Error(t, err, "nameservers inside the delegated domain requires glue")
+
+	err = mgr.AddSubdomainDelegation("user", domain, []NameServer{{Host: "ns.otherprovider.net", IPs: []net.IP{net.ParseIP("10.1.1.10")}}})
+	assert.Error(t, err, "nameservers outside the delegated domain cannot have glue")
+
+	// a used glue name fails the delegation as a whole, no NS record is written
+	err = mgr.AddSubdomain("user", "ns1.dev.example.com", []net.IP{net.ParseIP("10.1.1.11")}, 0)
+	require.NoError(t, err)
+	err = mgr.AddSubdomainDelegation("user", domain, nameservers)
+	assert.True(t, errors.Is(err, ErrSubdomainUsed), "glue records cannot replace existing records")
+	assert.Equal(t, "", s.HGet(zone+".", "dev"))
+	err = mgr.RemoveSubdomain("user", "ns1.dev.example.com", []net.IP{net.ParseIP("10.1.1.11")})
+	require.NoError(t, err)
+
+	err = mgr.AddSubdomainDelegation("user", domain, nameservers)
+	require.NoError(t, err)
+
+	zr, err := mgr.getZoneRecords(zone, "dev")
+	require.NoError(t, err)
+	assert.Equal(t, []Record{
+		RecordNS{Host: "ns1.dev.example.com", TTL: 3600},
+		RecordNS{Host: "ns.otherprovider.net", TTL: 3600},
+	}, zr.Records[RecordTypeNS])
+
+	glue, err := mgr.getZoneRecords(zone, "ns1.dev")
+	require.NoError(t, err)
+	assert.Equal(t, []Record{RecordA{IP4: "10.1.1.10", TTL: 3600}}, glue.Records[RecordTypeA])
+
+	err = mgr.AddSubdomainDelegation("user", domain, nameservers)
+	assert.True(t, errors.Is(err, ErrSubdomainUsed), "a delegated subdomain must be removed before it is delegated again")
+
+	err = mgr.RemoveSubdomainDelegation("user", domain)
+	require.NoError(t, err)
+
+	assert.Equal(t, "", s.HGet(zone+".", "dev"))
+	assert.Equal(t, "", s.HGet(zone+".", "ns1.dev"))
+}
+
+func TestWildcardSubdomain(t *testing.T) {
+	gwid := "gwid"
+	s, mgr := newTestMgr(t)
+
+	managed := "gateway.tf"
+	delegated := "mydomain.com"
+	ips := []net.IP{
+		net.ParseIP("10.1.1.10"),
+	}
+
+	err := mgr.AddDomainDelagate("id", gwid, managed)
+	require.NoError(t, err)
+	err = mgr.AddDomainDelagate("id", "user", delegated)
+	require.NoError(t, err)
+
+	err = mgr.AddDomainDelagate("id", "user", "*.otherdomain.com")
+	assert.Error(t, err, "wildcard domain cannot be delegated")
+
+	err = mgr.AddSubdomain("user", "*.gateway.tf", ips, 0)
+	assert.True(t, errors.Is(err, ErrAuth), "nobody can create a wildcard on the apex of a managed domain")
+
+	err = mgr.AddSubdomain("user", "*.app.gateway.tf", ips, 0)
+	assert.True(t, errors.Is(err, ErrAuth), "the subdomain must be reserved before its wildcard")
+
+	err = mgr.AddSubdomain("user", "app.gateway.tf", ips, 0)
+	require.NoError(t, err)
+
+	err = mgr.AddSubdomain("user2", "*.app.gateway.tf", ips, 0)
+	assert.True(t, errors.Is(err, ErrAuth), "only the owner of the subdomain can create its wildcard")
+
+	err = mgr.AddSubdomain("user", "*.app.gateway.tf", ips, 0)
+	require.NoError(t, err)
+
+	zr, err := mgr.getZoneRecords(managed, "*.app")
+	require.NoError(t, err)
+	assert.Equal(t, []Record{RecordA{IP4: "10.1.1.10", TTL: 3600}}, zr.Records[RecordTypeA])
+
+	err = mgr.AddSubdomain("user", "*.mydomain.com", ips, 0)
+	require.NoError(t, err)
+
+	zr, err = mgr.getZoneRecords(delegated, "*")
+	require.NoError(t, err)
+	assert.Equal(t, []Record{RecordA{IP4: "10.1.1.10", TTL: 3600}}, zr.Records[RecordTypeA])
+
+	// the subdomain is released but the wildcard is still owned by user
+	err = mgr.RemoveSubdomain("user", "app.gateway.tf", ips)
+	require.NoError(t, err)
+
+	err = mgr.AddSubdomain("user2", "app.gateway.tf", ips, 0)
+	assert.True(t, errors.Is(err, ErrSubdomainUsed), "a subdomain cannot be claimed while someone else owns a wildcard beneath it")
+
+	err = mgr.RemoveSubdomain("user2", "*.app.gateway.tf", ips)
+	assert.True(t, errors.Is(err, ErrAuth))
+
+	err = mgr.RemoveSubdomain("user", "*.app.gateway.tf", ips)
+	require.NoError(t, err)
+	assert.Equal(t, "", s.HGet(managed+".", "*.app"))
+
+	err = mgr.AddSubdomain("user2", "app.gateway.tf", ips, 0)
+	assert.NoError(t, err)
+}
+
+func TestDomainDelegateCascade(t *testing.T) {
+	s, mgr := newTestMgr(t)
+
+	zone := "mydomain.com"
+	ips := []net.IP{
+		net.ParseIP("10.1.1.10"),
+	}
+
+	err := mgr.AddDomainDelagate("id", "user", zone)
+	require.NoError(t, err)
+	err = mgr.AddDomainDelagate("id", "user", "othermydomain.com")
+	require.NoError(t, err)
+
+	for _, domain := range []string{"a.mydomain.com", "b.mydomain.com", "*.mydomain.com", "a.othermydomain.com"} {
+		err = mgr.AddSubdomain("user", domain, ips, 0)
+		require.NoError(t, err)
+	}
+
+	removed, err := mgr.RemoveDomainDelagate("user", zone)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"a.mydomain.com", "b.mydomain.com", "*.mydomain.com"}, removed)
+
+	assert.False(t, s.Exists(zone+"."), "zone records must be removed")
+	owner, err := mgr.getSubdomainOwner("a.othermydomain.com")
+	require.NoError(t, err)
+	assert.Equal(t, "user", owner, "subdomains of other zones are not touched")
+
+	owner, err = mgr.getSubdomainOwner("a.mydomain.com")
+	require.NoError(t, err)
+	assert.Equal(t, "", owner)
+}
+
+func TestZoneIndex(t *testing.T) {
+	s, mgr := newTestMgr(t)
+
+	// zones created before the zone index existed
+	s.HSet("legacy.com.", "www", `{"a":[{"ip":"10.1.1.10","ttl":3600}]}`)
+	s.HSet("legacy.com.", "empty", "{}")
+	s.HSet("other.com.", "@", `{"a":[{"ip":"10.1.1.11","ttl":3600}]}`)
+	require.NoError(t, s.Set("notazone.", "value"))
+	s.HSet("/tcprouter/service/app.legacy.com", "key", "value")
+
+	require.NoError(t, mgr.Cleanup())
+
+	members, err := s.Members(zoneIndexKey)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"legacy.com", "other.com"}, members)
+	assert.True(t, s.Exists(zoneIndexMigratedKey))
+	assert.Equal(t, "", s.HGet("legacy.com.", "empty"), "cleanup removes empty records")
+
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", "mydomain.com"))
+	members, err = s.Members(zoneIndexKey)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"legacy.com", "mydomain.com", "other.com"}, members)
+
+	// once migrated, redis is not scanned anymore
+	s.HSet("unindexed.com.", "empty", "{}")
+	require.NoError(t, mgr.Cleanup())
+	assert.Equal(t, "{}", s.HGet("unindexed.com.", "empty"))
+
+	_, err = mgr.RemoveDomainDelagate("user", "mydomain.com")
+	require.NoError(t, err)
+	members, err = s.Members(zoneIndexKey)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"legacy.com", "other.com"}, members)
+}
+
+func TestZoneApex(t *testing.T) {
+	s, mgr := newTestMgr(t)
+
+	zone := "mydomain.com"
+	require.NoError(t, mgr.AddDomainDelagate("gwid", "user", zone))
+	require.NoError(t, mgr.AddSubdomain("user", zone, []net.IP{net.ParseIP("10.1.1.10")}, 0))
+	require.NoError(t, mgr.AddMX("user", zone, []RecordMX{{Host: "mail.mydomain.com", Preference: 10}}))
+
+	// all the records of the zone itself are stored under the apex
+	zr, err := mgr.getZoneRecords(zone, apex)
+	require.NoError(t, err)
+	assert.Len(t, zr.Records[RecordTypeA], 1)
+	assert.Len(t, zr.Records[RecordTypeMX], 1)
+	assert.Equal(t, "", s.HGet(zone+".", ""))
+
+	// the records stored under an empty name by the former versions are moved to the apex
+	s.HSet(zone+".", "", `{"aaaa":[{"ip":"2a02:2788:864:1314:9eb6:d0ff:fe97:764b","ttl":3600}]}`)
+	require.NoError(t, mgr.Cleanup())
+
+	zr, err = mgr.getZoneRecords(zone, apex)
+	require.NoError(t, err)
+	assert.Len(t, zr.Records[RecordTypeA], 1)
+	assert.Len(t, zr.Records[RecordTypeAAAA], 1)
+	assert.Len(t, zr.Records[RecordTypeMX], 1)
+	assert.Equal(t, "", s.HGet(zone+".", ""))
+
+	require.NoError(t, mgr.RemoveSubdomain("user", zone, []net.IP{net.ParseIP("10.1.1.10")}))
+	zr, err = mgr.getZoneRecords(zone, apex)
+	require.NoError(t, err)
+	assert.NotContains(t, zr.Records, RecordTypeA)
+	assert.Len(t, zr.Records[RecordTypeMX], 1)
+}
+
+func TestAudit(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	log := audit.NewStream(pool)
+	mgr := New(pool, "gwid")
+	mgr.SetAuditRecorder(audit.NewRecorder(log, Describe))
+
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", "mydomain.com"))
+
+	user := mgr.As(audit.Actor{User: "user", Reservation: "12", Operation: "provision subdomain"})
+	ip := net.ParseIP("10.1.1.10")
+	require.NoError(t, user.AddSubdomain("user", "www.mydomain.com", []net.IP{ip}, 0))
+	require.NoError(t, user.RemoveSubdomain("user", "www.mydomain.com", []net.IP{ip}))
+
+	entries, err := log.Query(audit.Filter{Domain: "www.mydomain.com"})
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	objects := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		assert.Equal(t, "user", entry.User)
+		assert.Equal(t, "12", entry.Reservation)
+		assert.Equal(t, "provision subdomain", entry.Operation)
+		objects = append(objects, entry.Object)
+	}
+	assert.ElementsMatch(t, []string{"subdomain owner", "records", "subdomain owner", "records"}, objects)
+
+	for _, entry := range entries {
+		if entry.Object == "records" && entry.After != "" {
+			assert.Contains(t, entry.After, "10.1.1.10")
+			assert.Empty(t, entry.Before)
+		}
+	}
+
+	_, err = mgr.RemoveDomainDelagate("user", "mydomain.com")
+	require.NoError(t, err)
+
+	entries, err = log.Query(audit.Filter{Domain: "mydomain.com"})
+	require.NoError(t, err)
+	last := entries[len(entries)-2:]
+	assert.Equal(t, "records", last[0].Object)
+	assert.Equal(t, "__owner__.mydomain.com", last[0].Domain)
+	assert.Equal(t, "zone owner", last[1].Object)
+	assert.Equal(t, `{"Owner":"user"}`, last[1].Before)
+	assert.Empty(t, last[1].After)
+}
@@ -11,6 +11,11 @@ var (
 	RecordTypeAAAA  = RecordType("aaaa")
 	RecordTypeCNAME = RecordType("cname")
 	RecordTypeTXT   = RecordType("txt")
+	RecordTypeMX    = RecordType("mx")
+	RecordTypeSRV   = RecordType("srv")
+	RecordTypeCAA   = RecordType("caa")
+	RecordTypeNS    = RecordType("ns")
+	RecordTypePTR   = RecordType("ptr")
 )
 
 // Record define the interface to be a DNS record
@@ -22,6 +27,9 @@ type Record interface {
 type RecordA struct {
 	IP4 string `json:"ip"`
 	TTL int    `json:"ttl"`
+	// Weight and Region steer the clients of the built-in DNS server, see Target
+	Weight int    `json:"weight,omitempty"`
+	Region string `json:"region,omitempty"`
 }
 
 // Type implements Record interface
@@ -33,6 +41,9 @@ func (r RecordA) Type() RecordType {
 type RecordAAAA struct {
 	IP6 string `json:"ip"`
 	TTL int    `json:"ttl"`
+	// Weight and Region steer the clients of the built-in DNS server, see Target
+	Weight int    `json:"weight,omitempty"`
+	Region string `json:"region,omitempty"`
 }
 
 // Type implements Record interface
@@ -62,21 +73,91 @@ func (r RecordTXT) Type() RecordType {
 	return RecordTypeTXT
 }
 
+// RecordMX is a type MX DNS record
+type RecordMX struct {
+	Host       string `json:"host"`
+	Preference int    `json:"preference"`
+	TTL        int    `json:"ttl"`
+}
+
+// Type implements Record interface
+func (r RecordMX) Type() RecordType {
+	return RecordTypeMX
+}
+
+// RecordSRV is a type SRV DNS record
+type RecordSRV struct {
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Port     int    `json:"port"`
+	Target   string `json:"target"`
+	TTL      int    `json:"ttl"`
+}
+
+// Type implements Record interface
+func (r RecordSRV) Type() RecordType {
+	return RecordTypeSRV
+}
+
+// RecordCAA is a type CAA DNS record
+type RecordCAA struct {
+	Flag  int    `json:"flag"`
+	Tag   string `json:"tag"`
+	Value string `json:"value"`
+	TTL   int    `json:"ttl"`
+}
+
+// Type implements Record interface
+func (r RecordCAA) Type() RecordType {
+	return RecordTypeCAA
+}
+
+// RecordNS is a type NS DNS record
+type RecordNS struct {
+	Host string `json:"host"`
+	TTL  int    `json:"ttl"`
+}
+
+// Type implements Record interface
+func (r RecordNS) Type() RecordType {
+	return RecordTypeNS
+}
+
+// RecordPTR is a type PTR DNS record
+type RecordPTR struct {
+	Host string `json:"host"`
+	TTL  int    `json:"ttl"`
+}
+
+// Type implements Record interface
+func (r RecordPTR) Type() RecordType {
+	return RecordTypePTR
+}
+
 // Zone is a DNS zone. It hosts multiple records and belong to a owner
 type Zone struct {
 	Records records
 }
 
-// Add adds a record to the zone
+// Add adds a record to the zone. If the record is already in the
+// zone with another TTL or weight and region, they are updated
 func (z *Zone) Add(r Record) {
 	if z.Records == nil {
 		z.Records = records{}
 	}
 
+	for i, record := range z.Records[r.Type()] {
+		if recordKey(record) == recordKey(r) {
+			z.Records[r.Type()][i] = r
+			return
+		}
+	}
+
 	z.Records[r.Type()] = append(z.Records[r.Type()], r)
 }
 
-// Remove removes a record from the zone
+// Remove removes a record from the zone, the TTL, weight
+// and region of the records are ignored
 func (z *Zone) Remove(r Record) {
 	if z.Records == nil {
 		z.Records = records{}
@@ -89,7 +170,7 @@ func (z *Zone) Remove(r Record) {
 
 	newrecords := records[:0]
 	for _, record := range records {
-		if record != r {
+		if recordKey(record) != recordKey(r) {
 			newrecords = append(newrecords, record)
 		}
 	}
@@ -102,6 +183,73 @@ func (z *Zone) Remove(r Record) {
 	}
 }
 
+// checkCNAME makes sure that if the zone has a CNAME record,
+// it is the only record of the zone
+func (z *Zone) checkCNAME() error {
+	cnames := z.Records[RecordTypeCNAME]
+	if len(cnames) == 0 {
+		return nil
+	}
+
+	if len(cnames) > 1 || len(z.Records) > 1 {
+		return ErrCNAMEConflict
+	}
+	return nil
+}
+
+// recordKey returns a copy of r with its TTL, weight and region
+// unset, so records can be compared regardless of them
+func recordKey(r Record) Record {
+	switch r := r.(type) {
+	case RecordA:
+		r.TTL, r.Weight, r.Region = 0, 0, ""
+		return r
+	case RecordAAAA:
+		r.TTL, r.Weight, r.Region = 0, 0, ""
+		return r
+	case RecordCname:
+		r.TTL = 0
+		return r
+	case RecordTXT:
+		r.TTL = 0
+		return r
+	case RecordMX:
+		r.TTL = 0
+		return r
+	case RecordSRV:
+		r.TTL = 0
+		return r
+	case RecordCAA:
+		r.TTL = 0
+		return r
+	case RecordNS:
+		r.TTL = 0
+		return r
+	case RecordPTR:
+		r.TTL = 0
+		return r
+	}
+	return r
+}
+
+// recordUnknown is a record of a type the gateway does not handle, such as
+// the SOA records of the coredns redis plugin. It is kept as it is, so it is
+// not lost when the other records of its name change, but it is never answered
+type recordUnknown struct {
+	typ RecordType
+	raw string
+}
+
+// Type implements Record interface
+func (r recordUnknown) Type() RecordType {
+	return r.typ
+}
+
+// MarshalJSON implements encoding/json.Marshaler interface
+func (r recordUnknown) MarshalJSON() ([]byte, error) {
+	return []byte(r.raw), nil
+}
+
 type records map[RecordType][]Record
 
 func (rs records) IsEmpty() bool {
@@ -152,6 +300,38 @@ func (rs records) UnmarshalJSON(b []byte) error {
 					return err
 				}
 				r = x
+			case RecordTypeMX:
+				x := RecordMX{}
+				if err := json.Unmarshal(b, &x); err != nil {
+					return err
+				}
+				r = x
+			case RecordTypeSRV:
+				x := RecordSRV{}
+				if err := json.Unmarshal(b, &x); err != nil {
+					return err
+				}
+				r = x
+			case RecordTypeCAA:
+				x := RecordCAA{}
+				if err := json.Unmarshal(b, &x); err != nil {
+					return err
+				}
+				r = x
+			case RecordTypeNS:
+				x := RecordNS{}
+				if err := json.Unmarshal(b, &x); err != nil {
+					return err
+				}
+				r = x
+			case RecordTypePTR:
+				x := RecordPTR{}
+				if err := json.Unmarshal(b, &x); err != nil {
+					return err
+				}
+				r = x
+			default:
+				r = recordUnknown{typ: typ, raw: string(b)}
 			}
 
 			rs[typ] = append(rs[typ], r)
@@ -163,4 +343,7 @@ func (rs records) UnmarshalJSON(b []byte) error {
 // ZoneOwner contains the ThreebotID linked to a delagated zone
 type ZoneOwner struct {
 	Owner string //threebot ID owning this zone
+	// Reverse is set for the reverse zones added with AddReverseZone,
+	// their records are only managed by the gateway with AddPTR
+	Reverse bool `json:",omitempty"`
 }
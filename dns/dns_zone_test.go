@@ -1,9 +1,11 @@
 package dns
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestZone(t *testing.T) {
@@ -56,4 +58,18 @@ func TestZone(t *testing.T) {
 	assert.Equal(t, 1, len(z.Records[RecordTypeTXT]))
 	z.Remove(b)
 	assert.Equal(t, 2, len(z.Records[RecordTypeA]))
+
+	// the TTL is not used to match the records to remove
+	z.Remove(RecordA{IP4: c.IP4, TTL: 60})
+	assert.Equal(t, []Record{a}, z.Records[RecordTypeA])
+}
+
+func TestLoadRecordMX(t *testing.T) {
+	rs := records{}
+	err := json.Unmarshal([]byte(`{"mx":[{"host":"mail.example.com.","preference":10,"ttl":300}]}`), &rs)
+	require.NoError(t, err)
+
+	assert.Equal(t, []Record{
+		RecordMX{Host: "mail.example.com.", Preference: 10, TTL: 300},
+	}, rs[RecordTypeMX])
 }
@@ -0,0 +1,138 @@
+package dns
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// dnskeyTTL is the TTL of the DNSKEY and DS records
+	dnskeyTTL = 3600
+	// signatureValidity is how long a signature produced by the Signer is valid
+	signatureValidity = 7 * 24 * time.Hour
+)
+
+// Signer signs the zones served by the gateway with DNSSEC. Each zone uses
+// its own ed25519 key, derived from the gateway identity seed and the zone
+// name, so keys never need to be stored and survive restarts
+type Signer struct {
+	seed []byte
+}
+
+// NewSigner creates a signer that derive the zone keys from seed.
+// seed is usually the seed of the gateway identity keypair
+func NewSigner(seed []byte) *Signer {
+	return &Signer{seed: seed}
+}
+
+// key returns the DNSKEY record and the private key of zone
+func (s *Signer) key(zone string) (*mdns.DNSKEY, ed25519.PrivateKey) {
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+
+	h := sha256.New()
+	h.Write(s.seed)
+	h.Write([]byte("dnssec:" + zone))
+	priv := ed25519.NewKeyFromSeed(h.Sum(nil))
+
+	key := &mdns.DNSKEY{
+		Hdr:       header(mdns.Fqdn(zone), mdns.TypeDNSKEY, dnskeyTTL),
+		Flags:     mdns.ZONE | mdns.SEP,
+		Protocol:  3,
+		Algorithm: mdns.ED25519,
+		PublicKey: base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)),
+	}
+
+	return key, priv
+}
+
+// DNSKEY returns the DNSKEY record of zone
+func (s *Signer) DNSKEY(zone string) *mdns.DNSKEY {
+	key, _ := s.key(zone)
+	return key
+}
+
+// DS returns the DS record the owner of zone needs to install at its registrar
+func (s *Signer) DS(zone string) *mdns.DS {
+	key, _ := s.key(zone)
+	return key.ToDS(mdns.SHA256)
+}
+
+// Sign signs each RRset of rrs with the key of zone and
+// returns the RRSIG records
+func (s *Signer) Sign(zone string, rrs []mdns.RR) ([]mdns.RR, error) {
+	key, priv := s.key(zone)
+	now := time.Now()
+
+	var sigs []mdns.RR
+	for _, rrset := range rrsets(rrs) {
+		sig := &mdns.RRSIG{
+			Hdr:        header(rrset[0].Header().Name, mdns.TypeRRSIG, int(rrset[0].Header().Ttl)),
+			Algorithm:  key.Algorithm,
+			SignerName: key.Hdr.Name,
+			KeyTag:     key.KeyTag(),
+			Inception:  uint32(now.Add(-time.Hour).Unix()),
+			Expiration: uint32(now.Add(signatureValidity).Unix()),
+		}
+
+		if err := sig.Sign(priv, rrset); err != nil {
+			return nil, errors.Wrapf(err, "failed to sign %s %s", rrset[0].Header().Name, mdns.TypeToString[rrset[0].Header().Rrtype])
+		}
+		sigs = append(sigs, sig)
+	}
+
+	return sigs, nil
+}
+
+// rrsets groups rrs by name and type, keeping the order of appearance
+func rrsets(rrs []mdns.RR) [][]mdns.RR {
+	var (
+		sets  [][]mdns.RR
+		index = make(map[string]int)
+	)
+
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == mdns.TypeRRSIG {
+			continue
+		}
+
+		k := strings.ToLower(rr.Header().Name) + "/" + mdns.TypeToString[rr.Header().Rrtype]
+		i, ok := index[k]
+		if !ok {
+			i = len(sets)
+			index[k] = i
+			sets = append(sets, nil)
+		}
+		sets[i] = append(sets[i], rr)
+	}
+
+	return sets
+}
+
+// nsec creates a NSEC record for name that covers only name itself, listing
+// the types present at name. This allows to prove the absence of a type
+// or a name without having to walk the whole zone (a.k.a "black lies")
+func nsec(name string, ttl int, types []uint16) *mdns.NSEC {
+	types = append(types, mdns.TypeRRSIG, mdns.TypeNSEC)
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	bitmap := types[:0]
+	for i, t := range types {
+		if i > 0 && t == types[i-1] {
+			continue
+		}
+		bitmap = append(bitmap, t)
+	}
+
+	return &mdns.NSEC{
+		Hdr:        header(name, mdns.TypeNSEC, ttl),
+		NextDomain: `\000.` + name,
+		TypeBitMap: bitmap,
+	}
+}
@@ -0,0 +1,106 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignerKeys(t *testing.T) {
+	signer := NewSigner([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+
+	key := signer.DNSKEY("mydomain.com")
+	assert.Equal(t, key, signer.DNSKEY("mydomain.com."), "keys are derived from the zone name")
+	assert.NotEqual(t, key.PublicKey, signer.DNSKEY("otherdomain.com").PublicKey, "each zone has its own key")
+
+	other := NewSigner([]byte("bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"))
+	assert.NotEqual(t, key.PublicKey, other.DNSKEY("mydomain.com").PublicKey, "keys are derived from the seed")
+
+	ds := signer.DS("mydomain.com")
+	assert.Equal(t, key.KeyTag(), ds.KeyTag)
+	assert.Equal(t, uint8(mdns.ED25519), ds.Algorithm)
+	assert.Equal(t, uint8(mdns.SHA256), ds.DigestType)
+}
+
+func TestServerDNSSEC(t *testing.T) {
+	_, mgr := newTestMgr(t)
+	zone := "mydomain.com"
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", zone))
+	require.NoError(t, mgr.AddSubdomain("user", "www.mydomain.com", []net.IP{net.ParseIP("10.1.1.10")}, 0))
+
+	signer := NewSigner([]byte("aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"))
+	udp, _ := startServer(t, NewServer(mgr, []string{"ns1.gateway.tf"}, signer))
+
+	query := func(t *testing.T, name string, qtype uint16, do bool) *mdns.Msg {
+		m := new(mdns.Msg)
+		m.SetQuestion(mdns.Fqdn(name), qtype)
+		m.SetEdns0(4096, do)
+
+		resp, _, err := new(mdns.Client).Exchange(m, udp)
+		require.NoError(t, err)
+		return resp
+	}
+
+	key := signer.DNSKEY(zone)
+	verify := func(t *testing.T, rrs []mdns.RR) {
+		var sigs []*mdns.RRSIG
+		for _, rr := range rrs {
+			if sig, ok := rr.(*mdns.RRSIG); ok {
+				sigs = append(sigs, sig)
+			}
+		}
+
+		sets := rrsets(rrs)
+		require.Len(t, sigs, len(sets), "every RRset must be signed")
+		for i, set := range sets {
+			assert.NoError(t, sigs[i].Verify(key, set))
+			assert.True(t, sigs[i].ValidityPeriod(time.Now()))
+		}
+	}
+
+	t.Run("DNSKEY", func(t *testing.T) {
+		resp := query(t, zone, mdns.TypeDNSKEY, true)
+		require.Len(t, resp.Answer, 2)
+		assert.Equal(t, key.PublicKey, resp.Answer[0].(*mdns.DNSKEY).PublicKey)
+		verify(t, resp.Answer)
+	})
+
+	t.Run("signed answer", func(t *testing.T) {
+		resp := query(t, "www.mydomain.com", mdns.TypeA, true)
+		require.Len(t, resp.Answer, 2)
+		verify(t, resp.Answer)
+	})
+
+	t.Run("unsigned without DO", func(t *testing.T) {
+		resp := query(t, "www.mydomain.com", mdns.TypeA, false)
+		require.Len(t, resp.Answer, 1)
+	})
+
+	t.Run("NODATA", func(t *testing.T) {
+		resp := query(t, "www.mydomain.com", mdns.TypeAAAA, true)
+		assert.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 0)
+		verify(t, resp.Ns)
+
+		var nsec *mdns.NSEC
+		for _, rr := range resp.Ns {
+			if rr, ok := rr.(*mdns.NSEC); ok {
+				nsec = rr
+			}
+		}
+		require.NotNil(t, nsec)
+		assert.Contains(t, nsec.TypeBitMap, mdns.TypeA)
+		assert.NotContains(t, nsec.TypeBitMap, mdns.TypeAAAA)
+	})
+
+	t.Run("non existing name", func(t *testing.T) {
+		resp := query(t, "nothere.mydomain.com", mdns.TypeA, true)
+		assert.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 0)
+		verify(t, resp.Ns)
+	})
+}
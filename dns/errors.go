@@ -8,4 +8,19 @@ var (
 	ErrAuth = errors.New("unauthorized error")
 	// ErrSubdomainUsed returned if the subdomain is already reserved
 	ErrSubdomainUsed = errors.New("subdomain already reserved")
+	// ErrDelegationNotVerified is returned when a user cannot prove he controls
+	// the domain he tries to delegate to the gateway
+	ErrDelegationNotVerified = errors.New("domain delegation not verified")
+	// ErrCNAMEConflict is returned when a CNAME record would
+	// exist together with other records at the same name
+	ErrCNAMEConflict = errors.New("a CNAME record cannot coexist with other records")
+	// ErrConflict is returned when a change could not be applied because
+	// the same records kept being modified concurrently
+	ErrConflict = errors.New("too many concurrent modifications")
+	// ErrNoReverseZone is returned when a PTR record is added for an
+	// address outside of the reverse zones managed by the gateway
+	ErrNoReverseZone = errors.New("reverse zone not managed by the gateway")
+	// ErrPTRConflict is returned when a PTR record is added for an address
+	// whose PTR already points to another host for other peers
+	ErrPTRConflict = errors.New("the PTR of the address points to another host")
 )
@@ -0,0 +1,114 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GeoIP finds the region of the clients of the DNS server, so they can be
+// answered with the records of their region. See Server.SetGeoIP
+type GeoIP interface {
+	// Region returns the region of ip, or an empty string if it is unknown
+	Region(ip net.IP) string
+}
+
+// GeoIPDatabase is a GeoIP backed by a local file. Each line of the file
+// is a network in CIDR notation followed by its region, separated by spaces
+// or a comma. Empty lines and lines starting with # are ignored.
+// The most specific network that contains an IP gives its region
+type GeoIPDatabase struct {
+	v4 networks
+	v6 networks
+}
+
+// networks indexes the regions of networks by prefix length and network address
+type networks struct {
+	// lengths are the prefix lengths in use, longest first
+	lengths []int
+	regions map[int]map[string]string
+}
+
+func (n *networks) add(network *net.IPNet, region string) {
+	if n.regions == nil {
+		n.regions = make(map[int]map[string]string)
+	}
+
+	ones, _ := network.Mask.Size()
+	if _, ok := n.regions[ones]; !ok {
+		n.regions[ones] = make(map[string]string)
+		n.lengths = append(n.lengths, ones)
+		sort.Sort(sort.Reverse(sort.IntSlice(n.lengths)))
+	}
+
+	n.regions[ones][string(network.IP)] = region
+}
+
+func (n *networks) lookup(ip net.IP) string {
+	for _, ones := range n.lengths {
+		network := ip.Mask(net.CIDRMask(ones, len(ip)*8))
+		if region, ok := n.regions[ones][string(network)]; ok {
+			return region
+		}
+	}
+	return ""
+}
+
+// LoadGeoIPDatabase loads a GeoIPDatabase from the file at path
+func LoadGeoIPDatabase(path string) (*GeoIPDatabase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open geoip database %s", path)
+	}
+	defer f.Close()
+
+	db := &GeoIPDatabase{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a network and a region", path, n)
+		}
+
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid network '%s'", path, n, fields[0])
+		}
+
+		if ip4 := network.IP.To4(); ip4 != nil {
+			network.IP = ip4
+			db.v4.add(network, fields[1])
+		} else {
+			db.v6.add(network, fields[1])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read geoip database %s", path)
+	}
+
+	return db, nil
+}
+
+// Region implements GeoIP
+func (db *GeoIPDatabase) Region(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return db.v4.lookup(ip4)
+	}
+	if ip6 := ip.To16(); ip6 != nil {
+		return db.v6.lookup(ip6)
+	}
+	return ""
+}
@@ -0,0 +1,477 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// healthChecksKey is the redis hash holding the health check of the subdomains
+	healthChecksKey = "tfgateway_health_checks"
+	// unhealthyRecordsKey is the redis hash holding the A and AAAA records
+	// pulled out of the zone of a subdomain because their backend is unhealthy
+	unhealthyRecordsKey = "tfgateway_unhealthy_records"
+)
+
+// Health check protocols
+const (
+	HealthCheckTCP  = "tcp"
+	HealthCheckHTTP = "http"
+)
+
+const (
+	defaultHealthCheckInterval  = 10
+	defaultHealthCheckThreshold = 3
+	// minHealthCheckInterval is the shortest interval between two checks
+	minHealthCheckInterval = 5
+	// defaultMaxHealthChecks is how many health checks a user can set
+	defaultMaxHealthChecks = 20
+)
+
+// privateNetworks are the networks the health checks never probe, so the
+// users cannot make the gateway reach its own host or its private networks
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"100::/64",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// publicIP returns true if ip can be probed by the health checks
+func publicIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// HealthCheck defines how the backends of a subdomain are checked.
+// A backend is pulled out of the zone once Threshold checks in a row failed,
+// and is put back once Threshold checks in a row succeeded
+type HealthCheck struct {
+	// Protocol is either tcp, to open a connection to the backend,
+	// or http, to send a GET request that must succeed with a 2xx or 3xx status
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	// Path of the http request
+	Path string `json:"path,omitempty"`
+	// Interval between two checks in seconds, 10 if not set and at least 5
+	Interval int `json:"interval,omitempty"`
+	// Timeout of a check in seconds, it must be below the interval
+	// and at most 5. If not set, it is half the interval up to 5
+	Timeout int `json:"timeout,omitempty"`
+	// Threshold is 3 if not set
+	Threshold int `json:"threshold,omitempty"`
+}
+
+// Valid checks the health check is well defined
+func (h HealthCheck) Valid() error {
+	if h.Protocol != HealthCheckTCP && h.Protocol != HealthCheckHTTP {
+		return fmt.Errorf("unsupported health check protocol '%s'", h.Protocol)
+	}
+
+	if h.Port <= 0 || h.Port > 65535 {
+		return fmt.Errorf("invalid health check port %d", h.Port)
+	}
+
+	if h.Path != "" && !strings.HasPrefix(h.Path, "/") {
+		return fmt.Errorf("health check path '%s' must start with /", h.Path)
+	}
+
+	if h.Interval < 0 || h.Threshold < 0 || h.Timeout < 0 {
+		return fmt.Errorf("health check interval, timeout and threshold cannot be negative")
+	}
+
+	if h.Interval != 0 && h.Interval < minHealthCheckInterval {
+		return fmt.Errorf("health check interval %d is below the minimum of %d seconds", h.Interval, minHealthCheckInterval)
+	}
+
+	if h.timeout() >= h.interval() {
+		return fmt.Errorf("health check timeout %d must be below the interval of %d seconds", h.Timeout, h.interval()/time.Second)
+	}
+
+	if h.timeout() > maxProbeTimeout {
+		return fmt.Errorf("health check timeout %d is above the maximum of %d seconds", h.Timeout, maxProbeTimeout/time.Second)
+	}
+
+	return nil
+}
+
+func (h HealthCheck) interval() time.Duration {
+	if h.Interval == 0 {
+		return defaultHealthCheckInterval * time.Second
+	}
+	return time.Duration(h.Interval) * time.Second
+}
+
+func (h HealthCheck) timeout() time.Duration {
+	if h.Timeout != 0 {
+		return time.Duration(h.Timeout) * time.Second
+	}
+
+	timeout := h.interval() / 2
+	if timeout > maxProbeTimeout {
+		timeout = maxProbeTimeout
+	}
+	return timeout
+}
+
+func (h HealthCheck) threshold() int {
+	if h.Threshold == 0 {
+		return defaultHealthCheckThreshold
+	}
+	return h.Threshold
+}
+
+// SetMaxHealthChecks sets how many health checks a user can set,
+// 0 means the default of 20
+func (c *Mgr) SetMaxHealthChecks(max int) error {
+	if max < 0 {
+		return fmt.Errorf("invalid maximum number of health checks %d", max)
+	}
+
+	c.maxHealthChecks = max
+	return nil
+}
+
+// SetHealthCheck enables the health check of the backends of a subdomain
+// added with AddSubdomain. The same ownership rules as AddMX apply.
+// Only the public IPs of the subdomain are probed, so all its backends
+// must be public, and a user can only set a limited number of health checks
+func (c *Mgr) SetHealthCheck(user, domain string, check HealthCheck) error {
+	log.Info().Msgf("set health check of %s %+v", domain, check)
+
+	if err := check.Valid(); err != nil {
+		return err
+	}
+
+	if _, _, err := c.authorizeRecords(user, strings.TrimPrefix(domain, WildcardPrefix)); err != nil {
+		return err
+	}
+
+	backends, err := c.Backends(domain)
+	if err != nil {
+		return err
+	}
+
+	for ip := range backends {
+		if !c.probePrivate && !publicIP(net.ParseIP(ip)) {
+			return fmt.Errorf("cannot check the health of %s, backend %s is not a public IP", domain, ip)
+		}
+	}
+
+	b, err := json.Marshal(check)
+	if err != nil {
+		return err
+	}
+
+	return c.atomic(func(r *Mgr, t *tx) error {
+		checks, err := r.HealthChecks()
+		if err != nil {
+			return err
+		}
+
+		if _, ok := checks[domain]; !ok {
+			count := 0
+			for name := range checks {
+				if _, _, err := r.authorizeRecords(user, strings.TrimPrefix(name, WildcardPrefix)); err == nil {
+					count++
+				}
+			}
+
+			if max := c.healthChecksLimit(); count >= max {
+				return fmt.Errorf("cannot check the health of %s, the limit of %d health checks is reached", domain, max)
+			}
+		}
+
+		t.send("HSET", healthChecksKey, domain, b)
+		return nil
+	}, healthChecksKey)
+}
+
+func (c *Mgr) healthChecksLimit() int {
+	if c.maxHealthChecks == 0 {
+		return defaultMaxHealthChecks
+	}
+	return c.maxHealthChecks
+}
+
+// RemoveHealthCheck disables the health check of a subdomain
+// and publishes again the backends pulled out of its zone
+func (c *Mgr) RemoveHealthCheck(user, domain string) error {
+	name, zone, err := c.authorizeRecords(user, strings.TrimPrefix(domain, WildcardPrefix))
+	if err != nil {
+		return err
+	}
+	name = recordsName(domain, name)
+
+	return c.atomic(func(r *Mgr, t *tx) error {
+		unhealthy, err := r.getUnhealthyRecords(domain)
+		if err != nil {
+			return err
+		}
+
+		t.deleteHealthCheck(domain)
+		if unhealthy.Records.IsEmpty() {
+			return nil
+		}
+
+		zr, err := r.getZoneRecords(zone, name)
+		if err != nil {
+			return err
+		}
+
+		for _, records := range unhealthy.Records {
+			for _, record := range records {
+				zr.Add(record)
+			}
+		}
+
+		return t.setZoneRecords(zone, name, zr)
+	}, zoneKey(zone), healthChecksKey, unhealthyRecordsKey)
+}
+
+// HealthChecks returns the health checks of all the subdomains
+func (c *Mgr) HealthChecks() (map[string]HealthCheck, error) {
+	con := c.redis.Get()
+	defer con.Close()
+
+	values, err := redis.StringMap(con.Do("HGETALL", healthChecksKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list health checks")
+	}
+
+	checks := make(map[string]HealthCheck, len(values))
+	for domain, value := range values {
+		var check HealthCheck
+		if err := json.Unmarshal([]byte(value), &check); err != nil {
+			log.Error().Err(err).Str("domain", domain).Msg("invalid health check")
+			continue
+		}
+		checks[domain] = check
+	}
+
+	return checks, nil
+}
+
+// Backends returns the IPs of the A and AAAA records of domain, whether
+// they are published or not. The value is true for the published IPs
+func (c *Mgr) Backends(domain string) (map[string]bool, error) {
+	name, zone, _, err := c.locateDomain(strings.TrimPrefix(domain, WildcardPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := c.getZoneRecords(zone, recordsName(domain, name))
+	if err != nil {
+		return nil, err
+	}
+
+	unhealthy, err := c.getUnhealthyRecords(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	backends := make(map[string]bool)
+	for _, published := range []bool{false, true} {
+		z := unhealthy
+		if published {
+			z = zr
+		}
+
+		for _, record := range append(z.Records[RecordTypeA], z.Records[RecordTypeAAAA]...) {
+			backends[recordIP(record)] = published
+		}
+	}
+
+	return backends, nil
+}
+
+// SetBackendHealth pulls the record of ip out of the zone of domain if the
+// backend is not healthy, or publishes it again if it is. The last record of
+// its type is never pulled out, it returns false if the record was left untouched
+func (c *Mgr) SetBackendHealth(domain string, ip net.IP, healthy bool) (bool, error) {
+	name, zone, _, err := c.locateDomain(strings.TrimPrefix(domain, WildcardPrefix))
+	if err != nil {
+		return false, err
+	}
+	name = recordsName(domain, name)
+
+	changed := false
+	err = c.atomic(func(r *Mgr, t *tx) error {
+		changed = false
+
+		zr, err := r.getZoneRecords(zone, name)
+		if err != nil {
+			return err
+		}
+
+		unhealthy, err := r.getUnhealthyRecords(domain)
+		if err != nil {
+			return err
+		}
+
+		from, to := &zr, &unhealthy
+		if healthy {
+			from, to = to, from
+		}
+
+		record, ok := takeRecord(from, recordFromIP(ip, 0))
+		if !ok {
+			return nil
+		}
+
+		if !healthy && len(zr.Records[record.Type()]) == 0 {
+			// never publish an empty record set, a client is
+			// better served by an unhealthy backend than by nothing
+			return nil
+		}
+
+		to.Add(record)
+		if err := t.setZoneRecords(zone, name, zr); err != nil {
+			return err
+		}
+
+		changed = true
+		return t.setUnhealthyRecords(domain, unhealthy)
+	}, zoneKey(zone), unhealthyRecordsKey)
+
+	return changed, err
+}
+
+func (c *Mgr) getUnhealthyRecords(domain string) (Zone, error) {
+	con := c.redis.Get()
+	defer con.Close()
+
+	zr := Zone{Records: records{}}
+	data, err := redis.Bytes(con.Do("HGET", unhealthyRecordsKey, domain))
+	if errors.Is(err, redis.ErrNil) {
+		return zr, nil
+	} else if err != nil {
+		return zr, errors.Wrapf(err, "failed to read unhealthy records of %s", domain)
+	}
+
+	if err := json.Unmarshal(data, &zr.Records); err != nil {
+		return zr, err
+	}
+
+	return zr, nil
+}
+
+func (t *tx) setUnhealthyRecords(domain string, zr Zone) error {
+	if zr.Records.IsEmpty() {
+		t.send("HDEL", unhealthyRecordsKey, domain)
+		return nil
+	}
+
+	b, err := json.Marshal(zr.Records)
+	if err != nil {
+		return err
+	}
+
+	t.send("HSET", unhealthyRecordsKey, domain, b)
+	return nil
+}
+
+func (t *tx) deleteHealthCheck(domain string) {
+	t.send("HDEL", healthChecksKey, domain)
+	t.send("HDEL", unhealthyRecordsKey, domain)
+}
+
+// removeUnhealthyRecords removes records from the records of domain pulled out
+// of zr. If zr is left without records while some are pulled out, they are
+// published again. Once domain has no records left, its health check is removed
+func (c *Mgr) removeUnhealthyRecords(t *tx, domain string, zr *Zone, records []Record) error {
+	unhealthy, err := c.getUnhealthyRecords(domain)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		unhealthy.Remove(record)
+	}
+
+	if zr.Records.IsEmpty() {
+		for _, records := range unhealthy.Records {
+			for _, record := range records {
+				zr.Add(record)
+			}
+		}
+		unhealthy = Zone{}
+	}
+
+	if zr.Records.IsEmpty() {
+		t.deleteHealthCheck(domain)
+		return nil
+	}
+
+	return t.setUnhealthyRecords(domain, unhealthy)
+}
+
+// recordsName returns the name under which the records of domain are stored
+// from the name of domain in its zone, with the wildcard prefix removed
+func recordsName(domain, name string) string {
+	if IsWildcard(domain) {
+		return wildcardName(name)
+	}
+	return name
+}
+
+// takeRecord removes the record equal to r, ignoring the TTL, weight and region, from z and returns it
+func takeRecord(z *Zone, r Record) (Record, bool) {
+	for _, record := range z.Records[r.Type()] {
+		if recordKey(record) == recordKey(r) {
+			z.Remove(record)
+			return record, true
+		}
+	}
+	return nil, false
+}
+
+func recordIP(r Record) string {
+	switch r := r.(type) {
+	case RecordA:
+		return r.IP4
+	case RecordAAAA:
+		return r.IP6
+	}
+	return ""
+}
@@ -0,0 +1,222 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// maxProbeTimeout is the longest a single probe of a backend can take
+const maxProbeTimeout = 5 * time.Second
+
+// backendState is the result of the last checks of a backend
+type backendState struct {
+	healthy bool
+	// successes and failures count the checks in a row with the same result
+	successes int
+	failures  int
+	// refused is set when the backend could not be pulled out because it is
+	// the last one, so it is only reported once
+	refused bool
+}
+
+// HealthChecker checks the backends of the subdomains with a health check
+// and pulls the unhealthy ones out of the zones, see Mgr.SetHealthCheck
+type HealthChecker struct {
+	mgr    *Mgr
+	client *http.Client
+
+	backends map[string]map[string]*backendState
+	next     map[string]time.Time
+}
+
+// NewHealthChecker creates a HealthChecker
+func NewHealthChecker(mgr *Mgr) *HealthChecker {
+	return &HealthChecker{
+		mgr: mgr,
+		client: &http.Client{
+			// a redirect is enough to know the backend is up
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		backends: make(map[string]map[string]*backendState),
+		next:     make(map[string]time.Time),
+	}
+}
+
+// Run checks the backends when their health check is due until ctx is done
+func (h *HealthChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := h.checkDue(ctx, now); err != nil {
+				log.Error().Err(err).Msg("failed to run health checks")
+			}
+		}
+	}
+}
+
+func (h *HealthChecker) checkDue(ctx context.Context, now time.Time) error {
+	checks, err := h.mgr.HealthChecks()
+	if err != nil {
+		return err
+	}
+
+	for domain := range h.next {
+		if _, ok := checks[domain]; !ok {
+			delete(h.next, domain)
+			delete(h.backends, domain)
+		}
+	}
+
+	for domain, check := range checks {
+		if now.Before(h.next[domain]) {
+			continue
+		}
+		h.next[domain] = now.Add(check.interval())
+
+		if err := h.Check(ctx, domain, check); err != nil {
+			log.Error().Err(err).Str("domain", domain).Msg("failed to check backends")
+		}
+	}
+
+	return nil
+}
+
+// Check probes all the backends of domain once and updates the zone
+// of domain if a backend reached the threshold of its health check
+func (h *HealthChecker) Check(ctx context.Context, domain string, check HealthCheck) error {
+	backends, err := h.mgr.Backends(domain)
+	if err != nil {
+		return err
+	}
+
+	states, ok := h.backends[domain]
+	if !ok {
+		states = make(map[string]*backendState)
+		h.backends[domain] = states
+	}
+
+	for ip := range states {
+		if _, ok := backends[ip]; !ok {
+			delete(states, ip)
+		}
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		probes = make(map[string]error, len(backends))
+	)
+	for ip := range backends {
+		if !h.mgr.probePrivate && !publicIP(net.ParseIP(ip)) {
+			// the backends can change after the health check is set
+			log.Debug().Str("domain", domain).Str("ip", ip).Msg("private backend not checked")
+			delete(backends, ip)
+			continue
+		}
+
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			err := h.probe(ctx, check, ip)
+			mu.Lock()
+			probes[ip] = err
+			mu.Unlock()
+		}(ip)
+	}
+	wg.Wait()
+
+	for ip, published := range backends {
+		state, ok := states[ip]
+		if !ok {
+			state = &backendState{healthy: published}
+			states[ip] = state
+		}
+
+		if err := probes[ip]; err != nil {
+			state.failures++
+			state.successes = 0
+			log.Debug().Err(err).Str("domain", domain).Str("ip", ip).Msg("backend health check failed")
+		} else {
+			state.successes++
+			state.failures = 0
+		}
+
+		healthy := state.healthy
+		if state.healthy && state.failures >= check.threshold() {
+			healthy = false
+		} else if !state.healthy && state.successes >= check.threshold() {
+			healthy = true
+		}
+
+		if healthy == state.healthy {
+			state.refused = false
+			continue
+		}
+
+		changed, err := h.mgr.SetBackendHealth(domain, net.ParseIP(ip), healthy)
+		if err != nil {
+			return err
+		}
+
+		if !changed {
+			if !state.refused {
+				log.Warn().Str("domain", domain).Str("ip", ip).Msg("unhealthy backend kept, it is the last one")
+			}
+			state.refused = true
+			continue
+		}
+
+		log.Info().Str("domain", domain).Str("ip", ip).Bool("healthy", healthy).Msg("backend health changed")
+		state.healthy = healthy
+		state.refused = false
+	}
+
+	return nil
+}
+
+// probe returns an error if the backend at ip is not healthy
+func (h *HealthChecker) probe(ctx context.Context, check HealthCheck, ip string) error {
+	ctx, cancel := context.WithTimeout(ctx, check.timeout())
+	defer cancel()
+
+	addr := net.JoinHostPort(ip, strconv.Itoa(check.Port))
+	if check.Protocol == HealthCheckTCP {
+		var dialer net.Dialer
+		con, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return con.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("http://%s%s", addr, check.Path), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unhealthy status %s", resp.Status)
+	}
+
+	return nil
+}
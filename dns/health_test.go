@@ -0,0 +1,171 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthCheckTCP(t *testing.T) {
+	gwid := "gwid"
+	s, mgr := newTestMgr(t)
+	mgr.probePrivate = true
+	require.NoError(t, mgr.AddDomainDelagate("id", gwid, "gateway.tf"))
+
+	// only 127.0.0.1 accepts connections, 127.0.0.2 is a dead backend
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}
+	require.NoError(t, mgr.AddSubdomain("user", "app.gateway.tf", ips, 0))
+
+	check := HealthCheck{Protocol: HealthCheckTCP, Port: port, Threshold: 2}
+	assert.Error(t, mgr.SetHealthCheck("user2", "app.gateway.tf", check))
+	require.NoError(t, mgr.SetHealthCheck("user", "app.gateway.tf", check))
+
+	checks, err := mgr.HealthChecks()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]HealthCheck{"app.gateway.tf": check}, checks)
+
+	checker := NewHealthChecker(mgr)
+	ctx := context.Background()
+	published := func() []Record {
+		zr, err := mgr.getZoneRecords("gateway.tf", "app")
+		require.NoError(t, err)
+		return zr.Records[RecordTypeA]
+	}
+
+	require.NoError(t, checker.Check(ctx, "app.gateway.tf", check))
+	assert.Len(t, published(), 2, "the threshold is not reached yet")
+
+	require.NoError(t, checker.Check(ctx, "app.gateway.tf", check))
+	assert.Equal(t, []Record{RecordA{IP4: "127.0.0.1", TTL: defaultTTL}}, published())
+
+	backends, err := mgr.Backends("app.gateway.tf")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"127.0.0.1": true, "127.0.0.2": false}, backends)
+
+	// the last record is never pulled out
+	listener.Close()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, checker.Check(ctx, "app.gateway.tf", check))
+	}
+	assert.Equal(t, []Record{RecordA{IP4: "127.0.0.1", TTL: defaultTTL}}, published())
+	assert.True(t, checker.backends["app.gateway.tf"]["127.0.0.1"].refused, "the refused change is only reported once")
+	assert.True(t, checker.backends["app.gateway.tf"]["127.0.0.1"].healthy)
+
+	// removing the only published IP publishes the unhealthy ones
+	require.NoError(t, mgr.RemoveSubdomain("user", "app.gateway.tf", ips[:1]))
+	assert.Equal(t, []Record{RecordA{IP4: "127.0.0.2", TTL: defaultTTL}}, published())
+
+	require.NoError(t, mgr.RemoveSubdomain("user", "app.gateway.tf", ips[1:]))
+	assert.Empty(t, published())
+	assert.False(t, s.Exists(healthChecksKey), "the health check is removed with the subdomain")
+	assert.False(t, s.Exists(unhealthyRecordsKey))
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	_, mgr := newTestMgr(t)
+	mgr.probePrivate = true
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", "example.com"))
+
+	var status int32 = http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	_, portStr, err := net.SplitHostPort(server.Listener.Addr().String())
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	ips := []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}
+	require.NoError(t, mgr.AddSubdomain("user", "www.example.com", append(ips, net.ParseIP("127.0.0.2")), 0))
+
+	check := HealthCheck{Protocol: HealthCheckHTTP, Port: port, Path: "/health", Threshold: 1}
+	require.NoError(t, mgr.SetHealthCheck("user", "www.example.com", check))
+
+	checker := NewHealthChecker(mgr)
+	ctx := context.Background()
+	records := func() records {
+		zr, err := mgr.getZoneRecords("example.com", "www")
+		require.NoError(t, err)
+		return zr.Records
+	}
+
+	require.NoError(t, checker.Check(ctx, "www.example.com", check))
+	assert.Equal(t, []Record{RecordA{IP4: "127.0.0.1", TTL: defaultTTL}}, records()[RecordTypeA])
+	assert.Len(t, records()[RecordTypeAAAA], 1, "the last AAAA record is kept")
+
+	atomic.StoreInt32(&status, http.StatusServiceUnavailable)
+	require.NoError(t, checker.Check(ctx, "www.example.com", check))
+	assert.Equal(t, []Record{RecordA{IP4: "127.0.0.1", TTL: defaultTTL}}, records()[RecordTypeA])
+
+	require.NoError(t, mgr.RemoveHealthCheck("user", "www.example.com"))
+	assert.Len(t, records()[RecordTypeA], 2, "the backends are published again without health check")
+
+	invalid := []HealthCheck{
+		{Protocol: "udp", Port: 53},
+		{Protocol: HealthCheckTCP},
+		{Protocol: HealthCheckHTTP, Port: 80, Path: "health"},
+		{Protocol: HealthCheckTCP, Port: 80, Interval: -1},
+		{Protocol: HealthCheckTCP, Port: 80, Interval: 1},
+		{Protocol: HealthCheckTCP, Port: 80, Interval: 4},
+		{Protocol: HealthCheckTCP, Port: 80, Timeout: -1},
+		{Protocol: HealthCheckTCP, Port: 80, Interval: 5, Timeout: 5},
+		{Protocol: HealthCheckTCP, Port: 80, Interval: 30, Timeout: 10},
+	}
+	for _, check := range invalid {
+		assert.Error(t, mgr.SetHealthCheck("user", "www.example.com", check), "%+v", check)
+	}
+
+	valid := []HealthCheck{
+		{Protocol: HealthCheckTCP, Port: 80, Interval: 5},
+		{Protocol: HealthCheckTCP, Port: 80, Interval: 5, Timeout: 4},
+		{Protocol: HealthCheckTCP, Port: 80, Interval: 60},
+	}
+	for _, check := range valid {
+		assert.NoError(t, check.Valid(), "%+v", check)
+		assert.True(t, check.timeout() < check.interval(), "%+v", check)
+	}
+}
+
+func TestHealthCheckLimits(t *testing.T) {
+	_, mgr := newTestMgr(t)
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", "example.com"))
+	require.NoError(t, mgr.SetMaxHealthChecks(2))
+
+	check := HealthCheck{Protocol: HealthCheckTCP, Port: 80}
+	for i, ip := range []string{"127.0.0.1", "10.1.1.10", "169.254.169.254", "::1", "fe80::1", "fd00::1", "::ffff:192.168.1.1"} {
+		domain := fmt.Sprintf("private%d.example.com", i)
+		require.NoError(t, mgr.AddSubdomain("user", domain, []net.IP{net.ParseIP("185.15.201.80"), net.ParseIP(ip)}, 0))
+		assert.Error(t, mgr.SetHealthCheck("user", domain, check), "backend %s is not public", ip)
+	}
+
+	for _, name := range []string{"www", "app", "blog"} {
+		require.NoError(t, mgr.AddSubdomain("user", name+".example.com", []net.IP{net.ParseIP("185.15.201.80"), net.ParseIP("2a02:2788:864:1314:9eb6:d0ff:fe97:764b")}, 0))
+	}
+
+	require.NoError(t, mgr.SetHealthCheck("user", "www.example.com", check))
+	require.NoError(t, mgr.SetHealthCheck("user", "app.example.com", check))
+	assert.Error(t, mgr.SetHealthCheck("user", "blog.example.com", check), "the limit is reached")
+	assert.NoError(t, mgr.SetHealthCheck("user", "app.example.com", HealthCheck{Protocol: HealthCheckTCP, Port: 443}), "a health check can be changed")
+
+	require.NoError(t, mgr.RemoveHealthCheck("user", "app.example.com"))
+	assert.NoError(t, mgr.SetHealthCheck("user", "blog.example.com", check))
+}
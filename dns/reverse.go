@@ -0,0 +1,269 @@
+package dns
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	mdns "github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ptrPeersKey is the redis hash holding, for every address with a PTR,
+// the host the PTR points to for each of the peers using the address
+const ptrPeersKey = "tfgateway_ptr_peers"
+
+// ReverseZone returns the ip6.arpa zone holding the PTR records of the
+// addresses of subnet. The prefix of subnet must be a multiple of 4 bits
+func ReverseZone(subnet net.IPNet) (string, error) {
+	ones, bits := subnet.Mask.Size()
+	if bits != 8*net.IPv6len || subnet.IP.To4() != nil {
+		return "", fmt.Errorf("reverse zone of %s: only IPv6 subnets are supported", subnet.String())
+	}
+
+	if ones == 0 || ones%4 != 0 {
+		return "", fmt.Errorf("reverse zone of %s: the prefix length must be a multiple of 4", subnet.String())
+	}
+
+	labels := mdns.SplitDomainName(ptrName(subnet.IP))
+	return strings.Join(labels[(bits-ones)/4:], "."), nil
+}
+
+// AddReverseZone configures the gateway to answer the reverse lookups of the
+// addresses of subnet. The zone is owned by the gateway and marked as a reverse
+// zone: the users cannot reserve names in it, its records are only added with AddPTR
+func (c *Mgr) AddReverseZone(subnet net.IPNet) error {
+	zone, err := ReverseZone(subnet)
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("zone", zone).Msgf("gateway will answer reverse lookups of %s", subnet.String())
+	return c.addZone(c.identity, c.identity, zone, true, nil)
+}
+
+// refuseReverse fails if the zone owned by o is a reverse zone,
+// the users cannot reserve names or add records in such zones
+func (o ZoneOwner) refuseReverse(zone string) error {
+	if o.Reverse {
+		return errors.Wrapf(ErrAuth, "%s is a reverse zone, its records are only managed by the gateway", zone)
+	}
+	return nil
+}
+
+// SetReverseDomain sets the domain of the names the PTR records added without
+// a host point to. The name of an address is its hexadecimal form under domain.
+// If domain is empty, which is the default, no PTR is added without a host
+func (c *Mgr) SetReverseDomain(domain string) error {
+	if domain != "" {
+		if err := validateDomain(domain); err != nil {
+			return err
+		}
+	}
+
+	c.reverseDomain = domain
+	return nil
+}
+
+// AddPTR makes the reverse lookups of ip answer host for peer. If host is set,
+// user must be allowed to manage its records, as a subdomain reserved by user or
+// in a zone delegated by user. If host is empty the name set by SetReverseDomain
+// is used. The peers of a user share its address, so host must be the name the
+// PTR of ip already points to for the other peers, if any.
+// It returns the name the PTR points to, which is empty if no PTR is added
+func (c *Mgr) AddPTR(user, peer string, ip net.IP, host string, ttl int) (string, error) {
+	if err := validateTTL(ttl); err != nil {
+		return "", err
+	}
+
+	host, err := c.ptrHost(ip, host)
+	if err != nil || host == "" {
+		return "", err
+	}
+
+	if err := c.authorizePTRHost(user, ip, host); err != nil {
+		return "", err
+	}
+
+	log.Info().Msgf("add PTR %s to %s ttl %d for peer %s", ip, host, ttl, peer)
+	return host, c.updatePTR(ip, func(zr *Zone, peers map[string]string) error {
+		for other, otherHost := range peers {
+			if other != peer && otherHost != host {
+				return errors.Wrapf(ErrPTRConflict, "cannot point the PTR of %s to %s, it points to %s", ip, host, otherHost)
+			}
+		}
+
+		if former, ok := peers[peer]; ok && former != host {
+			zr.Remove(RecordPTR{Host: former})
+		}
+
+		peers[peer] = host
+		zr.Add(RecordPTR{Host: host, TTL: c.ttl(ttl)})
+		return nil
+	})
+}
+
+// RemovePTR removes the PTR added for peer with AddPTR. The PTR is kept as long
+// as other peers use it. The ownership of host is not checked again, since the
+// user may have released it in the meantime
+func (c *Mgr) RemovePTR(peer string, ip net.IP, host string) error {
+	host, err := c.ptrHost(ip, host)
+	if err != nil {
+		return err
+	}
+
+	err = c.updatePTR(ip, func(zr *Zone, peers map[string]string) error {
+		if former, ok := peers[peer]; ok {
+			// the PTR the peer was added with
+			host = former
+		}
+		delete(peers, peer)
+
+		for _, other := range peers {
+			if other == host {
+				return nil
+			}
+		}
+
+		if host != "" {
+			zr.Remove(RecordPTR{Host: host})
+		}
+		return nil
+	})
+	if errors.Is(err, ErrNoReverseZone) {
+		// the records went away with the zone
+		return c.apply(func(t *tx) error {
+			t.send("HDEL", ptrPeersKey, ptrField(ip))
+			return nil
+		})
+	}
+	return err
+}
+
+// ptrHost returns the name the PTR of ip points to
+func (c *Mgr) ptrHost(ip net.IP, host string) (string, error) {
+	if ip.To16() == nil {
+		return "", fmt.Errorf("invalid IP %s", ip)
+	}
+
+	host = strings.TrimSuffix(host, ".")
+	if host != "" {
+		return host, validateDomain(host)
+	}
+
+	if c.reverseDomain == "" {
+		return "", nil
+	}
+	return hex.EncodeToString(ip.To16()) + "." + c.reverseDomain, nil
+}
+
+// authorizePTRHost checks that user can point the PTR of ip to host
+func (c *Mgr) authorizePTRHost(user string, ip net.IP, host string) error {
+	if c.reverseDomain != "" && host == hex.EncodeToString(ip.To16())+"."+c.reverseDomain {
+		// the default name of ip
+		return nil
+	}
+
+	if IsWildcard(host) {
+		return fmt.Errorf("PTR host %s cannot be a wildcard", host)
+	}
+
+	if _, _, err := c.authorizeRecords(user, host); err != nil {
+		return errors.Wrapf(err, "cannot point the PTR of %s to %s", ip, host)
+	}
+	return nil
+}
+
+// updatePTR applies update to the records of the reverse name of ip and
+// to the hosts the PTR of ip points to for each of its peers
+func (c *Mgr) updatePTR(ip net.IP, update func(zr *Zone, peers map[string]string) error) error {
+	fqdn := strings.TrimSuffix(ptrName(ip), ".")
+	_, zone, owner, err := c.findZone(fqdn)
+	if err != nil {
+		return err
+	}
+
+	if owner.Owner != c.identity || !owner.Reverse {
+		return errors.Wrapf(ErrNoReverseZone, "cannot update the PTR of %s", ip)
+	}
+
+	return c.atomic(func(r *Mgr, t *tx) error {
+		name, zone, _, err := r.locateDomain(fqdn)
+		if err != nil {
+			return err
+		}
+
+		zr, err := r.getZoneRecords(zone, name)
+		if err != nil {
+			return err
+		}
+
+		peers, err := r.ptrPeers(ip)
+		if err != nil {
+			return err
+		}
+
+		if err := update(&zr, peers); err != nil {
+			return err
+		}
+
+		if err := t.setPTRPeers(ip, peers); err != nil {
+			return err
+		}
+
+		if zr.Records.IsEmpty() {
+			t.deleteZoneRecords(zone, name)
+			return nil
+		}
+		return t.setZoneRecords(zone, name, zr)
+	}, zoneKey(zone), ptrPeersKey)
+}
+
+// ptrPeers returns the host the PTR of ip points to for each peer using ip
+func (c *Mgr) ptrPeers(ip net.IP) (map[string]string, error) {
+	con := c.redis.Get()
+	defer con.Close()
+
+	peers := make(map[string]string)
+	b, err := redis.Bytes(con.Do("HGET", ptrPeersKey, ptrField(ip)))
+	if errors.Is(err, redis.ErrNil) {
+		return peers, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the peers of %s", ip)
+	}
+
+	if err := json.Unmarshal(b, &peers); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode the peers of %s", ip)
+	}
+	return peers, nil
+}
+
+func (t *tx) setPTRPeers(ip net.IP, peers map[string]string) error {
+	if len(peers) == 0 {
+		t.send("HDEL", ptrPeersKey, ptrField(ip))
+		return nil
+	}
+
+	b, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+
+	t.send("HSET", ptrPeersKey, ptrField(ip), b)
+	return nil
+}
+
+// ptrField returns the field of ptrPeersKey holding the peers of ip
+func ptrField(ip net.IP) string {
+	return strings.TrimSuffix(ptrName(ip), ".")
+}
+
+// ptrName returns the fully qualified reverse name of ip
+func ptrName(ip net.IP) string {
+	name, _ := mdns.ReverseAddr(ip.String())
+	return name
+}
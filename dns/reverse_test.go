@@ -0,0 +1,156 @@
+package dns
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReverseZone(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("fd5e:ca9b:d3eb:7c0::/64")
+	require.NoError(t, err)
+
+	zone, err := ReverseZone(*subnet)
+	require.NoError(t, err)
+	assert.Equal(t, "0.c.7.0.b.e.3.d.b.9.a.c.e.5.d.f.ip6.arpa", zone)
+
+	_, subnet, err = net.ParseCIDR("fd5e:ca9b:d3eb:7c0::/62")
+	require.NoError(t, err)
+	_, err = ReverseZone(*subnet)
+	assert.Error(t, err)
+
+	_, subnet, err = net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	_, err = ReverseZone(*subnet)
+	assert.Error(t, err)
+}
+
+func TestPTR(t *testing.T) {
+	gwid := "gwid"
+	s, mgr := newTestMgr(t)
+
+	_, subnet, err := net.ParseCIDR("fd5e:ca9b:d3eb:7c0::/64")
+	require.NoError(t, err)
+	ip := net.ParseIP("fd5e:ca9b:d3eb:7c0:1122:3344:5566:7788")
+	zone := "0.c.7.0.b.e.3.d.b.9.a.c.e.5.d.f.ip6.arpa."
+	name := "8.8.7.7.6.6.5.5.4.4.3.3.2.2.1.1"
+
+	require.NoError(t, mgr.AddDomainDelagate(gwid, gwid, "gateway.tf"))
+	require.NoError(t, mgr.AddDomainDelagate(gwid, "user", "mydomain.com"))
+	require.NoError(t, mgr.AddSubdomain("user", "app.gateway.tf", []net.IP{ip}, 0))
+
+	_, err = mgr.AddPTR("user", "peer", ip, "app.gateway.tf", 0)
+	assert.True(t, errors.Is(err, ErrNoReverseZone))
+	assert.NoError(t, mgr.RemovePTR("peer", ip, "app.gateway.tf"))
+
+	require.NoError(t, mgr.AddReverseZone(*subnet))
+
+	t.Run("no default name", func(t *testing.T) {
+		host, err := mgr.AddPTR("user", "peer", ip, "", 0)
+		require.NoError(t, err)
+		assert.Empty(t, host)
+		assert.Empty(t, s.HGet(zone, name))
+	})
+
+	t.Run("host of the user", func(t *testing.T) {
+		host, err := mgr.AddPTR("user", "peer", ip, "app.gateway.tf", 600)
+		require.NoError(t, err)
+		assert.Equal(t, "app.gateway.tf", host)
+		assert.JSONEq(t, `{"ptr":[{"host":"app.gateway.tf","ttl":600}]}`, s.HGet(zone, name))
+
+		require.NoError(t, mgr.RemovePTR("peer", ip, "app.gateway.tf"))
+		assert.Empty(t, s.HGet(zone, name))
+	})
+
+	t.Run("host of another user", func(t *testing.T) {
+		_, err := mgr.AddPTR("other", "peer", ip, "app.gateway.tf", 0)
+		assert.Error(t, err)
+
+		_, err = mgr.AddPTR("other", "peer", ip, "mail.mydomain.com", 0)
+		assert.Error(t, err)
+
+		_, err = mgr.AddPTR("user", "peer", ip, "mail.mydomain.com", 0)
+		assert.NoError(t, err)
+		require.NoError(t, mgr.RemovePTR("peer", ip, "mail.mydomain.com"))
+	})
+
+	t.Run("peers of the same user", func(t *testing.T) {
+		host, err := mgr.AddPTR("user", "peer1", ip, "app.gateway.tf", 0)
+		require.NoError(t, err)
+		assert.Equal(t, "app.gateway.tf", host)
+
+		_, err = mgr.AddPTR("user", "peer2", ip, "mail.mydomain.com", 0)
+		assert.True(t, errors.Is(err, ErrPTRConflict))
+
+		_, err = mgr.AddPTR("user", "peer2", ip, "app.gateway.tf", 0)
+		require.NoError(t, err)
+
+		require.NoError(t, mgr.RemovePTR("peer1", ip, "app.gateway.tf"))
+		assert.JSONEq(t, `{"ptr":[{"host":"app.gateway.tf","ttl":3600}]}`, s.HGet(zone, name))
+
+		require.NoError(t, mgr.RemovePTR("peer2", ip, "app.gateway.tf"))
+		assert.Empty(t, s.HGet(zone, name))
+		assert.Empty(t, s.HGet(ptrPeersKey, ptrField(ip)))
+	})
+
+	t.Run("default name", func(t *testing.T) {
+		require.NoError(t, mgr.SetReverseDomain("gateway.tf"))
+		defer mgr.SetReverseDomain("")
+
+		host, err := mgr.AddPTR("other", "peer", ip, "", 0)
+		require.NoError(t, err)
+		assert.Equal(t, "fd5eca9bd3eb07c01122334455667788.gateway.tf", host)
+
+		udp, _ := startServer(t, NewServer(mgr, []string{"ns1.gateway.tf"}, nil))
+
+		m := new(mdns.Msg)
+		m.SetQuestion(ptrName(ip), mdns.TypePTR)
+		resp, _, err := new(mdns.Client).Exchange(m, udp)
+		require.NoError(t, err)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, host+".", resp.Answer[0].(*mdns.PTR).Ptr)
+
+		require.NoError(t, mgr.RemovePTR("peer", ip, ""))
+		assert.Empty(t, s.HGet(zone, name))
+	})
+}
+
+func TestReverseZoneReserved(t *testing.T) {
+	gwid := "gwid"
+	s, mgr := newTestMgr(t)
+
+	_, subnet, err := net.ParseCIDR("fd5e:ca9b:d3eb:7c0::/64")
+	require.NoError(t, err)
+	zone := "0.c.7.0.b.e.3.d.b.9.a.c.e.5.d.f.ip6.arpa"
+	label := "8.8.7.7.6.6.5.5.4.4.3.3.2.2.1.1"
+	domain := label + "." + zone
+
+	require.NoError(t, mgr.AddReverseZone(*subnet))
+	require.NoError(t, mgr.AddReverseZone(*subnet), "the reverse zone is added again at every start")
+	assert.True(t, errors.Is(mgr.AddDomainDelagate(gwid, gwid, zone), ErrAuth), "a reverse zone cannot become a managed domain")
+
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+	refused := map[string]error{
+		"label":      mgr.AddSubdomain("user", "1."+zone, ips, 0),
+		"name":       mgr.AddSubdomain("user", domain, ips, 0),
+		"wildcard":   mgr.AddSubdomain("user", "*."+zone, ips, 0),
+		"cname":      mgr.AddSubdomainCNAME("user", "1."+zone, "app.example.com", 0),
+		"mx":         mgr.AddMX("user", zone, []RecordMX{{Host: "mail.example.com", Preference: 10}}),
+		"caa":        mgr.AddCAA("user", zone, []RecordCAA{{Tag: "issue", Value: "letsencrypt.org"}}),
+		"srv":        mgr.AddSRV("user", "_sip", "_tcp", zone, []RecordSRV{{Port: 5060, Target: "sip.example.com"}}),
+		"delegation": mgr.AddSubdomainDelegation("user", "1."+zone, []NameServer{{Host: "ns1.example.com"}}),
+	}
+	for what, err := range refused {
+		assert.True(t, errors.Is(err, ErrAuth), "%s: %v", what, err)
+	}
+
+	subdomains, err := mgr.Subdomains()
+	require.NoError(t, err)
+	assert.Empty(t, subdomains)
+	assert.Empty(t, s.HGet(zone+".", label))
+	assert.Empty(t, s.HGet(zone+".", "1"))
+}
@@ -0,0 +1,601 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Server is an authoritative DNS server that answers queries straight from
+// the zones configured in redis by Mgr. It can replace coredns-redis
+type Server struct {
+	mgr         *Mgr
+	nameservers []string
+	signer      *Signer
+	geoip       GeoIP
+}
+
+// NewServer creates a DNS server answering from the zones managed by mgr
+// nameservers are the names of the gateway nameservers, they are used to
+// build the SOA and NS records of the zones. If signer is not nil, the
+// zones are signed with DNSSEC
+func NewServer(mgr *Mgr, nameservers []string, signer *Signer) *Server {
+	return &Server{
+		mgr:         mgr,
+		nameservers: nameservers,
+		signer:      signer,
+	}
+}
+
+// SetGeoIP sets the lookup used to find the region of the clients,
+// so they are answered with the records of their region
+func (s *Server) SetGeoIP(geoip GeoIP) {
+	s.geoip = geoip
+}
+
+// ListenAndServe serves DNS over UDP and TCP on addr until ctx is canceled
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on udp %s", addr)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return errors.Wrapf(err, "failed to listen on tcp %s", addr)
+	}
+
+	return s.Serve(ctx, pc, l)
+}
+
+// Serve serves DNS on the UDP connection pc and the TCP listener l
+// until ctx is canceled
+func (s *Server) Serve(ctx context.Context, pc net.PacketConn, l net.Listener) error {
+	started := make(chan struct{}, 2)
+	errs := make(chan error, 2)
+
+	servers := []*mdns.Server{
+		{PacketConn: pc, Handler: s},
+		{Listener: l, Handler: s},
+	}
+
+	shutdown := func() {
+		for _, server := range servers {
+			if err := server.Shutdown(); err != nil {
+				log.Debug().Err(err).Msg("failed to shutdown dns server")
+			}
+		}
+	}
+
+	for _, server := range servers {
+		server.NotifyStartedFunc = func() { started <- struct{}{} }
+		go func(server *mdns.Server) {
+			errs <- server.ActivateAndServe()
+		}(server)
+	}
+
+	for range servers {
+		select {
+		case <-started:
+		case err := <-errs:
+			shutdown()
+			return err
+		}
+	}
+
+	log.Info().Str("udp", pc.LocalAddr().String()).Str("tcp", l.Addr().String()).Msg("dns server started")
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+
+	shutdown()
+	return err
+}
+
+// ServeDNS implements github.com/miekg/dns.Handler interface
+func (s *Server) ServeDNS(w mdns.ResponseWriter, req *mdns.Msg) {
+	m := new(mdns.Msg)
+	m.SetReply(req)
+
+	opt := req.IsEdns0()
+	dnssec := s.signer != nil && opt != nil && opt.Do()
+	subnet := clientSubnet(opt)
+
+	if len(req.Question) != 1 {
+		m.SetRcode(req, mdns.RcodeFormatError)
+	} else if err := s.answer(m, req.Question[0], clientIP(w, subnet), dnssec); err != nil {
+		log.Error().Err(err).Str("name", req.Question[0].Name).Msg("failed to answer dns query")
+		m = new(mdns.Msg)
+		m.SetRcode(req, mdns.RcodeServerFailure)
+	}
+
+	size := mdns.MinMsgSize
+	if opt != nil {
+		size = int(opt.UDPSize())
+		m.SetEdns0(opt.UDPSize(), dnssec)
+
+		if subnet != nil {
+			// the answer depends on the subnet of the client, as far as
+			// resolvers caching it are concerned
+			scoped := *subnet
+			scoped.SourceScope = subnet.SourceNetmask
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &scoped)
+		}
+	}
+
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		m.Truncate(size)
+	}
+
+	if err := w.WriteMsg(m); err != nil {
+		log.Error().Err(err).Msg("failed to write dns response")
+	}
+}
+
+// answer answers the question q asked by the client at ip
+func (s *Server) answer(m *mdns.Msg, q mdns.Question, ip net.IP, dnssec bool) error {
+	qname := strings.ToLower(mdns.Fqdn(q.Name))
+
+	zone, err := s.zoneOf(qname)
+	if err != nil {
+		return err
+	}
+
+	if zone == "" {
+		m.Rcode = mdns.RcodeRefused
+		return nil
+	}
+
+	serial, err := s.mgr.zoneSerial(zone)
+	if err != nil {
+		return err
+	}
+	soa := s.soa(zone, serial)
+
+	names, err := s.mgr.zoneNames(zone)
+	if err != nil {
+		return err
+	}
+
+	name := relativeName(qname, zone)
+
+	delegation, err := s.delegationPoint(zone, names, name, q.Qtype)
+	if err != nil {
+		return err
+	}
+
+	if delegation != nil {
+		if err := s.referral(m, zone, delegation); err != nil {
+			return err
+		}
+
+		if dnssec {
+			// prove that the delegation is not signed, there is no DS record
+			owner := mdns.Fqdn(absoluteName(delegation.name, zone))
+			return s.sign(m, zone, nil, []mdns.RR{nsec(owner, 300, []uint16{mdns.TypeNS})})
+		}
+		return nil
+	}
+
+	m.Authoritative = true
+
+	location, ok := findLocation(names, name)
+	if !ok {
+		if dnssec {
+			// with online signing, non existing names are answered
+			// as existing names without any records
+			return s.sign(m, zone, nil, []mdns.RR{soa, nsec(mdns.Fqdn(q.Name), 300, nil)})
+		}
+
+		m.Rcode = mdns.RcodeNameError
+		m.Ns = []mdns.RR{soa}
+		return nil
+	}
+
+	zr, err := s.mgr.getZoneRecords(zone, location)
+	if err != nil {
+		return err
+	}
+
+	owner := mdns.Fqdn(q.Name)
+	var extra []mdns.RR
+	if name == apex {
+		if _, ok := zr.Records[RecordTypeNS]; !ok {
+			for _, ns := range s.nameservers {
+				zr.Add(RecordNS{Host: ns, TTL: defaultTTL})
+			}
+		}
+
+		extra = append(extra, soa)
+		if s.signer != nil {
+			extra = append(extra, s.signer.DNSKEY(zone))
+		}
+	}
+
+	region := ""
+	if s.geoip != nil && ip != nil {
+		region = s.geoip.Region(ip)
+	}
+
+	for _, typ := range []RecordType{RecordTypeA, RecordTypeAAAA} {
+		if records, ok := zr.Records[typ]; ok {
+			zr.Records[typ] = steer(records, region)
+		}
+	}
+
+	var answer []mdns.RR
+	for _, records := range zr.Records {
+		for _, r := range records {
+			// the records of unknown types are not answered
+			if rr := toRR(owner, r); rr != nil {
+				answer = append(answer, rr)
+			}
+		}
+	}
+	answer = append(answer, extra...)
+
+	var cname []mdns.RR
+	types := make([]uint16, 0, len(answer))
+	for _, rr := range answer {
+		rrtype := rr.Header().Rrtype
+		types = append(types, rrtype)
+
+		if q.Qtype == mdns.TypeANY || rrtype == q.Qtype {
+			m.Answer = append(m.Answer, rr)
+		} else if rrtype == mdns.TypeCNAME {
+			cname = append(cname, rr)
+		}
+	}
+
+	if len(m.Answer) == 0 {
+		m.Answer = cname
+	}
+
+	if len(m.Answer) == 0 {
+		if dnssec {
+			return s.sign(m, zone, nil, []mdns.RR{soa, nsec(owner, 300, types)})
+		}
+
+		m.Ns = []mdns.RR{soa}
+		return nil
+	}
+
+	if dnssec {
+		return s.sign(m, zone, m.Answer, nil)
+	}
+
+	return nil
+}
+
+// clientSubnet returns the EDNS client subnet option of a query, if any
+func clientSubnet(opt *mdns.OPT) *mdns.EDNS0_SUBNET {
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*mdns.EDNS0_SUBNET); ok && subnet.SourceNetmask > 0 {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// clientIP returns the IP of the client that sent a query. A resolver
+// can send the subnet of its own client, which is used instead
+func clientIP(w mdns.ResponseWriter, subnet *mdns.EDNS0_SUBNET) net.IP {
+	if subnet != nil {
+		return subnet.Address
+	}
+
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// sign sets the answer and authority sections of m
+// together with the RRSIG records that cover them
+func (s *Server) sign(m *mdns.Msg, zone string, answer, authority []mdns.RR) error {
+	m.Answer = answer
+	m.Ns = append(m.Ns, authority...)
+
+	sigs, err := s.signer.Sign(zone, answer)
+	if err != nil {
+		return err
+	}
+	m.Answer = append(m.Answer, sigs...)
+
+	sigs, err = s.signer.Sign(zone, authority)
+	if err != nil {
+		return err
+	}
+	m.Ns = append(m.Ns, sigs...)
+
+	return nil
+}
+
+// delegationPoint looks for the closest ancestor of name, or name itself, that
+// is delegated to other nameservers and returns its records. DS records are
+// answered by the parent, so name itself is not considered for DS queries
+func (s *Server) delegationPoint(zone string, names map[string]struct{}, name string, qtype uint16) (*delegation, error) {
+	if name == apex {
+		return nil, nil
+	}
+
+	labels := strings.Split(name, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if i == 0 && qtype == mdns.TypeDS {
+			break
+		}
+
+		candidate := strings.Join(labels[i:], ".")
+		if _, ok := names[candidate]; !ok {
+			continue
+		}
+
+		zr, err := s.mgr.getZoneRecords(zone, candidate)
+		if err != nil {
+			return nil, err
+		}
+
+		if ns := zr.Records[RecordTypeNS]; len(ns) > 0 {
+			return &delegation{name: candidate, ns: ns}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// delegation is a name of a zone handed off to other nameservers
+type delegation struct {
+	name string
+	ns   []Record
+}
+
+// referral answers with the NS records of a name delegated to
+// other nameservers, and the glue records when needed
+func (s *Server) referral(m *mdns.Msg, zone string, d *delegation) error {
+	domain := absoluteName(d.name, zone)
+	for _, r := range d.ns {
+		ns, ok := r.(RecordNS)
+		if !ok {
+			continue
+		}
+		m.Ns = append(m.Ns, toRR(mdns.Fqdn(domain), ns))
+
+		host := ns.Host
+		if !strings.HasSuffix(host, "."+domain) {
+			continue
+		}
+
+		glue, err := s.mgr.getZoneRecords(zone, relativeName(mdns.Fqdn(host), zone))
+		if err != nil {
+			return err
+		}
+
+		for _, typ := range []RecordType{RecordTypeA, RecordTypeAAAA} {
+			for _, r := range glue.Records[typ] {
+				if rr := toRR(mdns.Fqdn(host), r); rr != nil {
+					m.Extra = append(m.Extra, rr)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// zoneOf returns the most specific zone served by the gateway that contains
+// the fully qualified name qname, or an empty string if there is none
+func (s *Server) zoneOf(qname string) (string, error) {
+	labels := mdns.SplitDomainName(qname)
+	for i := 0; i < len(labels)-1; i++ {
+		zone := strings.Join(labels[i:], ".")
+		owner, err := s.mgr.getZoneOwner(zone)
+		if err != nil {
+			return "", err
+		}
+
+		if owner.Owner != "" {
+			return zone, nil
+		}
+	}
+
+	return "", nil
+}
+
+// soa returns the SOA record of zone. The serial changes with the records of
+// the zone, so the resolvers and secondaries can tell when the zone changed
+func (s *Server) soa(zone string, serial uint32) *mdns.SOA {
+	ns := "ns1." + zone
+	if len(s.nameservers) > 0 {
+		ns = s.nameservers[0]
+	}
+
+	return &mdns.SOA{
+		Hdr:     header(mdns.Fqdn(zone), mdns.TypeSOA, 3600),
+		Ns:      mdns.Fqdn(ns),
+		Mbox:    mdns.Fqdn("hostmaster." + zone),
+		Serial:  serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  300,
+	}
+}
+
+// zoneNames returns all the names that have records in zone
+func (c *Mgr) zoneNames(zone string) (map[string]struct{}, error) {
+	con := c.redis.Get()
+	defer con.Close()
+
+	keys, err := redis.Strings(con.Do("HKEYS", zone+"."))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list names of zone '%s'", zone)
+	}
+
+	names := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		names[key] = struct{}{}
+	}
+
+	return names, nil
+}
+
+// findLocation returns the name holding the records of name in the zone. If name
+// does not exist, the wildcard of its closest encloser is used as the coredns
+// redis plugin does. ok is false if name does not exist at all
+func findLocation(names map[string]struct{}, name string) (location string, ok bool) {
+	if _, ok := names[name]; ok || name == apex {
+		return name, true
+	}
+
+	labels := strings.Split(name, ".")
+	for i := 1; i <= len(labels); i++ {
+		encloser := apex
+		if i < len(labels) {
+			encloser = strings.Join(labels[i:], ".")
+		}
+
+		wildcard := wildcardName(encloser)
+		if _, ok := names[wildcard]; ok {
+			return wildcard, true
+		}
+
+		if exists(names, encloser) {
+			break
+		}
+	}
+
+	// name can still be an empty non-terminal like _tcp in _sip._tcp
+	return name, exists(names, name)
+}
+
+// exists checks if name has records or is the parent of a name with records
+func exists(names map[string]struct{}, name string) bool {
+	if name == apex {
+		return true
+	}
+
+	if _, ok := names[name]; ok {
+		return true
+	}
+
+	for n := range names {
+		if strings.HasSuffix(n, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// relativeName returns the name of the fully qualified name fqdn inside zone
+func relativeName(fqdn, zone string) string {
+	name := strings.TrimSuffix(strings.TrimSuffix(fqdn, "."), zone)
+	if name == "" {
+		return apex
+	}
+	return strings.TrimSuffix(name, ".")
+}
+
+// absoluteName is the opposite of relativeName, without the trailing dot
+func absoluteName(name, zone string) string {
+	if name == apex {
+		return zone
+	}
+	return name + "." + zone
+}
+
+func header(name string, rrtype uint16, ttl int) mdns.RR_Header {
+	// records stored before the TTL was validated can have a negative TTL
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return mdns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  mdns.ClassINET,
+		Ttl:    uint32(ttl),
+	}
+}
+
+func rrType(typ RecordType) uint16 {
+	switch typ {
+	case RecordTypeA:
+		return mdns.TypeA
+	case RecordTypeAAAA:
+		return mdns.TypeAAAA
+	case RecordTypeCNAME:
+		return mdns.TypeCNAME
+	case RecordTypeTXT:
+		return mdns.TypeTXT
+	case RecordTypeMX:
+		return mdns.TypeMX
+	case RecordTypeSRV:
+		return mdns.TypeSRV
+	case RecordTypeCAA:
+		return mdns.TypeCAA
+	case RecordTypeNS:
+		return mdns.TypeNS
+	case RecordTypePTR:
+		return mdns.TypePTR
+	}
+	return mdns.TypeNone
+}
+
+// toRR converts a record into its wire representation owned by name.
+// It returns nil for the records of unknown types
+func toRR(name string, r Record) mdns.RR {
+	switch r := r.(type) {
+	case RecordA:
+		return &mdns.A{Hdr: header(name, mdns.TypeA, r.TTL), A: net.ParseIP(r.IP4)}
+	case RecordAAAA:
+		return &mdns.AAAA{Hdr: header(name, mdns.TypeAAAA, r.TTL), AAAA: net.ParseIP(r.IP6)}
+	case RecordCname:
+		return &mdns.CNAME{Hdr: header(name, mdns.TypeCNAME, r.TTL), Target: mdns.Fqdn(r.Host)}
+	case RecordTXT:
+		return &mdns.TXT{Hdr: header(name, mdns.TypeTXT, r.TTL), Txt: splitTXT(r.Text)}
+	case RecordMX:
+		return &mdns.MX{Hdr: header(name, mdns.TypeMX, r.TTL), Mx: mdns.Fqdn(r.Host), Preference: uint16(r.Preference)}
+	case RecordSRV:
+		return &mdns.SRV{
+			Hdr:      header(name, mdns.TypeSRV, r.TTL),
+			Priority: uint16(r.Priority),
+			Weight:   uint16(r.Weight),
+			Port:     uint16(r.Port),
+			Target:   mdns.Fqdn(r.Target),
+		}
+	case RecordCAA:
+		return &mdns.CAA{Hdr: header(name, mdns.TypeCAA, r.TTL), Flag: uint8(r.Flag), Tag: r.Tag, Value: r.Value}
+	case RecordNS:
+		return &mdns.NS{Hdr: header(name, mdns.TypeNS, r.TTL), Ns: mdns.Fqdn(r.Host)}
+	case RecordPTR:
+		return &mdns.PTR{Hdr: header(name, mdns.TypePTR, r.TTL), Ptr: mdns.Fqdn(r.Host)}
+	}
+	return nil
+}
+
+// splitTXT splits text in strings of at most 255 bytes as required by the TXT record
+func splitTXT(text string) []string {
+	var txt []string
+	for len(text) > 255 {
+		txt = append(txt, text[:255])
+		text = text[255:]
+	}
+	return append(txt, text)
+}
@@ -0,0 +1,176 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	gwid := "gwid"
+	s, mgr := newTestMgr(t)
+
+	ips := []net.IP{
+		net.ParseIP("10.1.1.10"),
+		net.ParseIP("2a02:2788:864:1314:9eb6:d0ff:fe97:764b"),
+	}
+
+	require.NoError(t, mgr.AddDomainDelagate("id", gwid, "gateway.tf"))
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", "mydomain.com"))
+	require.NoError(t, mgr.AddSubdomain("user", "app.gateway.tf", ips, 0))
+	require.NoError(t, mgr.AddSubdomain("user", "*.app.gateway.tf", ips[:1], 0))
+	require.NoError(t, mgr.AddMX("user", "mydomain.com", []RecordMX{{Host: "mail.mydomain.com", Preference: 10, TTL: 3600}}))
+	require.NoError(t, mgr.AddSRV("user", "_sip", "_tcp", "voip.mydomain.com", []RecordSRV{{Priority: 1, Weight: 1, Port: 5060, Target: "sip.mydomain.com", TTL: 3600}}))
+	require.NoError(t, mgr.AddSubdomainDelegation("user", "dev.mydomain.com", []NameServer{
+		{Host: "ns1.dev.mydomain.com", IPs: []net.IP{net.ParseIP("10.1.1.20")}},
+	}))
+
+	udp, tcp := startServer(t, NewServer(mgr, []string{"ns1.gateway.tf", "ns2.gateway.tf"}, nil))
+
+	query := func(t *testing.T, network, name string, qtype uint16) *mdns.Msg {
+		addr := udp
+		if network == "tcp" {
+			addr = tcp
+		}
+
+		m := new(mdns.Msg)
+		m.SetQuestion(mdns.Fqdn(name), qtype)
+
+		client := mdns.Client{Net: network}
+		resp, _, err := client.Exchange(m, addr)
+		require.NoError(t, err)
+		return resp
+	}
+
+	t.Run("A", func(t *testing.T) {
+		resp := query(t, "udp", "app.gateway.tf", mdns.TypeA)
+		assert.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+		assert.True(t, resp.Authoritative)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, "10.1.1.10", resp.Answer[0].(*mdns.A).A.String())
+	})
+
+	t.Run("AAAA over tcp", func(t *testing.T) {
+		resp := query(t, "tcp", "app.gateway.tf", mdns.TypeAAAA)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, ips[1].String(), resp.Answer[0].(*mdns.AAAA).AAAA.String())
+	})
+
+	t.Run("wildcard", func(t *testing.T) {
+		resp := query(t, "udp", "tenant.app.gateway.tf", mdns.TypeA)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, "tenant.app.gateway.tf.", resp.Answer[0].Header().Name)
+		assert.Equal(t, "10.1.1.10", resp.Answer[0].(*mdns.A).A.String())
+	})
+
+	t.Run("NXDOMAIN", func(t *testing.T) {
+		resp := query(t, "udp", "nothere.gateway.tf", mdns.TypeA)
+		assert.Equal(t, mdns.RcodeNameError, resp.Rcode)
+		require.Len(t, resp.Ns, 1)
+		assert.IsType(t, &mdns.SOA{}, resp.Ns[0])
+	})
+
+	t.Run("NODATA", func(t *testing.T) {
+		resp := query(t, "udp", "app.gateway.tf", mdns.TypeMX)
+		assert.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 0)
+		require.Len(t, resp.Ns, 1)
+	})
+
+	t.Run("empty non terminal", func(t *testing.T) {
+		resp := query(t, "udp", "_tcp.voip.mydomain.com", mdns.TypeA)
+		assert.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 0)
+	})
+
+	t.Run("MX on apex", func(t *testing.T) {
+		resp := query(t, "udp", "mydomain.com", mdns.TypeMX)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, "mail.mydomain.com.", resp.Answer[0].(*mdns.MX).Mx)
+	})
+
+	t.Run("NS and SOA on apex", func(t *testing.T) {
+		resp := query(t, "udp", "mydomain.com", mdns.TypeNS)
+		assert.Len(t, resp.Answer, 2)
+
+		resp = query(t, "udp", "mydomain.com", mdns.TypeSOA)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, "ns1.gateway.tf.", resp.Answer[0].(*mdns.SOA).Ns)
+	})
+
+	t.Run("SRV", func(t *testing.T) {
+		resp := query(t, "udp", "_sip._tcp.voip.mydomain.com", mdns.TypeSRV)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, uint16(5060), resp.Answer[0].(*mdns.SRV).Port)
+	})
+
+	t.Run("referral", func(t *testing.T) {
+		resp := query(t, "udp", "www.dev.mydomain.com", mdns.TypeA)
+		assert.False(t, resp.Authoritative)
+		assert.Len(t, resp.Answer, 0)
+		require.Len(t, resp.Ns, 1)
+		assert.Equal(t, "ns1.dev.mydomain.com.", resp.Ns[0].(*mdns.NS).Ns)
+		require.Len(t, resp.Extra, 1)
+		assert.Equal(t, "10.1.1.20", resp.Extra[0].(*mdns.A).A.String())
+	})
+
+	t.Run("not served", func(t *testing.T) {
+		resp := query(t, "udp", "example.org", mdns.TypeA)
+		assert.Equal(t, mdns.RcodeRefused, resp.Rcode)
+	})
+
+	t.Run("unknown record type", func(t *testing.T) {
+		// the coredns redis plugin stores SOA records the gateway does not handle
+		s.HSet("mydomain.com.", "legacy", `{"soa":[{"ttl":300,"mbox":"hostmaster.mydomain.com.","ns":"ns1.mydomain.com."}],"a":[{"ip":"10.1.1.30","ttl":300}]}`)
+		defer s.HDel("mydomain.com.", "legacy")
+
+		resp := query(t, "udp", "legacy.mydomain.com", mdns.TypeANY)
+		assert.Equal(t, mdns.RcodeSuccess, resp.Rcode)
+		require.Len(t, resp.Answer, 1)
+		assert.Equal(t, "10.1.1.30", resp.Answer[0].(*mdns.A).A.String())
+
+		// the unknown records survive the changes of the other records
+		require.NoError(t, mgr.AddSubdomain("user", "legacy.mydomain.com", []net.IP{net.ParseIP("10.1.1.31")}, 0))
+		assert.Contains(t, s.HGet("mydomain.com.", "legacy"), `"soa":[{"ttl":300,"mbox":"hostmaster.mydomain.com.","ns":"ns1.mydomain.com."}]`)
+	})
+
+	t.Run("SOA serial", func(t *testing.T) {
+		serial := func() uint32 {
+			resp := query(t, "udp", "mydomain.com", mdns.TypeSOA)
+			require.Len(t, resp.Answer, 1)
+			return resp.Answer[0].(*mdns.SOA).Serial
+		}
+
+		before := serial()
+		assert.Equal(t, before, serial(), "the serial does not change without changes of the zone")
+
+		require.NoError(t, mgr.AddSubdomain("user", "serial.mydomain.com", []net.IP{net.ParseIP("10.1.1.40")}, 0))
+		assert.Equal(t, before+1, serial())
+	})
+}
+
+// startServer starts server on random local ports until the end of the test
+// and returns the UDP and TCP addresses it listens on
+func startServer(t *testing.T, server *Server) (udp, tcp string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- server.Serve(ctx, pc, l)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-done)
+	})
+
+	return pc.LocalAddr().String(), l.Addr().String()
+}
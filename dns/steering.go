@@ -0,0 +1,133 @@
+package dns
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Target is an IP a subdomain points to, with the metadata the built-in DNS
+// server uses to steer the clients between the IPs of the subdomain.
+// If the region of a client is known and some IPs are in that region, only
+// those are answered. Then, if some of the remaining IPs have a weight, a
+// single IP is answered, picked at random in proportion to the weights.
+// An IP without weight has a weight of 1
+type Target struct {
+	IP     net.IP `json:"ip"`
+	Weight int    `json:"weight,omitempty"`
+	Region string `json:"region,omitempty"`
+}
+
+// Valid checks the target is well defined
+func (t Target) Valid() error {
+	if t.IP == nil {
+		return fmt.Errorf("target without IP")
+	}
+
+	if t.Weight < 0 || t.Weight > 65535 {
+		return fmt.Errorf("invalid weight %d for %s, it must be between 0 and 65535", t.Weight, t.IP)
+	}
+
+	if strings.ContainsAny(t.Region, " \t,") {
+		return fmt.Errorf("invalid region '%s' for %s", t.Region, t.IP)
+	}
+
+	return nil
+}
+
+func (t Target) record(ttl int) Record {
+	switch r := recordFromIP(t.IP, ttl).(type) {
+	case RecordA:
+		r.Weight, r.Region = t.Weight, t.Region
+		return r
+	case RecordAAAA:
+		r.Weight, r.Region = t.Weight, t.Region
+		return r
+	}
+	return nil
+}
+
+// AddSubdomainTargets is like AddSubdomain, with the weight and region of each IP.
+// Adding an IP again updates its weight and region
+func (c *Mgr) AddSubdomainTargets(user string, domain string, targets []Target, ttl int) error {
+	log.Info().Msgf("add subdomain %s %+v ttl %d", domain, targets, ttl)
+
+	if err := validateTTL(ttl); err != nil {
+		return err
+	}
+
+	records := make([]Record, 0, len(targets))
+	for _, target := range targets {
+		if err := target.Valid(); err != nil {
+			return err
+		}
+		records = append(records, target.record(c.ttl(ttl)))
+	}
+
+	return c.addSubdomain(user, domain, records)
+}
+
+// steer selects the A or AAAA records answered to a client in
+// region, as described by Target. region is empty if it is unknown
+func steer(records []Record, region string) []Record {
+	if len(records) < 2 {
+		return records
+	}
+
+	if region != "" {
+		var matched []Record
+		for _, r := range records {
+			if _, recordRegion := steering(r); strings.EqualFold(recordRegion, region) {
+				matched = append(matched, r)
+			}
+		}
+
+		if len(matched) > 0 {
+			records = matched
+		}
+	}
+
+	total, weighted := 0, false
+	for _, r := range records {
+		weight, _ := steering(r)
+		if weight > 0 {
+			weighted = true
+		} else {
+			weight = 1
+		}
+		total += weight
+	}
+
+	if !weighted {
+		return records
+	}
+
+	n := rand.Intn(total)
+	for _, r := range records {
+		weight, _ := steering(r)
+		if weight == 0 {
+			weight = 1
+		}
+
+		if n < weight {
+			return []Record{r}
+		}
+		n -= weight
+	}
+
+	return records
+}
+
+// steering returns the weight and region of an A or AAAA record
+func steering(r Record) (weight int, region string) {
+	switch r := r.(type) {
+	case RecordA:
+		return r.Weight, r.Region
+	case RecordAAAA:
+		return r.Weight, r.Region
+	}
+	return 0, ""
+}
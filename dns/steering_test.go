@@ -0,0 +1,155 @@
+package dns
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSteer(t *testing.T) {
+	eu1 := RecordA{IP4: "10.1.1.10", Region: "eu"}
+	eu2 := RecordA{IP4: "10.1.1.11", Region: "eu"}
+	us := RecordA{IP4: "10.2.1.10", Region: "us"}
+	records := []Record{eu1, eu2, us}
+
+	t.Run("no metadata", func(t *testing.T) {
+		plain := []Record{RecordA{IP4: "10.1.1.10"}, RecordA{IP4: "10.1.1.11"}}
+		assert.Equal(t, plain, steer(plain, "eu"))
+	})
+
+	t.Run("region", func(t *testing.T) {
+		assert.Equal(t, []Record{eu1, eu2}, steer(records, "EU"))
+		assert.Equal(t, []Record{us}, steer(records, "us"))
+	})
+
+	t.Run("unknown region", func(t *testing.T) {
+		assert.Equal(t, records, steer(records, ""))
+		assert.Equal(t, records, steer(records, "asia"))
+	})
+
+	t.Run("weights", func(t *testing.T) {
+		heavy := RecordA{IP4: "10.1.1.10", Weight: 9}
+		light := RecordA{IP4: "10.1.1.11"}
+
+		counts := make(map[Record]int)
+		for i := 0; i < 1000; i++ {
+			answer := steer([]Record{heavy, light}, "")
+			require.Len(t, answer, 1)
+			counts[answer[0]]++
+		}
+
+		assert.Greater(t, counts[light], 0)
+		assert.Greater(t, counts[heavy], 800)
+	})
+
+	t.Run("weights in region", func(t *testing.T) {
+		weighted := RecordA{IP4: "10.1.1.10", Region: "eu", Weight: 5}
+		answer := steer([]Record{weighted, us}, "eu")
+		assert.Equal(t, []Record{weighted}, answer)
+	})
+}
+
+func TestGeoIPDatabase(t *testing.T) {
+	path := writeGeoIPDatabase(t, `# network region
+10.0.0.0/8 eu
+10.2.0.0/16,us
+
+2a02:1800::/24 eu
+`)
+
+	db, err := LoadGeoIPDatabase(path)
+	require.NoError(t, err)
+
+	assert.Equal(t, "eu", db.Region(net.ParseIP("10.1.2.3")))
+	assert.Equal(t, "us", db.Region(net.ParseIP("10.2.2.3")))
+	assert.Equal(t, "eu", db.Region(net.ParseIP("2a02:1810::1")))
+	assert.Equal(t, "", db.Region(net.ParseIP("192.168.1.1")))
+	assert.Equal(t, "", db.Region(net.ParseIP("2a03::1")))
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("10.0.0.0/8\n"), 0644))
+	_, err = LoadGeoIPDatabase(path)
+	assert.Error(t, err)
+}
+
+func TestSubdomainTargets(t *testing.T) {
+	gwid := "gwid"
+	_, mgr := newTestMgr(t)
+	require.NoError(t, mgr.AddDomainDelagate("id", gwid, "gateway.tf"))
+	require.NoError(t, mgr.AddDomainDelagate("id", "user", "mydomain.com"))
+
+	targets := []Target{
+		{IP: net.ParseIP("10.1.1.10"), Region: "eu"},
+		{IP: net.ParseIP("10.2.1.10"), Region: "us"},
+	}
+	require.NoError(t, mgr.AddSubdomainTargets("user", "app.mydomain.com", targets, 0))
+
+	err := mgr.AddSubdomainTargets("user", "other.gateway.tf", []Target{{IP: net.ParseIP("10.1.1.10"), Weight: -1}}, 0)
+	assert.Error(t, err)
+
+	zr, err := mgr.getZoneRecords("mydomain.com", "app")
+	require.NoError(t, err)
+	assert.Equal(t, []Record{
+		RecordA{IP4: "10.1.1.10", TTL: defaultTTL, Region: "eu"},
+		RecordA{IP4: "10.2.1.10", TTL: defaultTTL, Region: "us"},
+	}, zr.Records[RecordTypeA])
+
+	geoip, err := LoadGeoIPDatabase(writeGeoIPDatabase(t, "10.0.0.0/8 eu\n127.0.0.0/8 us\n"))
+	require.NoError(t, err)
+
+	server := NewServer(mgr, []string{"ns1.gateway.tf"}, nil)
+	server.SetGeoIP(geoip)
+	udp, _ := startServer(t, server)
+
+	query := func(t *testing.T, subnet net.IP) []string {
+		m := new(mdns.Msg)
+		m.SetQuestion("app.mydomain.com.", mdns.TypeA)
+		if subnet != nil {
+			m.SetEdns0(4096, false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &mdns.EDNS0_SUBNET{
+				Code:          mdns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 24,
+				Address:       subnet,
+			})
+		}
+
+		resp, _, err := new(mdns.Client).Exchange(m, udp)
+		require.NoError(t, err)
+
+		var ips []string
+		for _, rr := range resp.Answer {
+			ips = append(ips, rr.(*mdns.A).A.String())
+		}
+		return ips
+	}
+
+	// the test client queries from 127.0.0.1
+	assert.Equal(t, []string{"10.2.1.10"}, query(t, nil))
+	assert.Equal(t, []string{"10.1.1.10"}, query(t, net.ParseIP("10.5.5.0").To4()))
+	assert.Equal(t, []string{"10.1.1.10", "10.2.1.10"}, query(t, net.ParseIP("192.168.1.0").To4()))
+
+	t.Run("update", func(t *testing.T) {
+		// adding an IP again to a delegated zone updates its metadata
+		require.NoError(t, mgr.AddSubdomainTargets("user", "app.mydomain.com", []Target{{IP: net.ParseIP("10.2.1.10"), Region: "eu"}}, 0))
+		assert.Equal(t, []string{"10.1.1.10", "10.2.1.10"}, query(t, net.ParseIP("10.5.5.0").To4()))
+
+		require.NoError(t, mgr.RemoveSubdomain("user", "app.mydomain.com", []net.IP{net.ParseIP("10.2.1.10")}))
+		assert.Equal(t, []string{"10.1.1.10"}, query(t, nil))
+	})
+}
+
+func writeGeoIPDatabase(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "geoip")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "regions")
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
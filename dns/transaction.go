@@ -0,0 +1,246 @@
+package dns
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/tfgateway/audit"
+)
+
+// maxTxAttempts is how many times a transaction is retried when
+// the keys it watches are modified concurrently
+const maxTxAttempts = 10
+
+type txCmd struct {
+	name string
+	args []interface{}
+}
+
+// pool is the part of redis.Pool used by the Mgr
+type pool interface {
+	Get() redis.Conn
+}
+
+// connPool always hands out the same connection. It lets a transaction
+// do all its reads on the connection that watches the keys
+type connPool struct {
+	con redis.Conn
+}
+
+func (p connPool) Get() redis.Conn {
+	return nopCloser{p.con}
+}
+
+type nopCloser struct {
+	redis.Conn
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// tx holds the writes of a transaction until they are applied all at once
+type tx struct {
+	cmds []txCmd
+	// zones holds the zones whose records are changed by the transaction,
+	// their serial is incremented when the transaction is applied
+	zones map[string]struct{}
+}
+
+func (t *tx) send(name string, args ...interface{}) {
+	t.cmds = append(t.cmds, txCmd{name: name, args: args})
+}
+
+func (t *tx) setZoneRecords(zone, name string, zr Zone) error {
+	b, err := json.Marshal(zr.Records)
+	if err != nil {
+		return err
+	}
+
+	t.send("HSET", zoneKey(zone), name, b)
+	t.changeZone(zone)
+	return nil
+}
+
+func (t *tx) deleteZoneRecords(zone, name string) {
+	t.send("HDEL", zoneKey(zone), name)
+	t.changeZone(zone)
+}
+
+func (t *tx) changeZone(zone string) {
+	if t.zones == nil {
+		t.zones = make(map[string]struct{})
+	}
+	t.zones[strings.TrimSuffix(zone, ".")] = struct{}{}
+}
+
+func (t *tx) setZoneOwner(zone string, owner ZoneOwner) error {
+	b, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+
+	t.send("HSET", "zone", zone, b)
+	return nil
+}
+
+func (t *tx) setSubdomainOwner(domain, user string) {
+	t.send("HSET", "managed_domains", domain, user)
+}
+
+func (t *tx) deleteSubdomainOwner(domain string) {
+	t.send("HDEL", "managed_domains", domain)
+	t.send("HDEL", transfersKey, domain)
+}
+
+func (t *tx) setFormerOwners(domain string, users []string) error {
+	if len(users) == 0 {
+		t.send("HDEL", transfersKey, domain)
+		return nil
+	}
+
+	b, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+
+	t.send("HSET", transfersKey, domain, b)
+	return nil
+}
+
+func (t *tx) commands() []audit.Command {
+	cmds := make([]audit.Command, 0, len(t.cmds))
+	for _, cmd := range t.cmds {
+		cmds = append(cmds, audit.Command{Name: cmd.name, Args: cmd.args})
+	}
+	return cmds
+}
+
+// atomic applies the writes queued by fn in a single redis transaction.
+// keys are watched before fn is called, if any of them is modified before
+// the writes are applied, fn is called again with the new state.
+// fn must only read the state with r and queue its writes in t.
+// The writes are recorded in the audit log
+func (c *Mgr) atomic(fn func(r *Mgr, t *tx) error, keys ...string) error {
+	con := c.redis.Get()
+	defer con.Close()
+
+	r := *c
+	r.redis = connPool{con}
+
+	for i := 0; i < maxTxAttempts; i++ {
+		if len(keys) > 0 {
+			if _, err := con.Do("WATCH", redis.Args{}.AddFlat(keys)...); err != nil {
+				return errors.Wrap(err, "failed to watch keys")
+			}
+		}
+
+		var t tx
+		err := fn(&r, &t)
+		var entries []audit.Entry
+		if err == nil {
+			entries, err = c.audit.Prepare(con, c.actor, t.commands()...)
+		}
+
+		if err != nil {
+			if _, err := con.Do("UNWATCH"); err != nil {
+				log.Error().Err(err).Msg("failed to unwatch keys")
+			}
+			return err
+		}
+
+		if err := con.Send("MULTI"); err != nil {
+			return err
+		}
+		for _, cmd := range t.cmds {
+			if err := con.Send(cmd.name, cmd.args...); err != nil {
+				return err
+			}
+		}
+		for zone := range t.zones {
+			if err := con.Send("HINCRBY", zoneSerialKey, zone, 1); err != nil {
+				return err
+			}
+		}
+
+		replies, err := redis.Values(con.Do("EXEC"))
+		if errors.Is(err, redis.ErrNil) {
+			log.Debug().Strs("keys", keys).Msg("concurrent modification, retrying transaction")
+			continue
+		} else if err != nil {
+			return errors.Wrap(err, "failed to execute transaction")
+		}
+
+		for _, reply := range replies {
+			if err, ok := reply.(redis.Error); ok {
+				return errors.Wrap(err, "failed to execute transaction")
+			}
+		}
+
+		c.audit.Commit(entries)
+		return nil
+	}
+
+	return ErrConflict
+}
+
+// apply applies the writes queued by fn in a single redis transaction,
+// for the writes that do not depend on the current state
+func (c *Mgr) apply(fn func(t *tx) error) error {
+	return c.atomic(func(_ *Mgr, t *tx) error {
+		return fn(t)
+	})
+}
+
+// updateZoneRecords atomically applies update to the records of name in zone.
+// The name is removed from the zone if update leaves it without records
+func (c *Mgr) updateZoneRecords(zone, name string, update func(zr *Zone) error) error {
+	return c.atomic(func(r *Mgr, t *tx) error {
+		zr, err := r.getZoneRecords(zone, name)
+		if err != nil {
+			return err
+		}
+
+		if err := update(&zr); err != nil {
+			return err
+		}
+
+		if err := zr.checkCNAME(); err != nil {
+			return errors.Wrapf(err, "cannot update records of %s", name)
+		}
+
+		if zr.Records.IsEmpty() {
+			t.deleteZoneRecords(zone, name)
+			return nil
+		}
+
+		return t.setZoneRecords(zone, name, zr)
+	}, zoneKey(zone))
+}
+
+// zoneSerial returns the serial of zone, which is incremented
+// every time the records of the zone change
+func (c *Mgr) zoneSerial(zone string) (uint32, error) {
+	con := c.redis.Get()
+	defer con.Close()
+
+	serial, err := redis.Uint64(con.Do("HGET", zoneSerialKey, strings.TrimSuffix(zone, ".")))
+	if errors.Is(err, redis.ErrNil) {
+		return 0, nil
+	} else if err != nil {
+		return 0, errors.Wrapf(err, "failed to read the serial of zone %s", zone)
+	}
+
+	return uint32(serial), nil
+}
+
+// zoneKey returns the key of the hash holding the records of zone
+func zoneKey(zone string) string {
+	if zone[len(zone)-1] != '.' {
+		zone += "."
+	}
+	return zone
+}
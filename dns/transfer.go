@@ -0,0 +1,271 @@
+package dns
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// transfersKey is the redis hash holding, for each domain transferred to another
+// user, the users it has been transferred from as a JSON list. The reservations
+// of these users still hold the domain until they are decommissioned
+const transfersKey = "tfgateway_transfers"
+
+// TxHook lets another component take part in a transaction of the Mgr.
+// It reads and watches the keys it needs with con and queues its writes
+// with send, they are applied together with the writes of the Mgr
+type TxHook func(con redis.Conn, send func(cmd string, args ...interface{})) error
+
+// TransferDomain transfers domain from user from to user to.
+// If domain is a zone delegated by from, the zone and all the subdomains
+// reserved by from inside the zone are transferred. If domain is a subdomain
+// of a zone managed by the gateway, the subdomain and its wildcard are transferred.
+// The subdomains of a delegated zone always belong to the owner of the zone,
+// they can only be transferred with the zone.
+// The records and health checks of the transferred names are removed, the new
+// owner publishes its own records when it deploys its reservations of the names.
+// The hooks are applied in the same transaction, so the proxies of domain
+// can change owner at the same time
+func (c *Mgr) TransferDomain(from, to, domain string, hooks ...TxHook) error {
+	log.Info().Msgf("transfer %s from %s to %s", domain, from, to)
+
+	if err := validateDomain(domain); err != nil {
+		return err
+	}
+
+	if IsWildcard(domain) {
+		return fmt.Errorf("cannot transfer wildcard %s, transfer %s instead", domain, strings.TrimPrefix(domain, WildcardPrefix))
+	}
+
+	if to == "" || to == from {
+		return fmt.Errorf("invalid new owner '%s' for %s", to, domain)
+	}
+
+	_, zone, _, err := c.locateDomain(domain)
+	if err != nil {
+		return err
+	}
+
+	return c.atomic(func(r *Mgr, t *tx) error {
+		name, zone, owner, err := r.locateDomain(domain)
+		if err != nil {
+			return err
+		}
+
+		subdomains, err := r.Subdomains()
+		if err != nil {
+			return err
+		}
+
+		if name == apex && owner.Owner != c.identity {
+			err = r.transferZone(t, from, to, zone, owner, subdomains)
+		} else if owner.Owner == c.identity {
+			err = r.transferSubdomain(t, from, to, zone, name, domain, subdomains)
+		} else {
+			err = errors.Wrapf(ErrAuth, "cannot transfer %s, it belongs to the owner of zone %s", domain, zone)
+		}
+		if err != nil {
+			return err
+		}
+
+		con := r.redis.Get()
+		defer con.Close()
+		for _, hook := range hooks {
+			if err := hook(con, t.send); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, "zone", "managed_domains", transfersKey, zoneKey(zone), healthChecksKey, unhealthyRecordsKey)
+}
+
+func (c *Mgr) transferZone(t *tx, from, to, zone string, owner ZoneOwner, subdomains map[string]string) error {
+	if owner.Owner != from {
+		return errors.Wrapf(ErrAuth, "cannot transfer zone %s", zone)
+	}
+
+	owner.Owner = to
+	if err := t.setZoneOwner(zone, owner); err != nil {
+		return err
+	}
+
+	records, err := ownerTXTRecord(c.identity, to)
+	if err != nil {
+		return err
+	}
+	if err := t.setZoneRecords(zone, ownerName, records); err != nil {
+		return err
+	}
+
+	// all the records of a delegated zone belong to its owner
+	names, err := c.zoneNames(zone)
+	if err != nil {
+		return err
+	}
+	for name := range names {
+		if name != ownerName {
+			t.deleteZoneRecords(zone, name)
+		}
+	}
+
+	for subdomain, user := range subdomains {
+		base := strings.TrimPrefix(subdomain, WildcardPrefix)
+		if user != from || (base != zone && !strings.HasSuffix(base, "."+zone)) {
+			continue
+		}
+
+		// the subdomain can be in a zone delegated inside this zone
+		_, subzone, _, err := c.findZone(base)
+		if err != nil {
+			return err
+		}
+
+		if subzone == zone {
+			t.setSubdomainOwner(subdomain, to)
+			t.deleteHealthCheck(subdomain)
+			if err := c.recordTransfer(t, subdomain, from, to); err != nil {
+				return err
+			}
+		}
+	}
+
+	return c.recordTransfer(t, zone, from, to)
+}
+
+func (c *Mgr) transferSubdomain(t *tx, from, to, zone, name, domain string, subdomains map[string]string) error {
+	if subdomains[domain] != from {
+		return errors.Wrapf(ErrAuth, "cannot transfer subdomain %s", domain)
+	}
+
+	t.setSubdomainOwner(domain, to)
+	t.deleteZoneRecords(zone, name)
+	t.deleteHealthCheck(domain)
+	if subdomains[WildcardPrefix+domain] == from {
+		t.setSubdomainOwner(WildcardPrefix+domain, to)
+		t.deleteZoneRecords(zone, wildcardName(name))
+		t.deleteHealthCheck(WildcardPrefix + domain)
+		if err := c.recordTransfer(t, WildcardPrefix+domain, from, to); err != nil {
+			return err
+		}
+	}
+
+	return c.recordTransfer(t, domain, from, to)
+}
+
+// recordTransfer records that domain was transferred from user from to user to.
+// The reservation of from still holds domain until it is decommissioned, see ReleaseTransfer
+func (c *Mgr) recordTransfer(t *tx, domain, from, to string) error {
+	users, err := c.formerOwners(domain)
+	if err != nil {
+		return err
+	}
+
+	// a domain transferred back to a former owner is owned by it again
+	users = append(removeUser(users, from, to), from)
+	return t.setFormerOwners(domain, users)
+}
+
+// ReleaseTransfer releases the hold the reservation of user has on domain
+// after user transferred domain to another user. It is called when the
+// reservation of user is decommissioned, instead of removing domain.
+// It returns false if domain has not been transferred from user.
+// Once the reservation of the former owner is gone, domain is only kept if
+// the new owner deployed its own reservation for it
+func (c *Mgr) ReleaseTransfer(user, domain string) (bool, error) {
+	var released bool
+	err := c.atomic(func(r *Mgr, t *tx) error {
+		users, err := r.formerOwners(domain)
+		if err != nil {
+			return err
+		}
+
+		released = containsUser(users, user)
+		if !released {
+			return nil
+		}
+
+		log.Info().Msgf("release the reservation of %s on transferred domain %s", user, domain)
+		return t.setFormerOwners(domain, removeUser(users, user))
+	}, transfersKey)
+
+	return released, err
+}
+
+// Transfers returns the domains transferred to another user together
+// with the former owners whose reservations still hold them
+func (c *Mgr) Transfers() (map[string][]string, error) {
+	con := c.redis.Get()
+	defer con.Close()
+
+	values, err := redis.StringMap(con.Do("HGETALL", transfersKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list transferred domains")
+	}
+
+	transfers := make(map[string][]string, len(values))
+	for domain, value := range values {
+		var users []string
+		if err := json.Unmarshal([]byte(value), &users); err != nil {
+			return nil, errors.Wrapf(err, "invalid former owners of %s", domain)
+		}
+		transfers[domain] = users
+	}
+
+	return transfers, nil
+}
+
+// formerOwners returns the users domain has been transferred from
+func (c *Mgr) formerOwners(domain string) ([]string, error) {
+	con := c.redis.Get()
+	defer con.Close()
+
+	value, err := redis.Bytes(con.Do("HGET", transfersKey, domain))
+	if errors.Is(err, redis.ErrNil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the former owners of %s", domain)
+	}
+
+	var users []string
+	if err := json.Unmarshal(value, &users); err != nil {
+		return nil, errors.Wrapf(err, "invalid former owners of %s", domain)
+	}
+	return users, nil
+}
+
+// adoptable returns true if domain, reserved by user, has been transferred to
+// user. user can then deploy its own reservation of domain, which takes over
+// the reservation of the former owner
+func (c *Mgr) adoptable(user, domain string) (bool, error) {
+	owner, err := c.getSubdomainOwner(domain)
+	if err != nil || owner != user {
+		return false, err
+	}
+
+	users, err := c.formerOwners(domain)
+	return len(users) > 0, err
+}
+
+func containsUser(users []string, user string) bool {
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func removeUser(users []string, remove ...string) []string {
+	kept := users[:0:0]
+	for _, u := range users {
+		if !containsUser(remove, u) {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,115 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	redigo "github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransferDomain(t *testing.T) {
+	gwid := "gwid"
+	s, mgr := newTestMgr(t)
+
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+	require.NoError(t, mgr.AddDomainDelagate(gwid, gwid, "gateway.tf"))
+	require.NoError(t, mgr.AddDomainDelagate(gwid, "user", "example.com"))
+	require.NoError(t, mgr.AddDomainDelagate(gwid, "user", "dev.example.com"))
+	require.NoError(t, mgr.AddSubdomain("user", "www.example.com", ips, 0))
+	require.NoError(t, mgr.AddSubdomain("user", "www.dev.example.com", ips, 0))
+	require.NoError(t, mgr.AddSubdomain("user", "app.gateway.tf", ips, 0))
+	require.NoError(t, mgr.AddSubdomain("user", "*.app.gateway.tf", ips, 0))
+
+	t.Run("errors", func(t *testing.T) {
+		err := mgr.TransferDomain("user2", "user3", "example.com")
+		assert.True(t, errors.Is(err, ErrAuth), "only the owner can transfer a zone")
+
+		err = mgr.TransferDomain("user2", "user3", "app.gateway.tf")
+		assert.True(t, errors.Is(err, ErrAuth), "only the owner can transfer a subdomain")
+
+		err = mgr.TransferDomain("user", "user2", "www.example.com")
+		assert.True(t, errors.Is(err, ErrAuth), "subdomains of delegated zones are transferred with the zone")
+
+		err = mgr.TransferDomain(gwid, "user2", "gateway.tf")
+		assert.True(t, errors.Is(err, ErrAuth), "managed zones cannot be transferred")
+
+		err = mgr.TransferDomain("user", "user", "example.com")
+		assert.Error(t, err)
+
+		err = mgr.TransferDomain("user", "user2", "unknown.com")
+		assert.Error(t, err)
+	})
+
+	t.Run("zone", func(t *testing.T) {
+		hooked := false
+		err := mgr.TransferDomain("user", "user2", "example.com", func(con redigo.Conn, send func(string, ...interface{})) error {
+			hooked = true
+			send("SET", "hook", "applied")
+			return nil
+		})
+		require.NoError(t, err)
+		assert.True(t, hooked)
+		value, err := s.Get("hook")
+		require.NoError(t, err)
+		assert.Equal(t, "applied", value)
+
+		owner, err := mgr.getZoneOwner("example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "user2", owner.Owner)
+
+		zr, err := mgr.getZoneRecords("example.com", ownerName)
+		require.NoError(t, err)
+		assert.Contains(t, zr.Records[RecordTypeTXT][0].(RecordTXT).Text, `"owner":"user2"`)
+
+		subdomains, err := mgr.Subdomains()
+		require.NoError(t, err)
+		assert.Equal(t, "user2", subdomains["www.example.com"])
+		assert.Equal(t, "user", subdomains["www.dev.example.com"], "zones delegated inside the zone are not transferred")
+
+		owner, err = mgr.getZoneOwner("dev.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "user", owner.Owner)
+
+		// the records of the former owner are removed, not those of the nested zone
+		assert.Empty(t, s.HGet("example.com.", "www"))
+		assert.NotEmpty(t, s.HGet("dev.example.com.", "www"))
+
+		require.NoError(t, mgr.AddSubdomain("user2", "blog.example.com", ips, 0))
+	})
+
+	t.Run("subdomain", func(t *testing.T) {
+		err := mgr.TransferDomain("user", "user2", "app.gateway.tf")
+		require.NoError(t, err)
+
+		subdomains, err := mgr.Subdomains()
+		require.NoError(t, err)
+		assert.Equal(t, "user2", subdomains["app.gateway.tf"])
+		assert.Equal(t, "user2", subdomains["*.app.gateway.tf"])
+		assert.Empty(t, s.HGet("gateway.tf.", "app"))
+		assert.Empty(t, s.HGet("gateway.tf.", "*.app"))
+
+		// only the records of the new owner are published once it reserves the subdomain again
+		newIPs := []net.IP{net.ParseIP("10.1.1.20")}
+		require.NoError(t, mgr.AddSubdomain("user2", "app.gateway.tf", newIPs, 0))
+		zr, err := mgr.getZoneRecords("gateway.tf", "app")
+		require.NoError(t, err)
+		assert.Equal(t, []Record{RecordA{IP4: "10.1.1.20", TTL: defaultTTL}}, zr.Records[RecordTypeA])
+
+		require.NoError(t, mgr.RemoveSubdomain("user2", "app.gateway.tf", newIPs))
+	})
+
+	t.Run("hook error", func(t *testing.T) {
+		err := mgr.TransferDomain("user", "user2", "dev.example.com", func(con redigo.Conn, send func(string, ...interface{})) error {
+			return fmt.Errorf("hook failed")
+		})
+		assert.Error(t, err)
+
+		owner, err := mgr.getZoneOwner("dev.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, "user", owner.Owner, "nothing is written if a hook fails")
+	})
+}
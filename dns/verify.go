@@ -0,0 +1,57 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+)
+
+// challengeLabel is the label under which the TXT challenge of a domain is looked for
+const challengeLabel = "_tfgateway"
+
+// Resolver looks up the public DNS records of a domain
+// net.Resolver implements this interface
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DelegationVerifier makes sure a user controls a domain before it can be
+// delegated to the gateway. A domain is verified if it holds the TXT challenge
+// of the user. The NS records of the domain are not enough, they do not tell
+// which user the domain belongs to
+type DelegationVerifier struct {
+	resolver Resolver
+}
+
+// NewDelegationVerifier creates a DelegationVerifier
+func NewDelegationVerifier(resolver Resolver) *DelegationVerifier {
+	return &DelegationVerifier{resolver: resolver}
+}
+
+// Challenge returns the TXT record a user needs to create to prove he controls domain
+func Challenge(user, domain string) (name, text string) {
+	return fmt.Sprintf("%s.%s", challengeLabel, domain), fmt.Sprintf("tfgateway=%s", user)
+}
+
+// Verify checks that user controls domain. It returns an error wrapping
+// ErrDelegationNotVerified with the steps the user needs to take if not
+func (v *DelegationVerifier) Verify(ctx context.Context, user, domain string) error {
+	name, text := Challenge(user, domain)
+	txts, err := v.resolver.LookupTXT(ctx, name)
+	if err == nil {
+		for _, txt := range txts {
+			if txt == text {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: a TXT record %s with value '%s' must exist (txt lookup: %v)",
+		ErrDelegationNotVerified, name, text, errOrNone(err))
+}
+
+func errOrNone(err error) string {
+	if err == nil {
+		return "none"
+	}
+	return err.Error()
+}
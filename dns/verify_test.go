@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeResolver struct {
+	txt map[string][]string
+}
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	txts, ok := r.txt[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return txts, nil
+}
+
+func TestDelegationVerifier(t *testing.T) {
+	resolver := fakeResolver{
+		txt: map[string][]string{
+			"_tfgateway.other.com": {"v=spf1", "tfgateway=user"},
+		},
+	}
+
+	verifier := NewDelegationVerifier(resolver)
+	ctx := context.Background()
+
+	tt := []struct {
+		name   string
+		user   string
+		domain string
+		ok     bool
+	}{
+		// the NS records do not prove which user the domain belongs to
+		{"NS delegated", "user", "delegated.com", false},
+		{"TXT challenge", "user", "other.com", true},
+		{"TXT challenge of other user", "user2", "other.com", false},
+		{"unknown domain", "user", "unknown.com", false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := verifier.Verify(ctx, tc.user, tc.domain)
+			if tc.ok {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, ErrDelegationNotVerified))
+			assert.Contains(t, err.Error(), "_tfgateway."+tc.domain)
+		})
+	}
+}
@@ -0,0 +1,332 @@
+package dns
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	mdns "github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+// ExportZone writes all the records of zone to w in the RFC 1035 master file format
+func (c *Mgr) ExportZone(zone string, w io.Writer) error {
+	zone = strings.TrimSuffix(zone, ".")
+
+	names, err := c.zoneNames(zone)
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		return fmt.Errorf("zone %s does not exist", zone)
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return exportOrder(sorted[i]) < exportOrder(sorted[j])
+	})
+
+	buf := bufio.NewWriter(w)
+	fmt.Fprintf(buf, "$ORIGIN %s\n", mdns.Fqdn(zone))
+
+	for _, name := range sorted {
+		zr, err := c.getZoneRecords(zone, name)
+		if err != nil {
+			return err
+		}
+
+		owner := mdns.Fqdn(zone)
+		if name != apex {
+			owner = mdns.Fqdn(name + "." + zone)
+		}
+
+		var rrs []mdns.RR
+		for _, records := range zr.Records {
+			for _, r := range records {
+				if rr := toRR(owner, r); rr != nil {
+					rrs = append(rrs, rr)
+				}
+			}
+		}
+		sort.Slice(rrs, func(i, j int) bool {
+			return rrs[i].String() < rrs[j].String()
+		})
+
+		for _, rr := range rrs {
+			fmt.Fprintln(buf, rr.String())
+		}
+	}
+
+	return buf.Flush()
+}
+
+// exportOrder sorts the apex of the zone first
+func exportOrder(name string) string {
+	if name == apex {
+		return ""
+	}
+	return name
+}
+
+// ImportZone reads a zone file in the RFC 1035 master file format from r and
+// stores its records into zone. zone needs to be a domain delegated by user.
+// The records of each name present in the file replace the existing records
+// of that name, other names are left untouched. SOA, NS of the apex and DNSSEC
+// records are ignored since they are generated by the gateway. The records are
+// validated like the records added one by one and their TTL is clamped the same way.
+// The NS records of the other names follow the rules of AddSubdomainDelegation
+func (c *Mgr) ImportZone(user, zone string, r io.Reader) error {
+	zone = strings.TrimSuffix(zone, ".")
+
+	if err := c.authorizeImport(user, zone); err != nil {
+		return err
+	}
+
+	zones := make(map[string]*Zone)
+	parser := mdns.NewZoneParser(r, mdns.Fqdn(zone), "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		fqdn := strings.ToLower(rr.Header().Name)
+		if !mdns.IsSubDomain(mdns.Fqdn(zone), fqdn) {
+			return fmt.Errorf("record %s is outside of zone %s", fqdn, zone)
+		}
+
+		name := relativeName(fqdn, zone)
+		if name == ownerName {
+			continue
+		}
+
+		record, err := fromRR(rr)
+		if err != nil {
+			return err
+		}
+
+		if record == nil || (name == apex && record.Type() == RecordTypeNS) {
+			continue
+		}
+
+		record, err = c.importRecord(strings.TrimSuffix(fqdn, "."), record)
+		if err != nil {
+			return errors.Wrapf(err, "cannot import records of %s", fqdn)
+		}
+
+		zr, ok := zones[name]
+		if !ok {
+			zr = &Zone{}
+			zones[name] = zr
+		}
+		zr.Add(record)
+	}
+
+	if err := parser.Err(); err != nil {
+		return errors.Wrap(err, "failed to parse zone file")
+	}
+
+	if len(zones) == 0 {
+		return nil
+	}
+
+	for name, zr := range zones {
+		if err := zr.checkCNAME(); err != nil {
+			return errors.Wrapf(err, "cannot import records of %s", name)
+		}
+	}
+
+	if err := c.checkImportedDelegations(user, zone, zones); err != nil {
+		return err
+	}
+
+	// the zone is watched so the import cannot overwrite concurrent changes
+	err := c.atomic(func(r *Mgr, t *tx) error {
+		if err := r.authorizeImport(user, zone); err != nil {
+			return err
+		}
+
+		for name, zr := range zones {
+			if err := t.setZoneRecords(zone, name, *zr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, "zone", zoneKey(zone))
+	if err != nil {
+		return errors.Wrapf(err, "failed to import records of zone %s", zone)
+	}
+
+	return nil
+}
+
+// authorizeImport checks that zone is a domain delegated by user
+func (c *Mgr) authorizeImport(user, zone string) error {
+	owner, err := c.getZoneOwner(zone)
+	if err != nil {
+		return err
+	}
+
+	if owner.Owner == "" {
+		return fmt.Errorf("%s is not managed by the gateway. delegate the domain first", zone)
+	}
+
+	if err := owner.refuseReverse(zone); err != nil {
+		return err
+	}
+
+	if owner.Owner == c.identity || owner.Owner != user {
+		return errors.Wrapf(ErrAuth, "cannot import records into zone %s", zone)
+	}
+
+	return nil
+}
+
+// checkImportedDelegations checks the names of zone delegated with NS records
+// like AddSubdomainDelegation does: the names are only delegated with NS records,
+// the nameservers inside a delegated name have glue records and the other names
+// beneath a delegated name only hold these glue records
+func (c *Mgr) checkImportedDelegations(user, zone string, zones map[string]*Zone) error {
+	for name, zr := range zones {
+		nameservers, ok := zr.Records[RecordTypeNS]
+		if !ok {
+			continue
+		}
+
+		domain := absoluteName(name, zone)
+		if IsWildcard(domain) {
+			return fmt.Errorf("cannot delegate wildcard %s", domain)
+		}
+
+		if len(zr.Records) != 1 {
+			return errors.Wrapf(ErrSubdomainUsed, "cannot delegate subdomain %s, it has other records than NS", domain)
+		}
+
+		_, nsZone, err := c.authorizeSubdomainDelegation(user, domain)
+		if err != nil {
+			return err
+		}
+		if nsZone != zone {
+			return errors.Wrapf(ErrAuth, "cannot delegate %s, it is inside zone %s", domain, nsZone)
+		}
+
+		for _, record := range nameservers {
+			host := record.(RecordNS).Host
+			if host == domain {
+				return fmt.Errorf("nameserver host '%s' is invalid", host)
+			}
+
+			if !strings.HasSuffix(host, "."+domain) {
+				continue
+			}
+
+			glue, ok := zones[strings.TrimSuffix(host, "."+zone)]
+			if !ok || len(glue.Records[RecordTypeA])+len(glue.Records[RecordTypeAAAA]) == 0 {
+				return fmt.Errorf("nameserver %s is inside %s, glue IPs are required", host, domain)
+			}
+		}
+
+		for other, records := range zones {
+			if !strings.HasSuffix(other, "."+name) {
+				continue
+			}
+
+			for typ := range records.Records {
+				if typ != RecordTypeA && typ != RecordTypeAAAA {
+					return errors.Wrapf(ErrSubdomainUsed, "cannot import records of %s, it is beneath delegated subdomain %s", absoluteName(other, zone), domain)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// importRecord validates a record of domain read from a zone file like the
+// records added one by one, and clamps its TTL to the range of the gateway
+func (c *Mgr) importRecord(domain string, r Record) (Record, error) {
+	switch r := r.(type) {
+	case RecordA:
+		r.TTL = c.ttl(r.TTL)
+		return r, nil
+	case RecordAAAA:
+		r.TTL = c.ttl(r.TTL)
+		return r, nil
+	case RecordCname:
+		return cnameRecord(domain, r.Host, c.ttl(r.TTL))
+	case RecordTXT:
+		r.TTL = c.ttl(r.TTL)
+		return r, nil
+	case RecordMX:
+		if err := validateMX(r); err != nil {
+			return nil, err
+		}
+		r.TTL = c.ttl(r.TTL)
+		return r, nil
+	case RecordSRV:
+		if err := validateSRV(r); err != nil {
+			return nil, err
+		}
+		r.TTL = c.ttl(r.TTL)
+		return r, nil
+	case RecordCAA:
+		if err := validateCAA(r); err != nil {
+			return nil, err
+		}
+		r.TTL = c.ttl(r.TTL)
+		return r, nil
+	case RecordNS:
+		if !govalidator.IsDNSName(r.Host) {
+			return nil, fmt.Errorf("nameserver host '%s' is invalid", r.Host)
+		}
+		r.TTL = c.ttl(r.TTL)
+		return r, nil
+	case RecordPTR:
+		if !govalidator.IsDNSName(r.Host) {
+			return nil, fmt.Errorf("PTR host '%s' is invalid", r.Host)
+		}
+		r.TTL = c.ttl(r.TTL)
+		return r, nil
+	}
+
+	return nil, fmt.Errorf("record type %s is not supported", r.Type())
+}
+
+// fromRR converts rr to a Record. It returns a nil Record for
+// the records generated by the gateway
+func fromRR(rr mdns.RR) (Record, error) {
+	ttl := int(rr.Header().Ttl)
+
+	switch rr := rr.(type) {
+	case *mdns.A:
+		return RecordA{IP4: rr.A.String(), TTL: ttl}, nil
+	case *mdns.AAAA:
+		return RecordAAAA{IP6: rr.AAAA.String(), TTL: ttl}, nil
+	case *mdns.CNAME:
+		return RecordCname{Host: strings.TrimSuffix(rr.Target, "."), TTL: ttl}, nil
+	case *mdns.TXT:
+		return RecordTXT{Text: strings.Join(rr.Txt, ""), TTL: ttl}, nil
+	case *mdns.MX:
+		return RecordMX{Host: strings.TrimSuffix(rr.Mx, "."), Preference: int(rr.Preference), TTL: ttl}, nil
+	case *mdns.SRV:
+		return RecordSRV{
+			Priority: int(rr.Priority),
+			Weight:   int(rr.Weight),
+			Port:     int(rr.Port),
+			Target:   strings.TrimSuffix(rr.Target, "."),
+			TTL:      ttl,
+		}, nil
+	case *mdns.CAA:
+		return RecordCAA{Flag: int(rr.Flag), Tag: rr.Tag, Value: rr.Value, TTL: ttl}, nil
+	case *mdns.NS:
+		return RecordNS{Host: strings.TrimSuffix(rr.Ns, "."), TTL: ttl}, nil
+	case *mdns.PTR:
+		return RecordPTR{Host: strings.TrimSuffix(rr.Ptr, "."), TTL: ttl}, nil
+	case *mdns.SOA, *mdns.DNSKEY, *mdns.RRSIG, *mdns.NSEC, *mdns.NSEC3, *mdns.NSEC3PARAM:
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("record %s: type %s is not supported", rr.Header().Name, mdns.TypeToString[rr.Header().Rrtype])
+}
@@ -0,0 +1,147 @@
+package dns
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestZoneFile(t *testing.T) {
+	gwid := "gwid"
+	_, mgr := newTestMgr(t)
+
+	require.NoError(t, mgr.AddDomainDelagate(gwid, gwid, "gateway.tf"))
+	require.NoError(t, mgr.AddDomainDelagate(gwid, "user", "mydomain.com"))
+	require.NoError(t, mgr.AddDomainDelagate(gwid, "user", "newdomain.com"))
+	require.NoError(t, mgr.AddSubdomain("user", "www.mydomain.com", []net.IP{net.ParseIP("10.1.1.10")}, 0))
+	require.NoError(t, mgr.AddMX("user", "mydomain.com", []RecordMX{{Host: "mail.mydomain.com", Preference: 10, TTL: 3600}}))
+	require.NoError(t, mgr.AddSRV("user", "_sip", "_tcp", "mydomain.com", []RecordSRV{{Priority: 1, Weight: 1, Port: 5060, Target: "sip.mydomain.com", TTL: 3600}}))
+
+	t.Run("export", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, mgr.ExportZone("mydomain.com", &buf))
+
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		require.Len(t, lines, 5)
+		assert.Equal(t, "$ORIGIN mydomain.com.", lines[0])
+		assert.Contains(t, lines[1], "mydomain.com.\t3600\tIN\tMX\t10 mail.mydomain.com.")
+		assert.Contains(t, buf.String(), "__owner__.mydomain.com.\t600\tIN\tTXT")
+		assert.Contains(t, buf.String(), "_sip._tcp.mydomain.com.\t3600\tIN\tSRV\t1 1 5060 sip.mydomain.com.")
+		assert.Contains(t, buf.String(), "www.mydomain.com.\t3600\tIN\tA\t10.1.1.10")
+
+		err := mgr.ExportZone("unknown.com", &buf)
+		assert.Error(t, err)
+	})
+
+	t.Run("import", func(t *testing.T) {
+		file := `$ORIGIN newdomain.com.
+$TTL 300
+@       IN SOA ns1.gateway.tf. hostmaster.newdomain.com. 1 3600 600 86400 300
+@       IN NS  ns1.gateway.tf.
+@       IN MX  10 mail
+@       IN CAA 0 issue "letsencrypt.org"
+www     IN A   10.1.1.10
+www     IN A   10.1.1.11
+blog    IN CNAME www
+dev     IN NS  ns1.dev
+ns1.dev IN A   10.1.1.20
+*.apps  IN AAAA 2a02:2788:864:1314:9eb6:d0ff:fe97:764b
+__owner__ IN TXT "forged"
+`
+		require.NoError(t, mgr.ImportZone("user", "newdomain.com", strings.NewReader(file)))
+
+		names, err := mgr.zoneNames("newdomain.com")
+		require.NoError(t, err)
+		assert.Len(t, names, 7)
+		// the apex is stored under the same name as with AddSubdomain and AddMX
+		assert.Contains(t, names, apex)
+		assert.NotContains(t, names, "")
+
+		zr, err := mgr.getZoneRecords("newdomain.com", apex)
+		require.NoError(t, err)
+		assert.Equal(t, []Record{RecordMX{Host: "mail.newdomain.com", Preference: 10, TTL: 300}}, zr.Records[RecordTypeMX])
+		assert.Len(t, zr.Records[RecordTypeCAA], 1)
+		assert.NotContains(t, zr.Records, RecordTypeNS)
+
+		zr, err = mgr.getZoneRecords("newdomain.com", "www")
+		require.NoError(t, err)
+		assert.Len(t, zr.Records[RecordTypeA], 2)
+
+		zr, err = mgr.getZoneRecords("newdomain.com", "dev")
+		require.NoError(t, err)
+		assert.Equal(t, []Record{RecordNS{Host: "ns1.dev.newdomain.com", TTL: 300}}, zr.Records[RecordTypeNS])
+
+		zr, err = mgr.getZoneRecords("newdomain.com", "*.apps")
+		require.NoError(t, err)
+		assert.Len(t, zr.Records[RecordTypeAAAA], 1)
+
+		zr, err = mgr.getZoneRecords("newdomain.com", ownerName)
+		require.NoError(t, err)
+		assert.Contains(t, zr.Records[RecordTypeTXT][0].(RecordTXT).Text, `"owner":"user"`)
+	})
+
+	t.Run("import errors", func(t *testing.T) {
+		file := "www IN A 10.1.1.10\n"
+
+		err := mgr.ImportZone("user2", "newdomain.com", strings.NewReader(file))
+		assert.True(t, errors.Is(err, ErrAuth))
+
+		err = mgr.ImportZone(gwid, "gateway.tf", strings.NewReader(file))
+		assert.True(t, errors.Is(err, ErrAuth), "managed domains cannot be imported")
+
+		err = mgr.ImportZone("user", "unknown.com", strings.NewReader(file))
+		assert.Error(t, err)
+
+		err = mgr.ImportZone("user", "newdomain.com", strings.NewReader("www.other.com. IN A 10.1.1.10\n"))
+		assert.Error(t, err, "records outside of the zone")
+
+		err = mgr.ImportZone("user", "newdomain.com", strings.NewReader("www IN HINFO cpu os\n"))
+		assert.Error(t, err, "unsupported record type")
+
+		err = mgr.ImportZone("user", "newdomain.com", strings.NewReader("www IN A not-an-ip\n"))
+		assert.Error(t, err, "invalid zone file")
+
+		err = mgr.ImportZone("user", "newdomain.com", strings.NewReader("@ IN CAA 0 tbs \"value\"\n"))
+		assert.Error(t, err, "invalid CAA tag")
+
+		err = mgr.ImportZone("user", "newdomain.com", strings.NewReader("www IN CNAME www\n"))
+		assert.Error(t, err, "CNAME to itself")
+	})
+
+	t.Run("import delegations", func(t *testing.T) {
+		err := mgr.ImportZone("user", "newdomain.com", strings.NewReader("lab IN NS ns1.lab\n"))
+		assert.Error(t, err, "nameserver inside the delegated name without glue")
+
+		err = mgr.ImportZone("user", "newdomain.com", strings.NewReader("lab IN NS ns1.other.com.\nlab IN A 10.1.1.10\n"))
+		assert.True(t, errors.Is(err, ErrSubdomainUsed), "delegated name with other records")
+
+		err = mgr.ImportZone("user", "newdomain.com", strings.NewReader("lab IN NS ns1.other.com.\nwww.lab IN TXT hello\n"))
+		assert.True(t, errors.Is(err, ErrSubdomainUsed), "records beneath a delegated name")
+
+		err = mgr.ImportZone("user", "newdomain.com", strings.NewReader("*.lab IN NS ns1.other.com.\n"))
+		assert.Error(t, err, "delegated wildcard")
+
+		require.NoError(t, mgr.ImportZone("user", "newdomain.com", strings.NewReader("lab IN NS ns1.lab\nns1.lab IN A 10.1.1.20\n")))
+		zr, err := mgr.getZoneRecords("newdomain.com", "lab")
+		require.NoError(t, err)
+		assert.Len(t, zr.Records[RecordTypeNS], 1)
+	})
+
+	t.Run("import TTL", func(t *testing.T) {
+		require.NoError(t, mgr.SetTTLRange(600, 7200))
+		defer mgr.SetTTLRange(0, 0)
+
+		require.NoError(t, mgr.ImportZone("user", "newdomain.com", strings.NewReader("www 60 IN A 10.1.1.10\nwww 30 IN A 10.1.1.11\n")))
+
+		zr, err := mgr.getZoneRecords("newdomain.com", "www")
+		require.NoError(t, err)
+		for _, r := range zr.Records[RecordTypeA] {
+			assert.Equal(t, 600, r.(RecordA).TTL)
+		}
+	})
+}
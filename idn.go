@@ -0,0 +1,200 @@
+package tfgateway
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/threefoldtech/tfgateway/dns"
+	"golang.org/x/net/idna"
+)
+
+// idnProfile converts internationalized domain names following
+// IDNA2008 and the non transitional mapping of UTS #46
+var idnProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.VerifyDNSLength(true),
+)
+
+// mixableScripts are the sets of scripts whose letters can be mixed in a
+// label, as the Japanese, Chinese and Korean writing systems do. They are
+// the sets allowed by the highly restrictive level of UTS #39
+var mixableScripts = []map[string]bool{
+	{"Latin": true, "Han": true, "Hiragana": true, "Katakana": true},
+	{"Latin": true, "Han": true, "Bopomofo": true},
+	{"Latin": true, "Han": true, "Hangul": true},
+}
+
+// DomainName is a domain name given by a user, which can be internationalized
+type DomainName struct {
+	// ASCII is the form of the name used in the DNS, where the
+	// internationalized labels are encoded with punycode
+	ASCII string
+	// Unicode is the form of the name displayed to the user
+	Unicode string
+}
+
+// ParseDomainName normalizes domain, given in its Unicode or ASCII form
+func ParseDomainName(domain string) (DomainName, error) {
+	// the wildcard label is not a valid IDN label
+	prefix := ""
+	if dns.IsWildcard(domain) {
+		prefix, domain = dns.WildcardPrefix, strings.TrimPrefix(domain, dns.WildcardPrefix)
+	}
+
+	if isASCII(domain) {
+		// ASCII names are kept as they are, so the reservations made
+		// before the IDNs were supported keep matching their records
+		name := DomainName{ASCII: prefix + domain, Unicode: prefix + domain}
+		if strings.Contains(strings.ToLower(domain), "xn--") {
+			unicode, err := idnProfile.ToUnicode(domain)
+			if err != nil {
+				return DomainName{}, fmt.Errorf("domain '%s%s' name is invalid: %w", prefix, domain, err)
+			}
+			if err := checkScripts(unicode); err != nil {
+				return DomainName{}, fmt.Errorf("domain '%s%s' name is invalid: %w", prefix, domain, err)
+			}
+			name.Unicode = prefix + unicode
+		}
+		return name, nil
+	}
+
+	ascii, err := idnProfile.ToASCII(domain)
+	if err != nil {
+		return DomainName{}, fmt.Errorf("domain '%s%s' name is invalid: %w", prefix, domain, err)
+	}
+
+	// the Unicode form is normalized too, ß is kept but the case is folded
+	unicode, err := idnProfile.ToUnicode(ascii)
+	if err != nil {
+		return DomainName{}, fmt.Errorf("domain '%s%s' name is invalid: %w", prefix, domain, err)
+	}
+
+	if err := checkScripts(unicode); err != nil {
+		return DomainName{}, fmt.Errorf("domain '%s%s' name is invalid: %w", prefix, domain, err)
+	}
+
+	return DomainName{ASCII: prefix + ascii, Unicode: prefix + unicode}, nil
+}
+
+// checkScripts makes sure the letters of each label of domain are written in a
+// single script, so a label cannot look like another one, such as a Cyrillic
+// а making pаypal look like paypal and pass the reserved labels check
+func checkScripts(domain string) error {
+	for _, label := range strings.Split(domain, ".") {
+		scripts := labelScripts(label)
+		if len(scripts) <= 1 || canMix(scripts) {
+			continue
+		}
+
+		names := make([]string, 0, len(scripts))
+		for name := range scripts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("label '%s' mixes the scripts %s", label, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// labelScripts returns the scripts of the characters of label, the
+// characters shared by all the scripts like digits and hyphens are ignored
+func labelScripts(label string) map[string]bool {
+	scripts := make(map[string]bool)
+	for _, r := range label {
+		for name, table := range unicode.Scripts {
+			if name == "Common" || name == "Inherited" {
+				continue
+			}
+			if unicode.Is(table, r) {
+				scripts[name] = true
+				break
+			}
+		}
+	}
+	return scripts
+}
+
+func canMix(scripts map[string]bool) bool {
+	for _, mixable := range mixableScripts {
+		all := true
+		for name := range scripts {
+			if !mixable[name] {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// IsIDN returns true if the domain has internationalized labels
+func (d DomainName) IsIDN() bool {
+	return d.ASCII != d.Unicode
+}
+
+// String returns both forms of an internationalized domain name
+func (d DomainName) String() string {
+	if !d.IsIDN() {
+		return d.ASCII
+	}
+	return fmt.Sprintf("%s (%s)", d.Unicode, d.ASCII)
+}
+
+// Wrap adds both forms of an internationalized domain name to err
+func (d DomainName) Wrap(err error) error {
+	if err == nil || !d.IsIDN() {
+		return err
+	}
+	return fmt.Errorf("%s: %w", d, err)
+}
+
+// DomainResult is the result of the reservations of an internationalized
+// domain name, it holds both forms of the name
+type DomainResult struct {
+	Domain        string `json:"domain,omitempty"`
+	UnicodeDomain string `json:"unicode_domain,omitempty"`
+}
+
+// domainResult returns both forms of d, or an empty
+// DomainResult if d is not an internationalized domain name
+func (d DomainName) domainResult() DomainResult {
+	if !d.IsIDN() {
+		return DomainResult{}
+	}
+	return DomainResult{Domain: d.ASCII, UnicodeDomain: d.Unicode}
+}
+
+// result returns the result of the reservations of d that have no other
+// result, which is nil unless d is an internationalized domain name
+func (d DomainName) result() interface{} {
+	if !d.IsIDN() {
+		return nil
+	}
+	return d.domainResult()
+}
+
+// normalizeDomain returns the ASCII form of domain, or domain
+// unchanged if it is invalid so the DNS and proxy managers report it
+func normalizeDomain(domain string) string {
+	name, err := ParseDomainName(domain)
+	if err != nil {
+		return domain
+	}
+	return name.ASCII
+}
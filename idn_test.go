@@ -0,0 +1,114 @@
+package tfgateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/tfgateway/dns"
+	"github.com/threefoldtech/tfgateway/proxy"
+	"github.com/threefoldtech/tfgateway/redis"
+	"github.com/threefoldtech/zos/pkg/identity"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+func TestParseDomainName(t *testing.T) {
+	for _, tt := range []struct {
+		Domain  string
+		ASCII   string
+		Unicode string
+		Err     bool
+	}{
+		{Domain: "app.gateway.tf", ASCII: "app.gateway.tf", Unicode: "app.gateway.tf"},
+		// ASCII names are not modified
+		{Domain: "App.gateway.tf", ASCII: "App.gateway.tf", Unicode: "App.gateway.tf"},
+		{Domain: "münchen.de", ASCII: "xn--mnchen-3ya.de", Unicode: "münchen.de"},
+		{Domain: "MÜNCHEN.de", ASCII: "xn--mnchen-3ya.de", Unicode: "münchen.de"},
+		{Domain: "xn--mnchen-3ya.de", ASCII: "xn--mnchen-3ya.de", Unicode: "münchen.de"},
+		// non transitional mapping, ß is not mapped to ss
+		{Domain: "straße.de", ASCII: "xn--strae-oqa.de", Unicode: "straße.de"},
+		{Domain: "*.bücher.gateway.tf", ASCII: "*.xn--bcher-kva.gateway.tf", Unicode: "*.bücher.gateway.tf"},
+		{Domain: "bad näme.de", Err: true},
+		{Domain: "xn--bad.de", Err: true},
+		// a single script per label, or the mixes of the CJK writing systems
+		{Domain: "почта.рф", ASCII: "xn--80a1acny.xn--p1ai", Unicode: "почта.рф"},
+		{Domain: "東京タワー.jp", ASCII: "xn--5ck2eqb538s34z.jp", Unicode: "東京タワー.jp"},
+		{Domain: "pаypal-login.gateway.tf", Err: true},
+		{Domain: "xn--pypal-login-yij.gateway.tf", Err: true},
+	} {
+		t.Run(tt.Domain, func(t *testing.T) {
+			name, err := ParseDomainName(tt.Domain)
+			if tt.Err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.ASCII, name.ASCII)
+			assert.Equal(t, tt.Unicode, name.Unicode)
+			assert.Equal(t, tt.ASCII != tt.Unicode, name.IsIDN())
+		})
+	}
+}
+
+func TestProvisionIDN(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	gwid := "gwid"
+	dnsMgr := dns.New(pool, gwid)
+	require.NoError(t, dnsMgr.AddDomainDelagate(gwid, gwid, "gateway.tf"))
+
+	p := NewProvisioner(proxy.New(pool), dnsMgr, nil, nil, nil, identity.KeyPair{}, nil)
+
+	reservation := func(typ provision.ReservationType, user string, data interface{}) *provision.Reservation {
+		b, err := json.Marshal(data)
+		require.NoError(t, err)
+		return &provision.Reservation{ID: "1", NodeID: gwid, User: user, Type: typ, Data: b}
+	}
+
+	delegate := reservation(DomainDeleateReservation, "user", Delegate{Domain: "münchen.de"})
+	result, err := p.Provisioners[DomainDeleateReservation](context.Background(), delegate)
+	require.NoError(t, err)
+	assert.Equal(t, DomainResult{Domain: "xn--mnchen-3ya.de", UnicodeDomain: "münchen.de"}, result)
+
+	zones, err := dnsMgr.DelegatedZones()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"xn--mnchen-3ya.de": "user"}, zones)
+
+	subdomain := reservation(SubDomainReservation, "user", Subdomain{Domain: "www.münchen.de", IPs: []net.IP{net.ParseIP("10.1.1.10")}})
+	result, err = p.Provisioners[SubDomainReservation](context.Background(), subdomain)
+	require.NoError(t, err)
+	assert.Equal(t, DomainResult{Domain: "www.xn--mnchen-3ya.de", UnicodeDomain: "www.münchen.de"}, result)
+	assert.NotEmpty(t, s.HGet("xn--mnchen-3ya.de.", "www"))
+
+	proxyReservation := reservation(ProxyReservation, "user", Proxy{Domain: "www.münchen.de", Addr: "10.1.1.10", Port: 80, PortTLS: 443})
+	_, err = p.Provisioners[ProxyReservation](context.Background(), proxyReservation)
+	require.NoError(t, err)
+	assert.True(t, s.Exists("/tcprouter/service/www.xn--mnchen-3ya.de"))
+
+	// the errors show both forms of the name
+	other := reservation(SubDomainReservation, "other", Subdomain{Domain: "mail.münchen.de", IPs: []net.IP{net.ParseIP("10.1.1.11")}})
+	_, err = p.Provisioners[SubDomainReservation](context.Background(), other)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "mail.münchen.de (mail.xn--mnchen-3ya.de)")
+
+	require.NoError(t, p.Decommissioners[ProxyReservation](context.Background(), proxyReservation))
+	assert.False(t, s.Exists("/tcprouter/service/www.xn--mnchen-3ya.de"))
+
+	require.NoError(t, p.Decommissioners[SubDomainReservation](context.Background(), subdomain))
+	assert.Empty(t, s.HGet("xn--mnchen-3ya.de.", "www"))
+
+	require.NoError(t, p.Decommissioners[DomainDeleateReservation](context.Background(), delegate))
+	zones, err = dnsMgr.DelegatedZones()
+	require.NoError(t, err)
+	assert.Empty(t, zones)
+}
@@ -8,6 +8,7 @@ import (
 	"math"
 	"net"
 	"strconv"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	"github.com/threefoldtech/zos/pkg/crypto"
@@ -54,37 +55,57 @@ type Provisioner struct {
 	dns   *dns.Mgr
 	wg    *wg.Mgr
 
+	signer   *dns.Signer
+	verifier *dns.DelegationVerifier
+
 	explorer *client.Client
 
+	quotas       *Quotas
+	reservations ReservationLister
+
 	Provisioners    map[provision.ReservationType]provision.ProvisionerFunc
 	Decommissioners map[provision.ReservationType]provision.DecomissionerFunc
 }
 
 // NewProvisioner creates a new 0-OS provisioner
-func NewProvisioner(proxy *proxy.Mgr, dns *dns.Mgr, wg *wg.Mgr, kp identity.KeyPair, explorer *client.Client) *Provisioner {
+// signer is optional, if set the DS records of the delegated domains are returned to the users
+// verifier is optional, if set the users need to prove they control a domain before delegating it
+func NewProvisioner(proxy *proxy.Mgr, dns *dns.Mgr, wg *wg.Mgr, signer *dns.Signer, verifier *dns.DelegationVerifier, kp identity.KeyPair, explorer *client.Client) *Provisioner {
 	p := &Provisioner{
 		kp:       kp,
 		proxy:    proxy,
 		dns:      dns,
 		wg:       wg,
+		signer:   signer,
+		verifier: verifier,
 		explorer: explorer,
 	}
-	p.Provisioners = map[provision.ReservationType]provision.ProvisionerFunc{
-		ProxyReservation:         p.proxyProvision,
-		ReverseProxyReservation:  p.reverseProxyProvision,
-		SubDomainReservation:     p.subDomainProvision,
-		DomainDeleateReservation: p.domainDeleateProvision,
+	provisioners := map[provision.ReservationType]provisionerMethod{
+		ProxyReservation:         (*Provisioner).proxyProvision,
+		ReverseProxyReservation:  (*Provisioner).reverseProxyProvision,
+		SubDomainReservation:     (*Provisioner).subDomainProvision,
+		DomainDeleateReservation: (*Provisioner).domainDeleateProvision,
 	}
-	p.Decommissioners = map[provision.ReservationType]provision.DecomissionerFunc{
-		ProxyReservation:         p.proxyDecomission,
-		ReverseProxyReservation:  p.reverseProxyDecomission,
-		SubDomainReservation:     p.subDomainDecomission,
-		DomainDeleateReservation: p.domainDeleateDecomission,
+	decommissioners := map[provision.ReservationType]decommissionerMethod{
+		ProxyReservation:         (*Provisioner).proxyDecomission,
+		ReverseProxyReservation:  (*Provisioner).reverseProxyDecomission,
+		SubDomainReservation:     (*Provisioner).subDomainDecomission,
+		DomainDeleateReservation: (*Provisioner).domainDeleateDecomission,
 	}
 
 	if wg != nil {
-		p.Provisioners[Gateway4To6Reservation] = p.gateway4To6Provision
-		p.Decommissioners[Gateway4To6Reservation] = p.gateway4To6Decomission
+		provisioners[Gateway4To6Reservation] = (*Provisioner).gateway4To6Provision
+		decommissioners[Gateway4To6Reservation] = (*Provisioner).gateway4To6Decomission
+	}
+
+	p.Provisioners = make(map[provision.ReservationType]provision.ProvisionerFunc, len(provisioners))
+	for typ, fn := range provisioners {
+		p.Provisioners[typ] = p.enforceQuota(p.auditProvision(fn))
+	}
+
+	p.Decommissioners = make(map[provision.ReservationType]provision.DecomissionerFunc, len(decommissioners))
+	for typ, fn := range decommissioners {
+		p.Decommissioners[typ] = p.auditDecommission(fn)
 	}
 
 	return p
@@ -139,6 +160,22 @@ func (p *Provisioner) fetchUserPublicKey(userID string) (ed25519.PublicKey, erro
 	return ed25519.PublicKey(b), nil
 }
 
+// workloadSettings decodes into v the settings of a workload that are not
+// defined by the explorer schema. They are given as a JSON object in the
+// metadata of the workload, with the same fields as the reservation data.
+// Metadata that is not a JSON object is ignored
+func workloadSettings(metadata string, v interface{}) error {
+	metadata = strings.TrimSpace(metadata)
+	if !strings.HasPrefix(metadata, "{") {
+		return nil
+	}
+
+	if err := json.Unmarshal([]byte(metadata), v); err != nil {
+		return fmt.Errorf("invalid workload settings in metadata: %w", err)
+	}
+	return nil
+}
+
 func proxyConverter(w workloads.Workloader) (Proxy, string, error) {
 	p, ok := w.(*workloads.GatewayProxy)
 	if !ok {
@@ -170,10 +207,14 @@ func subdomainConverter(w workloads.Workloader) (Subdomain, string, error) {
 		return Subdomain{}, "", fmt.Errorf("failed to convert subdomain workload, wrong format")
 	}
 
-	subdomain := Subdomain{
-		Domain: s.Domain,
-		IPs:    make([]net.IP, len(s.IPs)),
+	var subdomain Subdomain
+	if err := workloadSettings(s.Metadata, &subdomain); err != nil {
+		return Subdomain{}, "", err
 	}
+
+	// the domain and the IPs always come from the workload itself
+	subdomain.Domain = s.Domain
+	subdomain.IPs = make([]net.IP, len(s.IPs))
 	for i := range s.IPs {
 		subdomain.IPs[i] = net.ParseIP(s.IPs[i])
 	}
@@ -187,9 +228,13 @@ func delegateConverter(w workloads.Workloader) (Delegate, string, error) {
 		return Delegate{}, "", fmt.Errorf("failed to convert delegate domain workload, wrong format")
 	}
 
-	return Delegate{
-		Domain: d.Domain,
-	}, d.NodeId, nil
+	var delegate Delegate
+	if err := workloadSettings(d.Metadata, &delegate); err != nil {
+		return Delegate{}, "", err
+	}
+	delegate.Domain = d.Domain
+
+	return delegate, d.NodeId, nil
 }
 
 func gateway4To6Converter(w workloads.Workloader) (Gateway4to6, string, error) {
@@ -198,9 +243,13 @@ func gateway4To6Converter(w workloads.Workloader) (Gateway4to6, string, error) {
 		return Gateway4to6{}, "", fmt.Errorf("failed to convert gateway 4to6 workload, wrong format")
 	}
 
-	return Gateway4to6{
-		PublicKey: t.PublicKey,
-	}, t.NodeId, nil
+	var gateway Gateway4to6
+	if err := workloadSettings(t.Metadata, &gateway); err != nil {
+		return Gateway4to6{}, "", err
+	}
+	gateway.PublicKey = t.PublicKey
+
+	return gateway, t.NodeId, nil
 }
 
 // WorkloadToProvisionType TfgridReservationWorkload1 to provision.Reservation
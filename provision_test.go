@@ -0,0 +1,122 @@
+package tfgateway
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/tfexplorer/models/generated/workloads"
+	"github.com/threefoldtech/tfgateway/dns"
+)
+
+func TestSubdomainConverter(t *testing.T) {
+	w := &workloads.GatewaySubdomain{
+		ReservationInfo: workloads.ReservationInfo{
+			WorkloadId:   1,
+			NodeId:       "gwid",
+			WorkloadType: workloads.WorkloadTypeSubDomain,
+			Metadata: `{
+				"mx": [{"host": "mail.app.gateway.tf", "preference": 10, "ttl": 3600}],
+				"ttl": 300,
+				"healthcheck": {"protocol": "http", "port": 80, "path": "/health"},
+				"weights": {"10.1.1.10": 3},
+				"regions": {"10.1.1.11": "eu"},
+				"domain": "ignored.gateway.tf"
+			}`,
+		},
+		Domain: "app.gateway.tf",
+		IPs:    []string{"10.1.1.10", "10.1.1.11"},
+	}
+
+	r, err := WorkloadToProvisionType(w)
+	require.NoError(t, err)
+	assert.Equal(t, "gwid", r.NodeID)
+
+	var subdomain Subdomain
+	require.NoError(t, json.Unmarshal(r.Data, &subdomain))
+	assert.Equal(t, Subdomain{
+		Domain:      "app.gateway.tf",
+		IPs:         []net.IP{net.ParseIP("10.1.1.10"), net.ParseIP("10.1.1.11")},
+		MX:          []dns.RecordMX{{Host: "mail.app.gateway.tf", Preference: 10, TTL: 3600}},
+		HealthCheck: &dns.HealthCheck{Protocol: "http", Port: 80, Path: "/health"},
+		Weights:     map[string]int{"10.1.1.10": 3},
+		Regions:     map[string]string{"10.1.1.11": "eu"},
+		TTL:         300,
+	}, subdomain)
+
+	t.Run("cname", func(t *testing.T) {
+		w := &workloads.GatewaySubdomain{
+			ReservationInfo: workloads.ReservationInfo{Metadata: `{"cname": "app.example.com"}`},
+			Domain:          "www.gateway.tf",
+		}
+		subdomain, _, err := subdomainConverter(w)
+		require.NoError(t, err)
+		assert.Equal(t, "app.example.com", subdomain.CNAME)
+		assert.Empty(t, subdomain.IPs)
+	})
+
+	t.Run("metadata without settings", func(t *testing.T) {
+		w := &workloads.GatewaySubdomain{
+			ReservationInfo: workloads.ReservationInfo{Metadata: "my website"},
+			Domain:          "www.gateway.tf",
+			IPs:             []string{"10.1.1.10"},
+		}
+		subdomain, _, err := subdomainConverter(w)
+		require.NoError(t, err)
+		assert.Equal(t, Subdomain{Domain: "www.gateway.tf", IPs: []net.IP{net.ParseIP("10.1.1.10")}}, subdomain)
+	})
+
+	t.Run("invalid settings", func(t *testing.T) {
+		w := &workloads.GatewaySubdomain{
+			ReservationInfo: workloads.ReservationInfo{Metadata: `{"ttl": "long"}`},
+			Domain:          "www.gateway.tf",
+		}
+		_, _, err := subdomainConverter(w)
+		assert.Error(t, err)
+	})
+}
+
+func TestDelegateConverter(t *testing.T) {
+	w := &workloads.GatewayDelegate{
+		ReservationInfo: workloads.ReservationInfo{
+			NodeId:       "gwid",
+			WorkloadType: workloads.WorkloadTypeDomainDelegate,
+			Metadata: `{
+				"mx": [{"host": "mail.mydomain.com", "preference": 10, "ttl": 3600}],
+				"caa": [{"flag": 0, "tag": "issue", "value": "letsencrypt.org", "ttl": 3600}]
+			}`,
+		},
+		Domain: "mydomain.com",
+	}
+
+	r, err := WorkloadToProvisionType(w)
+	require.NoError(t, err)
+
+	var delegate Delegate
+	require.NoError(t, json.Unmarshal(r.Data, &delegate))
+	assert.Equal(t, Delegate{
+		Domain: "mydomain.com",
+		MX:     []dns.RecordMX{{Host: "mail.mydomain.com", Preference: 10, TTL: 3600}},
+		CAA:    []dns.RecordCAA{{Flag: 0, Tag: "issue", Value: "letsencrypt.org", TTL: 3600}},
+	}, delegate)
+}
+
+func TestGateway4To6Converter(t *testing.T) {
+	w := &workloads.Gateway4To6{
+		ReservationInfo: workloads.ReservationInfo{
+			NodeId:       "gwid",
+			WorkloadType: workloads.WorkloadTypeGateway4To6,
+			Metadata:     `{"hostname": "vpn.mydomain.com"}`,
+		},
+		PublicKey: "key",
+	}
+
+	r, err := WorkloadToProvisionType(w)
+	require.NoError(t, err)
+
+	var gateway Gateway4to6
+	require.NoError(t, json.Unmarshal(r.Data, &gateway))
+	assert.Equal(t, Gateway4to6{PublicKey: "key", Hostname: "vpn.mydomain.com"}, gateway)
+}
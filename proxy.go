@@ -25,7 +25,16 @@ func (p *Provisioner) proxyProvision(ctx context.Context, r *provision.Reservati
 	}
 	log.Info().Str("id", r.ID).Msgf("provision proxy %+v", data)
 
-	return nil, p.proxy.AddProxy(r.User, data.Domain, data.Addr, int(data.Port), int(data.PortTLS))
+	domain, err := ParseDomainName(data.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.proxy.AddProxy(r.User, domain.ASCII, data.Addr, int(data.Port), int(data.PortTLS)); err != nil {
+		return nil, domain.Wrap(err)
+	}
+
+	return domain.result(), nil
 }
 
 func (p *Provisioner) proxyDecomission(ctx context.Context, r *provision.Reservation) error {
@@ -36,5 +45,20 @@ func (p *Provisioner) proxyDecomission(ctx context.Context, r *provision.Reserva
 		return err
 	}
 
-	return p.proxy.RemoveProxy(r.User, data.Domain)
+	domain, err := ParseDomainName(data.Domain)
+	if err != nil {
+		return err
+	}
+
+	released, err := p.proxy.ReleaseTransfer(r.User, domain.ASCII)
+	if err != nil {
+		return domain.Wrap(err)
+	}
+	if released {
+		// the proxy now belongs to the user it was transferred to
+		log.Info().Str("id", r.ID).Msgf("proxy %s was transferred, released the reservation", domain)
+		return nil
+	}
+
+	return domain.Wrap(p.proxy.RemoveProxy(r.User, domain.ASCII))
 }
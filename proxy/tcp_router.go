@@ -5,10 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/gomodule/redigo/redis"
+	"github.com/threefoldtech/tfgateway/audit"
+	"github.com/threefoldtech/tfgateway/reserved"
 )
 
+// servicePrefix is the prefix of the keys of the proxies
+const servicePrefix = "/tcprouter/service/"
+
 // service is the type use by the TCP router to configure proxies
 // https://github.com/threefoldtech/tcprouter/blob/master/config.go#L36
 type service struct {
@@ -18,11 +24,18 @@ type service struct {
 	HTTPPort     int    `json:"httpport"`
 
 	UserID string `json:"user"`
+	// FormerUsers are the users the proxy has been transferred from,
+	// their reservations still hold it until they are decommissioned
+	FormerUsers []string `json:"former_users,omitempty"`
 }
 
 // Mgr is configure a TCP router server using redis
 type Mgr struct {
-	redis *redis.Pool
+	redis    *redis.Pool
+	reserved *reserved.Labels
+
+	audit *audit.Recorder
+	actor audit.Actor
 }
 
 // New creates a new TCP router server manager
@@ -30,36 +43,129 @@ func New(pool *redis.Pool) *Mgr {
 	return &Mgr{redis: pool}
 }
 
+// SetReservedLabels sets the labels users cannot use under the managed domains
+func (r *Mgr) SetReservedLabels(labels *reserved.Labels) {
+	r.reserved = labels
+}
+
+// SetAuditRecorder sets the recorder of the changes made to the proxies
+func (r *Mgr) SetAuditRecorder(recorder *audit.Recorder) {
+	r.audit = recorder
+}
+
+// As returns a copy of the Mgr that records its changes as made by actor
+func (r *Mgr) As(actor audit.Actor) *Mgr {
+	mgr := *r
+	mgr.actor = actor
+	return &mgr
+}
+
+// Describe is the audit.Describer of the redis keys written by the Mgr
+func Describe(key, field string) (audit.Key, bool) {
+	if !strings.HasPrefix(key, servicePrefix) || field != "" {
+		return audit.Key{}, false
+	}
+
+	return audit.Key{
+		Object: "proxy",
+		Domain: strings.TrimPrefix(key, servicePrefix),
+		Decode: func(value string) string {
+			service := service{}
+			if err := valkyrieDecode([]byte(value), &service); err != nil {
+				return value
+			}
+
+			// the secret gives access to the reverse tunnel
+			if service.ClientSecret != "" {
+				service.ClientSecret = "redacted"
+			}
+
+			b, err := json.Marshal(service)
+			if err != nil {
+				return value
+			}
+			return string(b)
+		},
+	}, true
+}
+
 func (r *Mgr) key(domain string) string {
-	return fmt.Sprintf("/tcprouter/service/%s", domain)
+	return servicePrefix + domain
 }
 
-func (r *Mgr) canUseDomain(user string, domain string) (bool, error) {
-	con := r.redis.Get()
-	defer con.Close()
+// do sends a command that changes the configuration of the
+// TCP router and records the change in the audit log
+func (r *Mgr) do(con redis.Conn, cmd string, args ...interface{}) error {
+	entries, err := r.audit.Prepare(con, r.actor, audit.Command{Name: cmd, Args: args})
+	if err != nil {
+		return err
+	}
+
+	if _, err := con.Do(cmd, args...); err != nil {
+		return err
+	}
+
+	r.audit.Commit(entries)
+	return nil
+}
 
+// checkReserved returns reserved.ErrReserved if domain cannot be used by the users
+func (r *Mgr) checkReserved(domain string) error {
+	if r.reserved == nil {
+		return nil
+	}
+	return r.reserved.Check(domain)
+}
+
+// getService returns the configuration of the proxy of domain, or nil if there is none
+func (r *Mgr) getService(con redis.Conn, domain string) (*service, error) {
 	data, err := redis.Bytes(con.Do("GET", r.key(domain)))
-	if err != nil {
-		if errors.Is(err, redis.ErrNil) {
-			return true, nil
-		}
-		return false, err
+	if errors.Is(err, redis.ErrNil) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
 
 	service := service{}
 	if err := valkyrieDecode(data, &service); err != nil {
-		return false, err
+		return nil, err
 	}
 
-	return service.UserID == user, nil
+	return &service, nil
+}
+
+func (r *Mgr) canUseDomain(user string, domain string) (bool, error) {
+	_, can, err := r.formerUsers(user, domain)
+	return can, err
+}
+
+// formerUsers returns the users the proxy of domain has been transferred from
+// if user can use domain. The new owner of a transferred proxy keeps them when
+// it deploys its own reservation of the proxy
+func (r *Mgr) formerUsers(user string, domain string) ([]string, bool, error) {
+	con := r.redis.Get()
+	defer con.Close()
+
+	service, err := r.getService(con, domain)
+	if err != nil || service == nil {
+		return nil, err == nil, err
+	}
+
+	if service.UserID != user {
+		return nil, false, nil
+	}
+	return service.FormerUsers, true, nil
 }
 
 // AddProxy adds a TCP proxy from domain to addr
 // port is for plain text protocol, usually HTTP
 // portTLS is for TCL protocol, usually HTTPS
 func (r *Mgr) AddProxy(user string, domain, addr string, port, portTLS int) error {
+	if err := r.checkReserved(domain); err != nil {
+		return err
+	}
 
-	can, err := r.canUseDomain(user, domain)
+	formers, can, err := r.formerUsers(user, domain)
 	if err != nil {
 		return err
 	}
@@ -69,10 +175,11 @@ func (r *Mgr) AddProxy(user string, domain, addr string, port, portTLS int) erro
 
 	key := r.key(domain)
 	b, err := valkyrieEncode(key, service{
-		Addr:     addr,
-		HTTPPort: port,
-		TLSPort:  portTLS,
-		UserID:   user,
+		Addr:        addr,
+		HTTPPort:    port,
+		TLSPort:     portTLS,
+		UserID:      user,
+		FormerUsers: formers,
 	})
 	if err != nil {
 		return err
@@ -81,8 +188,7 @@ func (r *Mgr) AddProxy(user string, domain, addr string, port, portTLS int) erro
 	con := r.redis.Get()
 	defer con.Close()
 
-	_, err = con.Do("SET", key, b)
-	return err
+	return r.do(con, "SET", key, b)
 }
 
 // RemoveProxy removes a proxy added with AddProxy
@@ -97,13 +203,15 @@ func (r *Mgr) RemoveProxy(user string, domain string) error {
 
 	con := r.redis.Get()
 	defer con.Close()
-	_, err = con.Do("DEL", r.key(domain))
-	return err
+	return r.do(con, "DEL", r.key(domain))
 }
 
 // AddReverseProxy add a reverse tunnel TCP proxy from domain to the TCP connection identityied by secret
 func (r *Mgr) AddReverseProxy(user string, domain, secret string) error {
-	can, err := r.canUseDomain(user, domain)
+	if err := r.checkReserved(domain); err != nil {
+		return err
+	}
+	formers, can, err := r.formerUsers(user, domain)
 	if err != nil {
 		return err
 	}
@@ -115,6 +223,7 @@ func (r *Mgr) AddReverseProxy(user string, domain, secret string) error {
 	b, err := valkyrieEncode(key, service{
 		ClientSecret: secret,
 		UserID:       user,
+		FormerUsers:  formers,
 	})
 	if err != nil {
 		return err
@@ -123,8 +232,7 @@ func (r *Mgr) AddReverseProxy(user string, domain, secret string) error {
 	con := r.redis.Get()
 	defer con.Close()
 
-	_, err = con.Do("SET", key, b)
-	return err
+	return r.do(con, "SET", key, b)
 }
 
 // RemoveReverseProxy removes a reverse tunnel proxy added with AddReverseProxy
@@ -139,8 +247,218 @@ func (r *Mgr) RemoveReverseProxy(user string, domain string) error {
 
 	con := r.redis.Get()
 	defer con.Close()
-	_, err = con.Do("DEL", r.key(domain))
-	return err
+	return r.do(con, "DEL", r.key(domain))
+}
+
+// RemoveDomain removes all the proxies and reverse proxies configured for domain
+// or any of its subdomains, regardless of the user owning them.
+// The subdomains inside the nested domains are kept, they belong to the
+// zones delegated inside domain and not to domain itself.
+// The list of removed domains is returned to the caller
+func (r *Mgr) RemoveDomain(domain string, nested ...string) ([]string, error) {
+	con := r.redis.Get()
+	defer con.Close()
+
+	var removed []string
+	err := r.scan(con, func(key, host string) error {
+		if !inDomain(host, domain) {
+			return nil
+		}
+
+		for _, zone := range nested {
+			if inDomain(host, zone) {
+				return nil
+			}
+		}
+
+		if err := r.do(con, "DEL", key); err != nil {
+			return err
+		}
+		removed = append(removed, host)
+		return nil
+	})
+
+	return removed, err
+}
+
+// inDomain returns true if host is domain or one of its subdomains
+func inDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// TransferDomain returns a function that gives the proxies of domain and of its
+// subdomains owned by user from to user to. It is meant to be used as a dns.TxHook
+// so the proxies change owner in the same transaction as the domain: the proxies
+// are watched and read with con, and their new configuration is queued with send.
+// The backends of the proxies are removed, the new owner configures its own
+// when it deploys its reservations of the proxies
+func (r *Mgr) TransferDomain(from, to, domain string) func(con redis.Conn, send func(cmd string, args ...interface{})) error {
+	return func(con redis.Conn, send func(cmd string, args ...interface{})) error {
+		return r.scan(con, func(key, host string) error {
+			if host != domain && !strings.HasSuffix(host, "."+domain) {
+				return nil
+			}
+
+			if _, err := con.Do("WATCH", key); err != nil {
+				return err
+			}
+
+			data, err := redis.Bytes(con.Do("GET", key))
+			if errors.Is(err, redis.ErrNil) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+
+			former := service{}
+			if err := valkyrieDecode(data, &former); err != nil {
+				return fmt.Errorf("failed to decode proxy %s: %w", host, err)
+			}
+
+			if former.UserID != from {
+				return nil
+			}
+
+			// only the owners are kept, the traffic of the new owner
+			// must not reach the backends of the former owner
+			b, err := valkyrieEncode(key, service{
+				UserID:      to,
+				FormerUsers: append(removeUser(former.FormerUsers, from, to), from),
+			})
+			if err != nil {
+				return err
+			}
+
+			send("SET", key, b)
+			return nil
+		})
+	}
+}
+
+// ReleaseTransfer releases the hold the reservation of user has on the proxy
+// of domain after user transferred it to another user. It is called when the
+// reservation of user is decommissioned, instead of removing the proxy.
+// It returns false if the proxy has not been transferred from user
+func (r *Mgr) ReleaseTransfer(user, domain string) (bool, error) {
+	con := r.redis.Get()
+	defer con.Close()
+
+	service, err := r.getService(con, domain)
+	if err != nil || service == nil {
+		return false, err
+	}
+
+	if service.UserID == user || !containsUser(service.FormerUsers, user) {
+		return false, nil
+	}
+
+	key := r.key(domain)
+	service.FormerUsers = removeUser(service.FormerUsers, user)
+	b, err := valkyrieEncode(key, *service)
+	if err != nil {
+		return false, err
+	}
+
+	return true, r.do(con, "SET", key, b)
+}
+
+// Transfers returns the domains of the proxies transferred to another
+// user together with the former owners whose reservations still hold them
+func (r *Mgr) Transfers() (map[string][]string, error) {
+	con := r.redis.Get()
+	defer con.Close()
+
+	transfers := make(map[string][]string)
+	err := r.scan(con, func(key, host string) error {
+		service, err := r.getService(con, host)
+		if err != nil {
+			return fmt.Errorf("failed to decode proxy %s: %w", host, err)
+		}
+
+		if service != nil && len(service.FormerUsers) > 0 {
+			transfers[host] = service.FormerUsers
+		}
+		return nil
+	})
+
+	return transfers, err
+}
+
+func containsUser(users []string, user string) bool {
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+func removeUser(users []string, remove ...string) []string {
+	kept := users[:0:0]
+	for _, u := range users {
+		if !containsUser(remove, u) {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
+
+// Services returns the domains of all the proxies configured
+// in the TCP router together with the user that owns them
+func (r *Mgr) Services() (map[string]string, error) {
+	con := r.redis.Get()
+	defer con.Close()
+
+	services := make(map[string]string)
+	err := r.scan(con, func(key, host string) error {
+		data, err := redis.Bytes(con.Do("GET", key))
+		if errors.Is(err, redis.ErrNil) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		service := service{}
+		if err := valkyrieDecode(data, &service); err != nil {
+			return fmt.Errorf("failed to decode proxy %s: %w", host, err)
+		}
+
+		services[host] = service.UserID
+		return nil
+	})
+
+	return services, err
+}
+
+// scan calls fn with the key and the domain of every proxy
+// configured in the TCP router
+func (r *Mgr) scan(con redis.Conn, fn func(key, host string) error) error {
+	var (
+		cursor int64
+		prefix = r.key("")
+	)
+
+	for {
+		values, err := redis.Values(con.Do("SCAN", cursor, "MATCH", prefix+"*", "COUNT", 100))
+		if err != nil {
+			return err
+		}
+
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := fn(key, strings.TrimPrefix(key, prefix)); err != nil {
+				return err
+			}
+		}
+
+		if cursor == 0 {
+			return nil
+		}
+	}
 }
 
 type valkyrieObj struct {
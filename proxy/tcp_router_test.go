@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/tfgateway/audit"
+	"github.com/threefoldtech/tfgateway/redis"
+	"github.com/threefoldtech/tfgateway/reserved"
+)
+
+func TestRemoveDomain(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	mgr := New(pool)
+
+	err = mgr.AddProxy("user", "mydomain.com", "10.1.1.10", 80, 443)
+	require.NoError(t, err)
+	err = mgr.AddProxy("user", "www.mydomain.com", "10.1.1.10", 80, 443)
+	require.NoError(t, err)
+	err = mgr.AddReverseProxy("user2", "app.mydomain.com", "user2:secret")
+	require.NoError(t, err)
+	err = mgr.AddProxy("user", "www.othermydomain.com", "10.1.1.10", 80, 443)
+	require.NoError(t, err)
+
+	removed, err := mgr.RemoveDomain("mydomain.com")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"mydomain.com", "www.mydomain.com", "app.mydomain.com"}, removed)
+
+	assert.False(t, s.Exists(mgr.key("www.mydomain.com")))
+	assert.True(t, s.Exists(mgr.key("www.othermydomain.com")))
+
+	t.Run("nested", func(t *testing.T) {
+		err = mgr.AddProxy("user", "www.mydomain.com", "10.1.1.10", 80, 443)
+		require.NoError(t, err)
+		err = mgr.AddProxy("user2", "app.dev.mydomain.com", "10.1.1.11", 80, 443)
+		require.NoError(t, err)
+
+		removed, err := mgr.RemoveDomain("mydomain.com", "dev.mydomain.com")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"www.mydomain.com"}, removed)
+		assert.True(t, s.Exists(mgr.key("app.dev.mydomain.com")))
+	})
+}
+
+func TestTransferDomain(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	mgr := New(pool)
+	require.NoError(t, mgr.AddProxy("user", "www.mydomain.com", "10.1.1.10", 80, 443))
+
+	con := pool.Get()
+	defer con.Close()
+	require.NoError(t, mgr.TransferDomain("user", "user2", "mydomain.com")(con, func(cmd string, args ...interface{}) {
+		_, err := con.Do(cmd, args...)
+		require.NoError(t, err)
+	}))
+
+	// the backend of the former owner is removed
+	transferred, err := mgr.getService(con, "www.mydomain.com")
+	require.NoError(t, err)
+	assert.Equal(t, &service{UserID: "user2", FormerUsers: []string{"user"}}, transferred)
+
+	require.NoError(t, mgr.AddProxy("user2", "www.mydomain.com", "10.1.1.20", 80, 443))
+	transferred, err = mgr.getService(con, "www.mydomain.com")
+	require.NoError(t, err)
+	assert.Equal(t, "10.1.1.20", transferred.Addr)
+	assert.Equal(t, []string{"user"}, transferred.FormerUsers)
+}
+
+func TestReservedLabels(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "reserved")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "reserved")
+	require.NoError(t, ioutil.WriteFile(path, []byte("www\n"), 0644))
+
+	labels, err := reserved.Load(path, []string{"gateway.tf"})
+	require.NoError(t, err)
+
+	mgr := New(pool)
+	mgr.SetReservedLabels(labels)
+
+	err = mgr.AddProxy("user", "www.gateway.tf", "10.1.1.10", 80, 443)
+	assert.True(t, errors.Is(err, reserved.ErrReserved))
+
+	err = mgr.AddReverseProxy("user", "www.gateway.tf", "user:secret")
+	assert.True(t, errors.Is(err, reserved.ErrReserved))
+
+	err = mgr.AddProxy("user", "www.mydomain.com", "10.1.1.10", 80, 443)
+	assert.NoError(t, err)
+}
+
+func TestAudit(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	log := audit.NewStream(pool)
+	mgr := New(pool)
+	mgr.SetAuditRecorder(audit.NewRecorder(log, Describe))
+
+	user := mgr.As(audit.Actor{User: "user", Reservation: "12", Operation: "provision reverse_proxy"})
+	require.NoError(t, user.AddReverseProxy("user", "app.gateway.tf", "user:tunnel-key"))
+	require.NoError(t, user.RemoveReverseProxy("user", "app.gateway.tf"))
+
+	entries, err := log.Query(audit.Filter{Domain: "app.gateway.tf", User: "user"})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	assert.Equal(t, "proxy", entries[0].Object)
+	assert.Equal(t, "12", entries[0].Reservation)
+	assert.Empty(t, entries[0].Before)
+	assert.Contains(t, entries[0].After, `"user":"user"`)
+	assert.NotContains(t, entries[0].After, "tunnel-key")
+
+	assert.Equal(t, entries[0].After, entries[1].Before)
+	assert.Empty(t, entries[1].After)
+}
@@ -0,0 +1,135 @@
+package tfgateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+// ErrQuotaExceeded is returned when a user already has as many
+// reservations of a type as he is allowed to
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quotas limits the number of reservations of each type a user can have.
+// A negative limit means unlimited. The types without limit are not limited
+type Quotas struct {
+	// Default are the limits of all the users
+	Default map[provision.ReservationType]int
+	// Users overrides the default limits for some users
+	Users map[string]map[provision.ReservationType]int
+}
+
+// Set parses a limit of the form [<user>:]<type>=<limit> and adds it to the quotas.
+// The limit applies to all the users if no user is given
+func (q *Quotas) Set(def string) error {
+	parts := strings.SplitN(def, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid quota '%s', expected [<user>:]<type>=<limit>", def)
+	}
+
+	limit, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid limit of quota '%s': %w", def, err)
+	}
+
+	var user string
+	typ := parts[0]
+	if i := strings.LastIndex(typ, ":"); i >= 0 {
+		user, typ = typ[:i], typ[i+1:]
+	}
+
+	rtype := provision.ReservationType(typ)
+	if _, ok := ProvisionOrder[rtype]; !ok {
+		return fmt.Errorf("unknown reservation type '%s' in quota '%s'", typ, def)
+	}
+
+	if user == "" {
+		if q.Default == nil {
+			q.Default = make(map[provision.ReservationType]int)
+		}
+		q.Default[rtype] = limit
+		return nil
+	}
+
+	if q.Users == nil {
+		q.Users = make(map[string]map[provision.ReservationType]int)
+	}
+	if q.Users[user] == nil {
+		q.Users[user] = make(map[provision.ReservationType]int)
+	}
+	q.Users[user][rtype] = limit
+
+	return nil
+}
+
+// limit returns the number of reservations of type typ user can have
+func (q *Quotas) limit(user string, typ provision.ReservationType) (int, bool) {
+	if limit, ok := q.Users[user][typ]; ok {
+		return limit, limit >= 0
+	}
+
+	limit, ok := q.Default[typ]
+	return limit, ok && limit >= 0
+}
+
+// SetQuotas limits the number of reservations each user can have.
+// The reservations of the users are counted from the reservations in cache
+func (p *Provisioner) SetQuotas(quotas *Quotas, cache ReservationLister) {
+	p.quotas = quotas
+	p.reservations = cache
+}
+
+// enforceQuota makes fn fail if the user of the reservation
+// reached his quota for the type of the reservation
+func (p *Provisioner) enforceQuota(fn provision.ProvisionerFunc) provision.ProvisionerFunc {
+	return func(ctx context.Context, r *provision.Reservation) (interface{}, error) {
+		if err := p.checkQuota(r); err != nil {
+			return nil, err
+		}
+		return fn(ctx, r)
+	}
+}
+
+func (p *Provisioner) checkQuota(r *provision.Reservation) error {
+	if p.quotas == nil {
+		return nil
+	}
+
+	limit, ok := p.quotas.limit(r.User, r.Type)
+	if !ok {
+		return nil
+	}
+
+	reservations, err := p.reservations.List()
+	if err != nil {
+		return fmt.Errorf("failed to count the reservations of user %s: %w", r.User, err)
+	}
+
+	used := 0
+	key := cacheKey(r)
+	for _, reservation := range reservations {
+		// the reservation itself is in the cache when it is provisioned again
+		if reservation.User == r.User && reservation.Type == r.Type && cacheKey(reservation) != key {
+			used++
+		}
+	}
+
+	if used >= limit {
+		return fmt.Errorf("%w: user %s already has %d %s reservations, the limit is %d", ErrQuotaExceeded, r.User, used, r.Type, limit)
+	}
+
+	return nil
+}
+
+// cacheKey returns the ID a reservation is stored under in the cache,
+// the reservations that reference another one replace it
+func cacheKey(r *provision.Reservation) string {
+	if r.Reference != "" {
+		return r.Reference
+	}
+	return r.ID
+}
@@ -0,0 +1,120 @@
+package tfgateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/tfgateway/cache"
+	"github.com/threefoldtech/tfgateway/dns"
+	"github.com/threefoldtech/tfgateway/proxy"
+	"github.com/threefoldtech/tfgateway/redis"
+	"github.com/threefoldtech/zos/pkg/identity"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+func TestQuotasSet(t *testing.T) {
+	var quotas Quotas
+	require.NoError(t, quotas.Set("subdomain=2"))
+	require.NoError(t, quotas.Set("proxy=0"))
+	require.NoError(t, quotas.Set("12:subdomain=10"))
+	require.NoError(t, quotas.Set("13:proxy=-1"))
+
+	assert.Error(t, quotas.Set("subdomain"))
+	assert.Error(t, quotas.Set("subdomain=many"))
+	assert.Error(t, quotas.Set("unknown=1"))
+
+	tt := []struct {
+		user  string
+		typ   provision.ReservationType
+		limit int
+		ok    bool
+	}{
+		{"1", SubDomainReservation, 2, true},
+		{"1", ProxyReservation, 0, true},
+		{"1", DomainDeleateReservation, 0, false},
+		{"12", SubDomainReservation, 10, true},
+		{"12", ProxyReservation, 0, true},
+		{"13", ProxyReservation, -1, false},
+	}
+
+	for _, tc := range tt {
+		limit, ok := quotas.limit(tc.user, tc.typ)
+		assert.Equal(t, tc.ok, ok, "%s %s", tc.user, tc.typ)
+		if tc.ok {
+			assert.Equal(t, tc.limit, limit, "%s %s", tc.user, tc.typ)
+		}
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	gwid := "gwid"
+	dnsMgr := dns.New(pool, gwid)
+	store := cache.NewRedis(pool)
+	p := NewProvisioner(proxy.New(pool), dnsMgr, nil, nil, nil, identity.KeyPair{}, nil)
+	require.NoError(t, dnsMgr.AddDomainDelagate(gwid, gwid, "gateway.tf"))
+
+	var quotas Quotas
+	require.NoError(t, quotas.Set("subdomain=1"))
+	require.NoError(t, quotas.Set("vip:subdomain=2"))
+	p.SetQuotas(&quotas, store)
+
+	reserve := func(id, user, domain string) error {
+		b, err := json.Marshal(Subdomain{Domain: domain, IPs: []net.IP{net.ParseIP("10.1.1.10")}})
+		require.NoError(t, err)
+
+		r := &provision.Reservation{ID: id, NodeID: gwid, User: user, Type: SubDomainReservation, Data: b}
+		if _, err := p.Provisioners[SubDomainReservation](context.Background(), r); err != nil {
+			return err
+		}
+		return store.Add(r)
+	}
+
+	require.NoError(t, reserve("1", "user", "one.gateway.tf"))
+
+	err = reserve("2", "user", "two.gateway.tf")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	assert.Contains(t, err.Error(), "user user already has 1 subdomain reservations, the limit is 1")
+
+	subdomains, err := dnsMgr.Subdomains()
+	require.NoError(t, err)
+	assert.NotContains(t, subdomains, "two.gateway.tf", "nothing is configured for a reservation over quota")
+
+	require.NoError(t, reserve("3", "vip", "three.gateway.tf"))
+	require.NoError(t, reserve("4", "vip", "four.gateway.tf"))
+	assert.True(t, errors.Is(reserve("5", "vip", "five.gateway.tf"), ErrQuotaExceeded))
+
+	require.NoError(t, dnsMgr.ReleaseSubdomain("one.gateway.tf"))
+	require.NoError(t, reserve("1", "user", "one.gateway.tf"), "a reservation provisioned again does not count against its quota")
+
+	t.Run("reference", func(t *testing.T) {
+		b, err := json.Marshal(Subdomain{Domain: "ref.gateway.tf", IPs: []net.IP{net.ParseIP("10.1.1.10")}})
+		require.NoError(t, err)
+
+		// the cache keys the reservations that reference
+		// another one by the reference, not by their ID
+		r := &provision.Reservation{ID: "6-1", Reference: "6", NodeID: gwid, User: "ref", Type: SubDomainReservation, Data: b}
+		require.NoError(t, store.Add(&provision.Reservation{ID: "6", NodeID: gwid, User: "ref", Type: SubDomainReservation, Data: b}))
+
+		_, err = p.Provisioners[SubDomainReservation](context.Background(), r)
+		require.NoError(t, err, "a reservation provisioned again with a reference does not count against its quota")
+
+		other := &provision.Reservation{ID: "7", NodeID: gwid, User: "ref", Type: SubDomainReservation, Data: b}
+		_, err = p.Provisioners[SubDomainReservation](context.Background(), other)
+		assert.True(t, errors.Is(err, ErrQuotaExceeded))
+	})
+}
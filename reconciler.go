@@ -0,0 +1,288 @@
+package tfgateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/tfgateway/audit"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+// ReservationLister lists the reservations provisioned by the gateway
+// cache.Redis implements this interface
+type ReservationLister interface {
+	List() ([]*provision.Reservation, error)
+}
+
+// ReconcileReport lists the differences found between the reservation
+// cache and the configuration of the DNS and the TCP router
+type ReconcileReport struct {
+	// OrphanZones are delegated zones without reservation
+	OrphanZones []string
+	// OrphanSubdomains are subdomains without reservation
+	OrphanSubdomains []string
+	// OrphanProxies are proxies and reverse proxies without reservation
+	OrphanProxies []string
+	// Missing are the IDs of the reservations whose configuration is missing
+	Missing []string
+}
+
+// Empty returns true if no difference has been found
+func (r ReconcileReport) Empty() bool {
+	return len(r.OrphanZones) == 0 &&
+		len(r.OrphanSubdomains) == 0 &&
+		len(r.OrphanProxies) == 0 &&
+		len(r.Missing) == 0
+}
+
+// Reconciler makes sure the configuration of the DNS and the TCP router
+// matches the reservations in the cache
+type Reconciler struct {
+	cache       ReservationLister
+	provisioner *Provisioner
+	repair      bool
+
+	// differences found by the previous run
+	previous map[string]struct{}
+}
+
+// NewReconciler creates a Reconciler. If repair is false, the differences
+// are only reported. Otherwise the orphans are removed and the reservations
+// with a missing configuration are provisioned again. To not interfere with
+// the reservations being provisioned or decommissioned while the reconciler
+// runs, a difference is only repaired once it has been found by two runs in a row
+func NewReconciler(cache ReservationLister, provisioner *Provisioner, repair bool) *Reconciler {
+	return &Reconciler{
+		cache:       cache,
+		provisioner: provisioner,
+		repair:      repair,
+	}
+}
+
+// Run reconciles the configuration now and then every interval until ctx is done
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := r.Reconcile(ctx); err != nil {
+			log.Error().Err(err).Msg("failed to reconcile gateway configuration")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile compares the reservation cache with the configuration of the DNS
+// and the TCP router and returns the differences found. In repair mode,
+// the differences are fixed
+func (r *Reconciler) Reconcile(ctx context.Context) (ReconcileReport, error) {
+	var report ReconcileReport
+
+	reservations, err := r.cache.List()
+	if err != nil {
+		return report, fmt.Errorf("failed to list cached reservations: %w", err)
+	}
+
+	zones, err := r.provisioner.dns.DelegatedZones()
+	if err != nil {
+		return report, err
+	}
+
+	subdomains, err := r.provisioner.dns.Subdomains()
+	if err != nil {
+		return report, err
+	}
+
+	proxies, err := r.provisioner.proxy.Services()
+	if err != nil {
+		return report, fmt.Errorf("failed to list proxies: %w", err)
+	}
+
+	// the reservations of the former owners of the transferred
+	// domains hold them until they are decommissioned
+	transfers, err := r.provisioner.dns.Transfers()
+	if err != nil {
+		return report, err
+	}
+
+	proxyTransfers, err := r.provisioner.proxy.Transfers()
+	if err != nil {
+		return report, fmt.Errorf("failed to list transferred proxies: %w", err)
+	}
+
+	var (
+		reservedZones      = make(map[string]struct{})
+		reservedSubdomains = make(map[string]struct{})
+		reservedProxies    = make(map[string]struct{})
+		missing            []*provision.Reservation
+	)
+
+	for _, reservation := range reservations {
+		var (
+			data struct {
+				Domain string `json:"domain"`
+			}
+			reserved map[string]struct{}
+			owners   map[string]string
+			formers  map[string][]string
+		)
+
+		switch reservation.Type {
+		case DomainDeleateReservation:
+			reserved, owners, formers = reservedZones, zones, transfers
+		case SubDomainReservation:
+			reserved, owners, formers = reservedSubdomains, subdomains, transfers
+		case ProxyReservation, ReverseProxyReservation:
+			reserved, owners, formers = reservedProxies, proxies, proxyTransfers
+		default:
+			continue
+		}
+
+		if err := json.Unmarshal(reservation.Data, &data); err != nil {
+			log.Error().Err(err).Str("id", reservation.ID).Msg("failed to decode cached reservation")
+			continue
+		}
+
+		// the configuration holds the ASCII form of the internationalized domain names
+		domain := normalizeDomain(data.Domain)
+		reserved[domain] = struct{}{}
+		if owners[domain] != reservation.User && !containsUser(formers[domain], reservation.User) {
+			report.Missing = append(report.Missing, reservation.ID)
+			missing = append(missing, reservation)
+		}
+	}
+
+	for zone := range zones {
+		if _, ok := reservedZones[zone]; !ok {
+			report.OrphanZones = append(report.OrphanZones, zone)
+		}
+	}
+
+	for subdomain := range subdomains {
+		if _, ok := reservedSubdomains[subdomain]; !ok {
+			report.OrphanSubdomains = append(report.OrphanSubdomains, subdomain)
+		}
+	}
+
+	for domain := range proxies {
+		if _, ok := reservedProxies[domain]; !ok {
+			report.OrphanProxies = append(report.OrphanProxies, domain)
+		}
+	}
+
+	sort.Strings(report.OrphanZones)
+	sort.Strings(report.OrphanSubdomains)
+	sort.Strings(report.OrphanProxies)
+	sort.Strings(report.Missing)
+
+	previous := r.previous
+	r.previous = report.differences()
+
+	if report.Empty() {
+		log.Debug().Msg("gateway configuration matches the reservation cache")
+		return report, nil
+	}
+
+	log.Warn().
+		Strs("orphan_zones", report.OrphanZones).
+		Strs("orphan_subdomains", report.OrphanSubdomains).
+		Strs("orphan_proxies", report.OrphanProxies).
+		Strs("missing", report.Missing).
+		Bool("repair", r.repair).
+		Msg("gateway configuration does not match the reservation cache")
+
+	if !r.repair {
+		return report, nil
+	}
+
+	r.removeOrphans(report, previous, zones, proxies)
+	r.provisionMissing(ctx, missing, previous)
+
+	return report, nil
+}
+
+// differences returns a key for each difference in the report
+func (r ReconcileReport) differences() map[string]struct{} {
+	diffs := make(map[string]struct{})
+	for _, zone := range r.OrphanZones {
+		diffs["zone:"+zone] = struct{}{}
+	}
+	for _, subdomain := range r.OrphanSubdomains {
+		diffs["subdomain:"+subdomain] = struct{}{}
+	}
+	for _, domain := range r.OrphanProxies {
+		diffs["proxy:"+domain] = struct{}{}
+	}
+	for _, id := range r.Missing {
+		diffs["missing:"+id] = struct{}{}
+	}
+	return diffs
+}
+
+func (r *Reconciler) removeOrphans(report ReconcileReport, previous map[string]struct{}, zones, proxies map[string]string) {
+	p := r.provisioner
+
+	for _, zone := range report.OrphanZones {
+		if _, ok := previous["zone:"+zone]; !ok {
+			continue
+		}
+		dns := p.dns.As(audit.Actor{User: zones[zone], Operation: "reconcile"})
+		if _, err := dns.RemoveDomainDelagate(zones[zone], zone); err != nil {
+			log.Error().Err(err).Str("zone", zone).Msg("failed to remove orphan zone")
+		}
+	}
+
+	for _, subdomain := range report.OrphanSubdomains {
+		if _, ok := previous["subdomain:"+subdomain]; !ok {
+			continue
+		}
+		if err := p.dns.As(audit.Actor{Operation: "reconcile"}).ReleaseSubdomain(subdomain); err != nil {
+			log.Error().Err(err).Str("subdomain", subdomain).Msg("failed to release orphan subdomain")
+		}
+	}
+
+	for _, domain := range report.OrphanProxies {
+		if _, ok := previous["proxy:"+domain]; !ok {
+			continue
+		}
+		proxy := p.proxy.As(audit.Actor{User: proxies[domain], Operation: "reconcile"})
+		if err := proxy.RemoveProxy(proxies[domain], domain); err != nil {
+			log.Error().Err(err).Str("domain", domain).Msg("failed to remove orphan proxy")
+		}
+	}
+}
+
+func (r *Reconciler) provisionMissing(ctx context.Context, reservations []*provision.Reservation, previous map[string]struct{}) {
+	for _, reservation := range reservations {
+		if _, ok := previous["missing:"+reservation.ID]; !ok {
+			continue
+		}
+
+		fn, ok := r.provisioner.Provisioners[reservation.Type]
+		if !ok {
+			continue
+		}
+
+		if _, err := fn(ctx, reservation); err != nil {
+			log.Error().Err(err).Str("id", reservation.ID).Msg("failed to provision reservation again")
+		}
+	}
+}
+
+func containsUser(users []string, user string) bool {
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package tfgateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/tfgateway/cache"
+	"github.com/threefoldtech/tfgateway/dns"
+	"github.com/threefoldtech/tfgateway/proxy"
+	"github.com/threefoldtech/tfgateway/redis"
+	"github.com/threefoldtech/zos/pkg/identity"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+func TestReconciler(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	gwid := "gwid"
+	dnsMgr := dns.New(pool, gwid)
+	proxyMgr := proxy.New(pool)
+	store := cache.NewRedis(pool)
+	p := NewProvisioner(proxyMgr, dnsMgr, nil, nil, nil, identity.KeyPair{}, nil)
+
+	reservation := func(id string, typ provision.ReservationType, data interface{}) *provision.Reservation {
+		b, err := json.Marshal(data)
+		require.NoError(t, err)
+		return &provision.Reservation{ID: id, NodeID: gwid, User: "user", Type: typ, Data: b}
+	}
+
+	require.NoError(t, dnsMgr.AddDomainDelagate(gwid, gwid, "gateway.tf"))
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+
+	// configured and reserved
+	require.NoError(t, dnsMgr.AddDomainDelagate(gwid, "user", "mydomain.com"))
+	require.NoError(t, dnsMgr.AddSubdomain("user", "app.gateway.tf", ips, 0))
+	require.NoError(t, proxyMgr.AddProxy("user", "app.gateway.tf", "10.1.1.10:80", 80, 443))
+	require.NoError(t, store.Add(reservation("1", DomainDeleateReservation, Delegate{Domain: "mydomain.com"})))
+	require.NoError(t, store.Add(reservation("2", SubDomainReservation, Subdomain{Domain: "app.gateway.tf", IPs: ips})))
+	require.NoError(t, store.Add(reservation("3", ProxyReservation, Proxy{Domain: "app.gateway.tf", Addr: "10.1.1.10:80", Port: 80, PortTLS: 443})))
+
+	// configured but not reserved
+	require.NoError(t, dnsMgr.AddDomainDelagate(gwid, "user", "orphan.com"))
+	require.NoError(t, dnsMgr.AddSubdomain("user", "orphan.gateway.tf", ips, 0))
+	require.NoError(t, proxyMgr.AddReverseProxy("user", "orphan.gateway.tf", "user:secret"))
+
+	// reserved but not configured
+	require.NoError(t, store.Add(reservation("4", SubDomainReservation, Subdomain{Domain: "missing.gateway.tf", IPs: ips})))
+
+	expected := ReconcileReport{
+		OrphanZones:      []string{"orphan.com"},
+		OrphanSubdomains: []string{"orphan.gateway.tf"},
+		OrphanProxies:    []string{"orphan.gateway.tf"},
+		Missing:          []string{"4"},
+	}
+
+	t.Run("report only", func(t *testing.T) {
+		reconciler := NewReconciler(store, p, false)
+		for i := 0; i < 2; i++ {
+			report, err := reconciler.Reconcile(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, expected, report)
+		}
+	})
+
+	t.Run("repair", func(t *testing.T) {
+		reconciler := NewReconciler(store, p, true)
+
+		report, err := reconciler.Reconcile(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, expected, report, "differences are only repaired when found twice")
+
+		report, err = reconciler.Reconcile(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, expected, report)
+
+		report, err = reconciler.Reconcile(context.Background())
+		require.NoError(t, err)
+		assert.True(t, report.Empty(), "%+v", report)
+
+		subdomains, err := dnsMgr.Subdomains()
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"app.gateway.tf": "user", "missing.gateway.tf": "user"}, subdomains)
+		assert.Equal(t, "", s.HGet("gateway.tf.", "orphan"))
+		assert.NotEqual(t, "", s.HGet("gateway.tf.", "missing"))
+	})
+}
@@ -51,7 +51,16 @@ func (p *Provisioner) reverseProxyProvision(ctx context.Context, r *provision.Re
 		return nil, err
 	}
 
-	return nil, p.proxy.AddReverseProxy(r.User, data.Domain, data.Secret)
+	domain, err := ParseDomainName(data.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.proxy.AddReverseProxy(r.User, domain.ASCII, data.Secret); err != nil {
+		return nil, domain.Wrap(err)
+	}
+
+	return domain.result(), nil
 }
 
 func (p *Provisioner) reverseProxyDecomission(ctx context.Context, r *provision.Reservation) error {
@@ -61,5 +70,20 @@ func (p *Provisioner) reverseProxyDecomission(ctx context.Context, r *provision.
 	}
 	log.Info().Str("id", r.ID).Msgf("decomission proxy %+v", data)
 
-	return p.proxy.RemoveReverseProxy(r.User, data.Domain)
+	domain, err := ParseDomainName(data.Domain)
+	if err != nil {
+		return err
+	}
+
+	released, err := p.proxy.ReleaseTransfer(r.User, domain.ASCII)
+	if err != nil {
+		return domain.Wrap(err)
+	}
+	if released {
+		// the proxy now belongs to the user it was transferred to
+		log.Info().Str("id", r.ID).Msgf("reverse proxy %s was transferred, released the reservation", domain)
+		return nil
+	}
+
+	return domain.Wrap(p.proxy.RemoveReverseProxy(r.User, domain.ASCII))
 }
@@ -0,0 +1,194 @@
+// Package reserved implements the list of labels users cannot reserve
+// under the domains managed by the gateway
+package reserved
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ErrReserved is returned when a user tries to use a label that
+// is reserved or blocked by the operator of the gateway
+var ErrReserved = errors.New("label reserved by the gateway")
+
+// rule matches a label
+type rule interface {
+	match(label string) bool
+}
+
+type exact string
+
+func (e exact) match(label string) bool {
+	return string(e) == label
+}
+
+type glob string
+
+func (g glob) match(label string) bool {
+	ok, _ := path.Match(string(g), label)
+	return ok
+}
+
+type pattern struct {
+	*regexp.Regexp
+}
+
+func (p pattern) match(label string) bool {
+	return p.MatchString(label)
+}
+
+// Labels is the list of labels that cannot be used directly under the
+// domains managed by the gateway. The list is read from a file where
+// each line is a rule. A label, like www, is reserved. A glob, like paypal*,
+// and a regular expression prefixed with regex:, like regex:^paypal-,
+// block the labels they match. Empty lines and lines starting with # are ignored. Labels are compared case insensitively
+type Labels struct {
+	path    string
+	domains []string
+
+	m       sync.RWMutex
+	rules   []rule
+	modTime time.Time
+}
+
+// Load reads the rules from the file at path. They apply to the labels right
+// under domains, the domains managed by the gateway
+func Load(path string, domains []string) (*Labels, error) {
+	l := &Labels{path: path}
+	for _, domain := range domains {
+		l.domains = append(l.domains, strings.ToLower(strings.TrimSuffix(domain, ".")))
+	}
+
+	if err := l.reload(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Watch reloads the rules every interval if the file changed, until ctx is done.
+// If the file cannot be read, the previous rules are kept
+func (l *Labels) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := l.reload(); err != nil {
+			log.Error().Err(err).Str("path", l.path).Msg("failed to reload reserved labels, keeping the previous ones")
+		}
+	}
+}
+
+// Check returns ErrReserved if domain is a subdomain of a managed domain
+// and its label right under the managed domain is reserved or blocked
+func (l *Labels) Check(domain string) error {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+
+	var label string
+	for _, managed := range l.domains {
+		if strings.HasSuffix(domain, "."+managed) {
+			labels := strings.Split(strings.TrimSuffix(domain, "."+managed), ".")
+			label = labels[len(labels)-1]
+			break
+		}
+	}
+
+	if label == "" {
+		return nil
+	}
+
+	l.m.RLock()
+	defer l.m.RUnlock()
+
+	for _, rule := range l.rules {
+		if rule.match(label) {
+			return fmt.Errorf("cannot use %s: %w", domain, ErrReserved)
+		}
+	}
+
+	return nil
+}
+
+func (l *Labels) reload() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+
+	l.m.RLock()
+	unchanged := info.ModTime().Equal(l.modTime)
+	l.m.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	rules, err := parse(f)
+	if err != nil {
+		return fmt.Errorf("failed to parse reserved labels file %s: %w", l.path, err)
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.rules = rules
+	l.modTime = info.ModTime()
+
+	log.Info().Str("path", l.path).Int("rules", len(rules)).Msg("reserved labels loaded")
+	return nil
+}
+
+func parse(r io.Reader) ([]rule, error) {
+	var rules []rule
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if expr := strings.TrimPrefix(line, "regex:"); expr != line {
+			re, err := regexp.Compile("(?i)" + expr)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			rules = append(rules, pattern{re})
+			continue
+		}
+
+		line = strings.ToLower(line)
+		if strings.ContainsAny(line, "*?[") {
+			if _, err := path.Match(line, ""); err != nil {
+				return nil, fmt.Errorf("line %d: invalid glob %s: %w", n, line, err)
+			}
+			rules = append(rules, glob(line))
+			continue
+		}
+
+		rules = append(rules, exact(line))
+	}
+
+	return rules, scanner.Err()
+}
@@ -0,0 +1,89 @@
+package reserved
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reserved")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "reserved")
+	err = ioutil.WriteFile(path, []byte(`# reserved labels
+www
+MAIL
+ns?
+
+paypal*
+regex:^(admin|root)-?[0-9]*$
+`), 0644)
+	require.NoError(t, err)
+
+	labels, err := Load(path, []string{"gateway.tf", "Other.TF."})
+	require.NoError(t, err)
+
+	tt := []struct {
+		domain   string
+		reserved bool
+	}{
+		{"www.gateway.tf", true},
+		{"WWW.gateway.tf", true},
+		{"mail.other.tf", true},
+		{"ns1.gateway.tf", true},
+		{"ns10.gateway.tf", false},
+		{"paypal-login.gateway.tf", true},
+		{"admin.gateway.tf", true},
+		{"admin-2.gateway.tf", true},
+		{"administrator.gateway.tf", false},
+		{"*.www.gateway.tf", true},
+		{"app.www.gateway.tf", true},
+		{"www.app.gateway.tf", false},
+		{"app.gateway.tf", false},
+		{"www.mydomain.com", false},
+		{"gateway.tf", false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.domain, func(t *testing.T) {
+			err := labels.Check(tc.domain)
+			if tc.reserved {
+				assert.True(t, errors.Is(err, ErrReserved), "%v", err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go labels.Watch(ctx, 10*time.Millisecond)
+
+		require.NoError(t, ioutil.WriteFile(path, []byte("app\n"), 0644))
+		// make sure the modification time changes on file systems with a coarse resolution
+		require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+
+		assert.Eventually(t, func() bool {
+			return labels.Check("app.gateway.tf") != nil
+		}, time.Second, 10*time.Millisecond)
+		assert.NoError(t, labels.Check("www.gateway.tf"))
+
+		require.NoError(t, ioutil.WriteFile(path, []byte("regex:(\n"), 0644))
+		require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+		time.Sleep(50 * time.Millisecond)
+		assert.Error(t, labels.Check("app.gateway.tf"), "an invalid file does not replace the rules")
+	})
+
+	_, err = Load(filepath.Join(dir, "missing"), nil)
+	assert.Error(t, err)
+}
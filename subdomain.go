@@ -2,8 +2,11 @@ package tfgateway
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"strings"
 
+	"github.com/threefoldtech/tfgateway/dns"
 	"github.com/threefoldtech/zos/pkg/provision"
 
 	"encoding/json"
@@ -13,8 +16,78 @@ import (
 
 // Subdomain defines a sub-domain from a mangaged or delagated domain
 type Subdomain struct {
-	Domain string   `json:"domain"`
-	IPs    []net.IP `json:"destination"`
+	Domain string         `json:"domain"`
+	IPs    []net.IP       `json:"destination"`
+	MX     []dns.RecordMX `json:"mx,omitempty"`
+	// CNAME makes the subdomain an alias of an external host.
+	// It cannot be used together with IPs
+	CNAME string `json:"cname,omitempty"`
+	// HealthCheck of the IPs, the unhealthy IPs are temporarily
+	// removed from the DNS records
+	HealthCheck *dns.HealthCheck `json:"healthcheck,omitempty"`
+	// Weights and Regions of the IPs, indexed by IP. They steer the
+	// clients between the IPs, see dns.Target
+	Weights map[string]int    `json:"weights,omitempty"`
+	Regions map[string]string `json:"regions,omitempty"`
+	// TTL of the records, the gateway uses its default TTL if not set
+	TTL int `json:"ttl,omitempty"`
+}
+
+// targets returns the IPs of the subdomain with their weight and region
+func (s Subdomain) targets() ([]dns.Target, error) {
+	targets := make([]dns.Target, 0, len(s.IPs))
+	index := make(map[string]int, len(s.IPs))
+	for i, ip := range s.IPs {
+		index[ip.String()] = i
+		targets = append(targets, dns.Target{IP: ip})
+	}
+
+	// the IPs used as keys are not necessarily written in their canonical form
+	find := func(key, what string) (*dns.Target, error) {
+		i, ok := index[net.ParseIP(key).String()]
+		if !ok {
+			return nil, fmt.Errorf("subdomain %s has a %s for %s, which is not one of its destinations", s.Domain, what, key)
+		}
+		return &targets[i], nil
+	}
+
+	for ip, weight := range s.Weights {
+		target, err := find(ip, "weight")
+		if err != nil {
+			return nil, err
+		}
+		target.Weight = weight
+	}
+
+	for ip, region := range s.Regions {
+		target, err := find(ip, "region")
+		if err != nil {
+			return nil, err
+		}
+		target.Region = region
+	}
+
+	return targets, nil
+}
+
+// normalize converts the domain and the CNAME target of the subdomain
+// to their ASCII form, and returns both forms of the domain
+func (s *Subdomain) normalize() (DomainName, error) {
+	domain, err := ParseDomainName(s.Domain)
+	if err != nil {
+		return domain, err
+	}
+	s.Domain = domain.ASCII
+
+	if s.CNAME != "" {
+		cname, err := ParseDomainName(strings.TrimSuffix(s.CNAME, "."))
+		if err != nil {
+			return domain, domain.Wrap(fmt.Errorf("invalid CNAME target: %w", err))
+		}
+		s.CNAME = cname.ASCII
+	}
+
+	return domain, nil
 }
 
 func (p *Provisioner) subDomainProvision(ctx context.Context, r *provision.Reservation) (interface{}, error) {
@@ -24,7 +97,83 @@ func (p *Provisioner) subDomainProvision(ctx context.Context, r *provision.Reser
 	}
 	log.Info().Str("id", r.ID).Msgf("provision Sudbomain %+v", data)
 
-	return nil, p.dns.AddSubdomain(r.User, data.Domain, data.IPs)
+	domain, err := data.normalize()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.subDomainProvisionImpl(r, data); err != nil {
+		return nil, domain.Wrap(err)
+	}
+
+	return domain.result(), nil
+}
+
+func (p *Provisioner) subDomainProvisionImpl(r *provision.Reservation, data Subdomain) error {
+	if data.CNAME != "" {
+		if len(data.IPs) > 0 {
+			return fmt.Errorf("subdomain %s cannot have both a destination and a CNAME", data.Domain)
+		}
+		if len(data.Weights) > 0 || len(data.Regions) > 0 {
+			return fmt.Errorf("subdomain %s cannot have weights or regions with a CNAME", data.Domain)
+		}
+		if data.HealthCheck != nil {
+			return fmt.Errorf("subdomain %s cannot have a health check with a CNAME", data.Domain)
+		}
+		return p.dns.AddSubdomainCNAME(r.User, data.Domain, data.CNAME, data.TTL)
+	}
+
+	if data.HealthCheck != nil {
+		if err := data.HealthCheck.Valid(); err != nil {
+			return err
+		}
+	}
+
+	if err := dns.ValidateMX(data.MX); err != nil {
+		return err
+	}
+
+	targets, err := data.targets()
+	if err != nil {
+		return err
+	}
+
+	if err := p.dns.AddSubdomainTargets(r.User, data.Domain, targets, data.TTL); err != nil {
+		return err
+	}
+
+	if data.HealthCheck != nil {
+		if err := p.dns.SetHealthCheck(r.User, data.Domain, *data.HealthCheck); err != nil {
+			// a failed reservation is never decommissioned, the subdomain is released now
+			p.releaseSubdomain(r, data)
+			return err
+		}
+	}
+
+	if len(data.MX) == 0 {
+		return nil
+	}
+
+	if err := p.dns.AddMX(r.User, data.Domain, data.MX); err != nil {
+		p.releaseSubdomain(r, data)
+		return err
+	}
+
+	return nil
+}
+
+// releaseSubdomain removes the health check and the subdomain
+// reserved by a reservation that failed
+func (p *Provisioner) releaseSubdomain(r *provision.Reservation, data Subdomain) {
+	if data.HealthCheck != nil {
+		if err := p.dns.RemoveHealthCheck(r.User, data.Domain); err != nil {
+			log.Error().Err(err).Str("id", r.ID).Msgf("failed to remove the health check of subdomain %s", data.Domain)
+		}
+	}
+
+	if err := p.dns.RemoveSubdomain(r.User, data.Domain, data.IPs); err != nil {
+		log.Error().Err(err).Str("id", r.ID).Msgf("failed to release subdomain %s", data.Domain)
+	}
 }
 
 func (p *Provisioner) subDomainDecomission(ctx context.Context, r *provision.Reservation) error {
@@ -34,5 +183,34 @@ func (p *Provisioner) subDomainDecomission(ctx context.Context, r *provision.Res
 	}
 	log.Info().Str("id", r.ID).Msgf("decomission Sudbomain %+v", data)
 
+	domain, err := data.normalize()
+	if err != nil {
+		return err
+	}
+
+	return domain.Wrap(p.subDomainDecomissionImpl(r, data))
+}
+
+func (p *Provisioner) subDomainDecomissionImpl(r *provision.Reservation, data Subdomain) error {
+	released, err := p.dns.ReleaseTransfer(r.User, data.Domain)
+	if err != nil {
+		return err
+	}
+	if released {
+		// the subdomain now belongs to the user it was transferred to
+		log.Info().Str("id", r.ID).Msgf("subdomain %s was transferred, released the reservation", data.Domain)
+		return nil
+	}
+
+	if data.CNAME != "" {
+		return p.dns.RemoveSubdomainCNAME(r.User, data.Domain, data.CNAME)
+	}
+
+	if len(data.MX) > 0 {
+		if err := p.dns.RemoveMX(r.User, data.Domain, data.MX); err != nil {
+			return err
+		}
+	}
+
 	return p.dns.RemoveSubdomain(r.User, data.Domain, data.IPs)
 }
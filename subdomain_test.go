@@ -0,0 +1,122 @@
+package tfgateway
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/tfgateway/dns"
+	"github.com/threefoldtech/tfgateway/proxy"
+	"github.com/threefoldtech/tfgateway/redis"
+	"github.com/threefoldtech/zos/pkg/identity"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+func TestSubdomainTargets(t *testing.T) {
+	subdomain := Subdomain{
+		Domain:  "app.gateway.tf",
+		IPs:     []net.IP{net.ParseIP("10.1.1.10"), net.ParseIP("2a02:1800::1")},
+		Weights: map[string]int{"10.1.1.10": 3},
+		Regions: map[string]string{"2a02:1800:0:0::1": "eu"},
+	}
+
+	targets, err := subdomain.targets()
+	require.NoError(t, err)
+	assert.Equal(t, []dns.Target{
+		{IP: subdomain.IPs[0], Weight: 3},
+		{IP: subdomain.IPs[1], Region: "eu"},
+	}, targets)
+
+	subdomain.Weights["10.1.1.11"] = 1
+	_, err = subdomain.targets()
+	assert.Error(t, err)
+}
+
+func TestProvisionFailure(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	gwid := "gwid"
+	dnsMgr := dns.New(pool, gwid)
+	require.NoError(t, dnsMgr.AddDomainDelagate(gwid, gwid, "gateway.tf"))
+
+	p := NewProvisioner(proxy.New(pool), dnsMgr, nil, nil, nil, identity.KeyPair{}, nil)
+
+	reservation := func(typ provision.ReservationType, data interface{}) *provision.Reservation {
+		b, err := json.Marshal(data)
+		require.NoError(t, err)
+		return &provision.Reservation{ID: "1", NodeID: gwid, User: "user", Type: typ, Data: b}
+	}
+
+	// the failed reservations are never decommissioned, they must not leave anything behind
+	t.Run("subdomain", func(t *testing.T) {
+		subdomain := reservation(SubDomainReservation, Subdomain{
+			Domain: "app.gateway.tf",
+			IPs:    []net.IP{net.ParseIP("10.1.1.10")},
+			MX:     []dns.RecordMX{{Host: "not a host", Preference: 10}},
+		})
+		_, err := p.Provisioners[SubDomainReservation](context.Background(), subdomain)
+		require.Error(t, err)
+
+		owners, err := dnsMgr.Subdomains()
+		require.NoError(t, err)
+		assert.NotContains(t, owners, "app.gateway.tf")
+		assert.Empty(t, s.HGet("gateway.tf.", "app"))
+	})
+
+	t.Run("health check", func(t *testing.T) {
+		// private backends cannot be checked
+		subdomain := reservation(SubDomainReservation, Subdomain{
+			Domain:      "app.gateway.tf",
+			IPs:         []net.IP{net.ParseIP("10.1.1.10")},
+			HealthCheck: &dns.HealthCheck{Protocol: dns.HealthCheckTCP, Port: 80},
+		})
+		_, err := p.Provisioners[SubDomainReservation](context.Background(), subdomain)
+		require.Error(t, err)
+
+		owners, err := dnsMgr.Subdomains()
+		require.NoError(t, err)
+		assert.NotContains(t, owners, "app.gateway.tf")
+		assert.Empty(t, s.HGet("gateway.tf.", "app"))
+
+		checks, err := dnsMgr.HealthChecks()
+		require.NoError(t, err)
+		assert.Empty(t, checks)
+	})
+
+	t.Run("delegate", func(t *testing.T) {
+		delegate := reservation(DomainDeleateReservation, Delegate{
+			Domain: "mydomain.com",
+			MX:     []dns.RecordMX{{Host: "mail.mydomain.com", Preference: -1}},
+		})
+		_, err := p.Provisioners[DomainDeleateReservation](context.Background(), delegate)
+		require.Error(t, err)
+
+		zones, err := dnsMgr.DelegatedZones()
+		require.NoError(t, err)
+		assert.NotContains(t, zones, "mydomain.com")
+		assert.False(t, s.Exists("mydomain.com."))
+
+		delegate = reservation(DomainDeleateReservation, Delegate{
+			Domain: "mydomain.com",
+			MX:     []dns.RecordMX{{Host: "mail.mydomain.com", Preference: 10}},
+			CAA:    []dns.RecordCAA{{Tag: "unknown", Value: "letsencrypt.org"}},
+		})
+		_, err = p.Provisioners[DomainDeleateReservation](context.Background(), delegate)
+		require.Error(t, err)
+
+		zones, err = dnsMgr.DelegatedZones()
+		require.NoError(t, err)
+		assert.NotContains(t, zones, "mydomain.com")
+		assert.False(t, s.Exists("mydomain.com."))
+	})
+}
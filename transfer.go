@@ -0,0 +1,90 @@
+package tfgateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+	"github.com/threefoldtech/tfgateway/audit"
+)
+
+// TransferRequest is the body of the request sent to the transfer API to give
+// Domain, a delegated domain or a subdomain of a managed domain, from user From
+// to user To. Both users must consent to the transfer by signing SigningMessage
+// with the key registered in the explorer phonebook. Nonce is a random string,
+// a nonce is only accepted once by the gateway
+type TransferRequest struct {
+	Domain    string `json:"domain"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Nonce     string `json:"nonce"`
+	Timestamp int64  `json:"timestamp"`
+	// FromSignature and ToSignature are the hex encoded
+	// signatures of SigningMessage by From and To
+	FromSignature string `json:"from_signature"`
+	ToSignature   string `json:"to_signature"`
+}
+
+// SigningMessage returns the message signed by both users for a request
+// sent with method to path of the gateway with identity gateway
+func (r TransferRequest) SigningMessage(method, path, gateway string) []byte {
+	return []byte(fmt.Sprintf("%s:%s:%s:%s:%s:%s:%s:%d", method, path, gateway, r.Domain, r.From, r.To, r.Nonce, r.Timestamp))
+}
+
+// TransferDomain gives domain from user from to user to. The ownership of the
+// domain, of its subdomains and of its proxies change in a single transaction
+func (p *Provisioner) TransferDomain(from, to, domain string) error {
+	dns := p.dns.As(audit.Actor{User: from, Operation: fmt.Sprintf("transfer to %s", to)})
+	return dns.TransferDomain(from, to, domain, p.proxy.TransferDomain(from, to, domain))
+}
+
+type transferHandler struct {
+	provisioner *Provisioner
+	keys        userKeyFetcher
+	gateway     string
+	nonces      *nonceStore
+}
+
+func (h *transferHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	consents := []struct {
+		user      string
+		signature string
+	}{
+		{req.From, req.FromSignature},
+		{req.To, req.ToSignature},
+	}
+
+	msg := req.SigningMessage(r.Method, r.URL.Path, h.gateway)
+	for _, consent := range consents {
+		if err := verifySignature(h.keys, consent.user, msg, consent.signature, req.Timestamp); err != nil {
+			log.Warn().Err(err).Str("domain", req.Domain).Str("from", req.From).Str("to", req.To).Msg("refused transfer request")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if err := h.nonces.use(req.From, req.Nonce, req.Timestamp); err != nil {
+		log.Warn().Err(err).Str("domain", req.Domain).Str("from", req.From).Str("to", req.To).Msg("refused transfer request")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.provisioner.TransferDomain(req.From, req.To, req.Domain); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
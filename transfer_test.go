@@ -0,0 +1,212 @@
+package tfgateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/threefoldtech/tfgateway/cache"
+	"github.com/threefoldtech/tfgateway/dns"
+	"github.com/threefoldtech/tfgateway/proxy"
+	"github.com/threefoldtech/tfgateway/redis"
+	"github.com/threefoldtech/zos/pkg/identity"
+	"github.com/threefoldtech/zos/pkg/provision"
+)
+
+func TestTransferHandler(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	gwid := "gwid"
+	dnsMgr := dns.New(pool, gwid)
+	proxyMgr := proxy.New(pool)
+	p := NewProvisioner(proxyMgr, dnsMgr, nil, nil, nil, identity.KeyPair{}, nil)
+
+	require.NoError(t, dnsMgr.AddDomainDelagate(gwid, "1", "example.com"))
+	require.NoError(t, dnsMgr.AddSubdomain("1", "www.example.com", []net.IP{net.ParseIP("10.1.1.10")}, 0))
+	require.NoError(t, proxyMgr.AddProxy("1", "www.example.com", "10.1.1.10:80", 80, 443))
+	require.NoError(t, proxyMgr.AddReverseProxy("1", "app.example.com", "1:secret"))
+	require.NoError(t, proxyMgr.AddProxy("1", "www.other.com", "10.1.1.10:80", 80, 443))
+
+	keys := make(map[string]ed25519.PrivateKey)
+	for _, user := range []string{"1", "2", "3"} {
+		_, sk, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+		keys[user] = sk
+	}
+
+	handler := &transferHandler{
+		provisioner: p,
+		keys: func(user string) (ed25519.PublicKey, error) {
+			return keys[user].Public().(ed25519.PublicKey), nil
+		},
+		gateway: gwid,
+		nonces:  newNonceStore(),
+	}
+
+	signed := func(gateway string, req TransferRequest, fromKey, toKey ed25519.PrivateKey) []byte {
+		msg := req.SigningMessage(http.MethodPost, "/transfer", gateway)
+		req.FromSignature = hex.EncodeToString(ed25519.Sign(fromKey, msg))
+		req.ToSignature = hex.EncodeToString(ed25519.Sign(toKey, msg))
+		b, err := json.Marshal(req)
+		require.NoError(t, err)
+		return b
+	}
+
+	post := func(b []byte) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewReader(b)))
+		return w.Code
+	}
+
+	send := func(req TransferRequest, fromKey, toKey ed25519.PrivateKey) int {
+		return post(signed(gwid, req, fromKey, toKey))
+	}
+
+	req := TransferRequest{Domain: "example.com", From: "1", To: "2", Nonce: "1", Timestamp: time.Now().Unix()}
+
+	assert.Equal(t, http.StatusUnauthorized, send(req, keys["1"], keys["3"]), "new owner did not consent")
+	assert.Equal(t, http.StatusUnauthorized, send(req, keys["3"], keys["2"]), "old owner did not consent")
+
+	stolen := req
+	stolen.From = "3"
+	assert.Equal(t, http.StatusForbidden, send(stolen, keys["3"], keys["2"]))
+
+	assert.Equal(t, http.StatusUnauthorized, post(signed("other-gateway", req, keys["1"], keys["2"])), "signed for another gateway")
+
+	captured := signed(gwid, req, keys["1"], keys["2"])
+	assert.Equal(t, http.StatusNoContent, post(captured))
+
+	zones, err := dnsMgr.DelegatedZones()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"example.com": "2"}, zones)
+
+	subdomains, err := dnsMgr.Subdomains()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"www.example.com": "2"}, subdomains)
+
+	services, err := proxyMgr.Services()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"www.example.com": "2",
+		"app.example.com": "2",
+		"www.other.com":   "1",
+	}, services)
+
+	// the domain is given back to user 1, the captured
+	// request can not be replayed to take it again
+	back := TransferRequest{Domain: "example.com", From: "2", To: "1", Nonce: "2", Timestamp: time.Now().Unix()}
+	assert.Equal(t, http.StatusNoContent, send(back, keys["2"], keys["1"]))
+	assert.Equal(t, http.StatusUnauthorized, post(captured))
+
+	zones, err = dnsMgr.DelegatedZones()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"example.com": "1"}, zones)
+}
+
+func TestDecommissionAfterTransfer(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	pool, err := redis.NewPool(fmt.Sprintf("tcp://%s", s.Addr()))
+	require.NoError(t, err)
+
+	gwid := "gwid"
+	dnsMgr := dns.New(pool, gwid)
+	proxyMgr := proxy.New(pool)
+	store := cache.NewRedis(pool)
+	p := NewProvisioner(proxyMgr, dnsMgr, nil, nil, nil, identity.KeyPair{}, nil)
+	require.NoError(t, dnsMgr.AddDomainDelagate(gwid, gwid, "gateway.tf"))
+
+	reservation := func(id, user string, typ provision.ReservationType, data interface{}) *provision.Reservation {
+		b, err := json.Marshal(data)
+		require.NoError(t, err)
+		return &provision.Reservation{ID: id, NodeID: gwid, User: user, Type: typ, Data: b}
+	}
+
+	ips := []net.IP{net.ParseIP("10.1.1.10")}
+	reservations := func(id, user string) []*provision.Reservation {
+		return []*provision.Reservation{
+			reservation(id+"-delegate", user, DomainDeleateReservation, Delegate{Domain: "example.com"}),
+			reservation(id+"-subdomain", user, SubDomainReservation, Subdomain{Domain: "app.gateway.tf", IPs: ips}),
+			reservation(id+"-proxy", user, ProxyReservation, Proxy{Domain: "app.gateway.tf", Addr: "10.1.1.10", Port: 80, PortTLS: 443}),
+		}
+	}
+
+	provisionAll := func(reservations []*provision.Reservation) {
+		for _, r := range reservations {
+			_, err := p.Provisioners[r.Type](context.Background(), r)
+			require.NoError(t, err, r.ID)
+			require.NoError(t, store.Add(r))
+		}
+	}
+
+	reconcile := func() ReconcileReport {
+		report, err := NewReconciler(store, p, false).Reconcile(context.Background())
+		require.NoError(t, err)
+		return report
+	}
+
+	original := reservations("1", "user1")
+	provisionAll(original)
+
+	require.NoError(t, p.TransferDomain("user1", "user2", "example.com"))
+	require.NoError(t, p.TransferDomain("user1", "user2", "app.gateway.tf"))
+
+	// the reservations of the former owner still hold the domains
+	assert.True(t, reconcile().Empty())
+
+	// the new owner takes the domains over with its own reservations
+	provisionAll(reservations("2", "user2"))
+	assert.True(t, reconcile().Empty())
+
+	for _, r := range original {
+		require.NoError(t, p.Decommissioners[r.Type](context.Background(), r), r.ID)
+		require.NoError(t, store.Remove(r.ID))
+	}
+
+	zones, err := dnsMgr.DelegatedZones()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"example.com": "user2"}, zones)
+
+	subdomains, err := dnsMgr.Subdomains()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"app.gateway.tf": "user2"}, subdomains)
+
+	services, err := proxyMgr.Services()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"app.gateway.tf": "user2"}, services)
+
+	transfers, err := dnsMgr.Transfers()
+	require.NoError(t, err)
+	assert.Empty(t, transfers)
+	assert.True(t, reconcile().Empty())
+
+	t.Run("without reservation of the new owner", func(t *testing.T) {
+		r := reservation("3-subdomain", "user2", SubDomainReservation, Subdomain{Domain: "www.gateway.tf", IPs: ips})
+		provisionAll([]*provision.Reservation{r})
+		require.NoError(t, p.TransferDomain("user2", "user3", "www.gateway.tf"))
+
+		require.NoError(t, p.Decommissioners[r.Type](context.Background(), r))
+		require.NoError(t, store.Remove(r.ID))
+
+		// the subdomain is not held by any reservation anymore
+		assert.Equal(t, []string{"www.gateway.tf"}, reconcile().OrphanSubdomains)
+	})
+}
@@ -137,10 +137,15 @@ func (m *Mgr) Close() error {
 	// return namespace.Delete(netns)
 }
 
+// PeerIP returns the address allocated to the peers of user
+func (m *Mgr) PeerIP(user string) (net.IP, error) {
+	return m.ipAlloc.Get([]byte(user))
+}
+
 // AddPeer addd a peer identified by pubkey to the wireguard network
 // The peer address is allocated from the manager pool and returned to the caller
 func (m *Mgr) AddPeer(user, pubKey string) (PeerConfig, error) {
-	ip, err := m.ipAlloc.Get([]byte(user))
+	ip, err := m.PeerIP(user)
 	if err != nil {
 		return PeerConfig{}, err
 	}